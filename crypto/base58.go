@@ -41,6 +41,9 @@ func Base58Decode(b, alphabet string) ([]byte, error) {
 	flen := numZeros + len(tmpval)
 	val := make([]byte, flen, flen)
 	copy(val[numZeros:], tmpval)
+	if len(val) < 5 {
+		return nil, fmt.Errorf("Base58 string too short: %s", b)
+	}
 
 	// Check checksum
 	checksum, err := DoubleSha256(val[0 : len(val)-4])
@@ -2,7 +2,9 @@ package crypto
 
 import (
 	"crypto/sha512"
+	"fmt"
 	"math/big"
+	"runtime"
 )
 
 var maxNonce = big.NewInt(0).SetUint64(1 << 23)
@@ -11,11 +13,15 @@ type ProofOfWork struct {
 	Challenge  *big.Int
 	Target     *big.Int
 	Iterations int
-	first      []byte
-	second     []byte
 }
 
 func (pow *ProofOfWork) Next(nonce []byte) (*big.Int, error) {
+	return pow.next(nonce, make([]byte, pow.Iterations*32))
+}
+
+// next hashes nonce using second as scratch space, so each concurrent caller
+// needs its own
+func (pow *ProofOfWork) next(nonce, second []byte) (*big.Int, error) {
 	first := make([]byte, 96)
 	copy(first, pow.Challenge.Bytes())
 	copy(first[64-len(nonce):], nonce)
@@ -25,10 +31,10 @@ func (pow *ProofOfWork) Next(nonce []byte) (*big.Int, error) {
 			return nil, err
 		}
 		copy(first[64:], hasher.Sum(nil)[:32])
-		copy(pow.second[i*32:], first[64:])
+		copy(second[i*32:], first[64:])
 		hasher.Reset()
 	}
-	if _, err := hasher.Write(pow.second); err != nil {
+	if _, err := hasher.Write(second); err != nil {
 		return nil, err
 	}
 	return big.NewInt(0).SetBytes(hasher.Sum(nil)[:32]), nil
@@ -39,22 +45,67 @@ func NewProofOfWork(challenge, target []byte, iterations uint32) *ProofOfWork {
 		Challenge:  big.NewInt(0).SetBytes(challenge),
 		Target:     big.NewInt(0).SetBytes(target),
 		Iterations: int(iterations),
-		second:     make([]byte, iterations*32),
 	}
 }
 
+// Solve searches for a nonce with a worker for each CPU
 func (pow *ProofOfWork) Solve() ([]byte, error) {
-	for nonce := big.NewInt(0); ; nonce.Add(nonce, one) {
-		result, err := pow.Next(nonce.Bytes())
+	return pow.SolveParallel(runtime.NumCPU(), nil)
+}
+
+// SolveParallel splits the nonces between workers and returns the first
+// solution found. The solution is nil if there is none below the maximum
+// nonce. Closing cancel abandons the search.
+func (pow *ProofOfWork) SolveParallel(workers int, cancel <-chan struct{}) ([]byte, error) {
+	if workers < 1 {
+		workers = 1
+	}
+	type result struct {
+		nonce []byte
+		err   error
+	}
+	results := make(chan result, workers)
+	done := make(chan struct{})
+	defer close(done)
+	step := big.NewInt(int64(workers))
+	for i := 0; i < workers; i++ {
+		go func(start *big.Int) {
+			nonce, err := pow.search(start, step, done)
+			results <- result{nonce, err}
+		}(big.NewInt(int64(i)))
+	}
+	for i := 0; i < workers; i++ {
+		select {
+		case r := <-results:
+			if r.err != nil || r.nonce != nil {
+				return r.nonce, r.err
+			}
+		case <-cancel:
+			return nil, fmt.Errorf("Proof of work cancelled")
+		}
+	}
+	return nil, nil
+}
+
+// search tries every step'th nonce from nonce until one meets the target or
+// done is closed
+func (pow *ProofOfWork) search(nonce, step *big.Int, done <-chan struct{}) ([]byte, error) {
+	second := make([]byte, pow.Iterations*32)
+	for ; nonce.Cmp(maxNonce) < 0; nonce.Add(nonce, step) {
+		select {
+		case <-done:
+			return nil, nil
+		default:
+		}
+		result, err := pow.next(nonce.Bytes(), second)
 		switch {
 		case err != nil:
 			return nil, err
-		case nonce.Cmp(maxNonce) >= 0:
-			return []byte(nil), nil
 		case result.Cmp(pow.Target) <= 0:
 			return nonce.Bytes(), nil
 		}
 	}
+	return nil, nil
 }
 
 func (pow *ProofOfWork) Check(nonce []byte) (bool, error) {
@@ -58,3 +58,26 @@ func (p *PowSuite) TestProofOfWork(c *C) {
 		c.Check(solution, Equals, true)
 	}
 }
+
+func (p *PowSuite) TestProofOfWorkParallel(c *C) {
+	t := powTests[0]
+	for _, workers := range []int{1, 3} {
+		pow := NewProofOfWork(hexToBytes(t.challenge), hexToBytes(t.target), t.iterations)
+		nonce, err := pow.SolveParallel(workers, nil)
+		c.Assert(err, IsNil)
+		c.Assert(nonce, NotNil)
+		found, err := pow.Check(nonce)
+		c.Check(err, IsNil)
+		c.Check(found, Equals, true)
+	}
+}
+
+func (p *PowSuite) TestProofOfWorkCancel(c *C) {
+	t := powTests[0]
+	pow := NewProofOfWork(hexToBytes(t.challenge), make([]byte, 32), t.iterations)
+	cancel := make(chan struct{})
+	close(cancel)
+	nonce, err := pow.SolveParallel(2, cancel)
+	c.Check(err, NotNil)
+	c.Check(nonce, IsNil)
+}
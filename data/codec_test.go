@@ -60,3 +60,23 @@ func (s *CodecSuite) TestParseNodes(c *C) {
 		c.Assert(string(b2h(n.Raw()))[16:], Equals, test.Encoded[16:], msg)
 	}
 }
+
+func (s *CodecSuite) TestNodeFormats(c *C) {
+	for _, test := range internal.MatchingNodes {
+		b := test.Bytes()
+		sequence := uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+		n, err := NewNodeFromPrefix(b[9:], NT_TRANSACTION_NODE, sequence)
+		c.Assert(err, IsNil)
+		msg := dump(test, n)
+		c.Assert(string(b2h(n.Raw())), Equals, test.Encoded, msg)
+		prefix, err := NodePrefix(n)
+		c.Assert(err, IsNil, msg)
+		c.Assert(string(b2h(prefix)), Equals, test.Encoded[18:], msg)
+		wire, err := NodeWire(n)
+		c.Assert(err, IsNil, msg)
+		w, err := NewNodeFromWire(wire, NT_TRANSACTION_NODE, sequence)
+		c.Assert(err, IsNil, msg)
+		c.Assert(w.Hash(), Equals, n.Hash(), msg)
+		c.Assert(string(b2h(w.Raw())), Equals, test.Encoded, msg)
+	}
+}
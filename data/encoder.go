@@ -72,7 +72,36 @@ func (enc *Encoder) Validation(v *Validation, ignoreSigningFields bool) error {
 	return nil
 }
 
+func (enc *Encoder) Proposal(p *Proposal) error {
+	enc.reset()
+	if err := enc.HashPrefix(enc.hash, p); err != nil {
+		return err
+	}
+	signing := struct {
+		Sequence       uint32
+		CloseTime      uint32
+		PreviousLedger Hash256
+		LedgerHash     Hash256
+	}{p.Sequence, p.CloseTime, p.PreviousLedger, p.LedgerHash}
+	if err := write(enc.multi, signing); err != nil {
+		return err
+	}
+	p.SetHash(enc.hash.Sum(nil))
+	p.SetRaw(enc.buf.Bytes())
+	return nil
+}
+
 func (enc *Encoder) Node(h Hashable) error {
+	if err := enc.node(h); err != nil {
+		return err
+	}
+	h.SetHash(enc.hash.Sum(nil))
+	h.SetRaw(enc.buf.Bytes())
+	return nil
+}
+
+// node writes the prefix format of h without modifying it
+func (enc *Encoder) node(h Hashable) error {
 	enc.reset()
 	if err := enc.Ledger(&enc.buf, h); err != nil {
 		return err
@@ -131,10 +160,9 @@ func (enc *Encoder) Node(h Hashable) error {
 	default:
 		return fmt.Errorf("Unknown type")
 	}
-	h.SetHash(enc.hash.Sum(nil))
-	h.SetRaw(enc.buf.Bytes())
 	return nil
 }
+
 func (enc *Encoder) reset() {
 	enc.buf.Reset()
 	enc.hash.Reset()
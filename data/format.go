@@ -7,6 +7,7 @@ import (
 
 type NodeType uint8
 type NodeFormat uint8
+type WireType uint8
 type HashPrefix uint32
 type LedgerNamespace uint16
 
@@ -33,6 +34,13 @@ const (
 	NF_HASH   NodeFormat = 2
 	NF_WIRE   NodeFormat = 3
 
+	// Wire Types, the last byte of a node in wire format
+	WT_TRANSACTION           WireType = 0
+	WT_ACCOUNT_STATE         WireType = 1
+	WT_INNER                 WireType = 2
+	WT_COMPRESSED_INNER      WireType = 3
+	WT_TRANSACTION_WITH_META WireType = 4
+
 	// Ledger index NameSpaces
 	NS_ACCOUNT         LedgerNamespace = 'a'
 	NS_DIRECTORY_NODE  LedgerNamespace = 'd'
@@ -68,7 +68,7 @@ func (h Hash256) Xor(x Hash256) Hash256 {
 	for i := range h {
 		xor[i] = h[i] ^ x[i]
 	}
-	return x
+	return xor
 }
 
 func (h Hash256) Compare(x Hash256) int {
@@ -20,10 +20,21 @@ type LedgerRange struct {
 	Max   uint32
 }
 
+// NodeRequest names the missing nodes of the state or transaction tree of
+// a ledger, either by their position in the tree or by their hash.
+type NodeRequest struct {
+	LedgerSequence uint32
+	LedgerHash     Hash256
+	Type           NodeType
+	Ids            []NodeId
+	Hashes         []Hash256
+}
+
 type Work struct {
 	*LedgerRange
 	MissingLedgers LedgerSlice
 	MissingNodes   []Hash256
+	Requests       []*NodeRequest
 }
 
 type LedgerSet struct {
@@ -81,6 +92,38 @@ func (l *LedgerSet) Set(i uint32) time.Duration {
 	return time.Duration(0)
 }
 
+// Has returns true if the ledger is in the set
+func (l *LedgerSet) Has(i uint32) bool {
+	return i >= l.start && i < uint32(l.ledgers.Len()) && !l.ledgers.Test(uint(i))
+}
+
+// Last returns the highest ledger in the set or zero if there are none
+func (l *LedgerSet) Last() uint32 {
+	for i := uint32(l.ledgers.Len()) - 1; i >= l.start && i < uint32(l.ledgers.Len()); i-- {
+		if !l.ledgers.Test(uint(i)) {
+			return i
+		}
+	}
+	return 0
+}
+
+// Prune removes the ledgers below end and stops them being taken again. It
+// returns the number of ledgers removed.
+func (l *LedgerSet) Prune(end uint32) uint32 {
+	var removed uint32
+	for i := l.start; i < end && i < uint32(l.ledgers.Len()); i++ {
+		if !l.ledgers.Test(uint(i)) {
+			l.ledgers.Set(uint(i))
+			removed++
+		}
+		delete(l.taken, i)
+	}
+	if end > l.start {
+		l.start = end
+	}
+	return removed
+}
+
 func (l *LedgerSet) take(i uint32) bool {
 	if !l.ledgers.Test(uint(i)) {
 		return false
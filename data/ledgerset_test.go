@@ -42,6 +42,20 @@ func (s *LedgerSetSuite) TestLedgerSetMiddle(c *C) {
 	c.Assert(l.Max(), Equals, uint32(40000))
 }
 
+func (s *LedgerSetSuite) TestLedgerSetPrune(c *C) {
+	l := NewLedgerSet(32570, 32670)
+	c.Assert(l.Last(), Equals, uint32(0))
+	l.Set(32570)
+	l.Set(32580)
+	l.Set(32600)
+	c.Assert(l.Last(), Equals, uint32(32600))
+	c.Assert(l.Prune(32590), Equals, uint32(2))
+	c.Assert(l.Count(), Equals, uint32(1))
+	c.Assert(l.Prune(32590), Equals, uint32(0))
+	c.Assert(l.TakeBottom(2), DeepEquals, LedgerSlice{32590, 32591})
+	c.Assert(l.Last(), Equals, uint32(32600))
+}
+
 // func (s *LedgerSetSuite) TestLargeLedgerSet(c *C) {
 // 	l := NewLedgerSet(32570, 5500000)
 // 	l.Set(32570)
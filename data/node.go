@@ -0,0 +1,163 @@
+package data
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/donovanhide/ripple/crypto"
+)
+
+// NewNodeFromWire decodes a node in the wire format used by TMLedgerData,
+// where the last byte is the WireType. The hash is calculated from the
+// received bytes and the raw value is set to the prefix format. The sequence
+// is only used for transactions with metadata.
+func NewNodeFromWire(b []byte, typ NodeType, sequence uint32) (Hashable, error) {
+	if len(b) == 0 {
+		return nil, fmt.Errorf("NewNodeFromWire: Empty node")
+	}
+	body, wireType := b[:len(b)-1], WireType(b[len(b)-1])
+	var (
+		node   Hashable
+		prefix HashPrefix
+		err    error
+	)
+	switch wireType {
+	case WT_INNER, WT_COMPRESSED_INNER:
+		var inner *InnerNode
+		if inner, err = newInnerNodeFromWire(body, typ, wireType == WT_COMPRESSED_INNER); err != nil {
+			return nil, err
+		}
+		var children bytes.Buffer
+		if err := write(&children, inner.Children); err != nil {
+			return nil, err
+		}
+		node, prefix, body, sequence = inner, HP_INNER_NODE, children.Bytes(), 0
+	case WT_ACCOUNT_STATE:
+		node, err = NewDecoder(bytes.NewReader(body)).LedgerEntry()
+		prefix, typ, sequence = HP_LEAF_NODE, NT_ACCOUNT_NODE, 0
+	case WT_TRANSACTION:
+		node, err = NewDecoder(bytes.NewReader(body)).Transaction()
+		prefix, typ, sequence = HP_TRANSACTION_ID, NT_TRANSACTION, 0
+	case WT_TRANSACTION_WITH_META:
+		var tx *TransactionWithMetaData
+		if tx, err = NewDecoder(bytes.NewReader(body)).TransactionWithMetadata(); err == nil {
+			tx.LedgerSequence = sequence
+		}
+		node, prefix, typ = tx, HP_TRANSACTION_NODE, NT_TRANSACTION_NODE
+	default:
+		return nil, fmt.Errorf("NewNodeFromWire: Unknown wire type: %d", wireType)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("NewNodeFromWire: %s", err.Error())
+	}
+	return node, setPrefix(node, typ, prefix, sequence, body)
+}
+
+// NewNodeFromPrefix decodes a node in the hash prefix format used by
+// TMGetObjectByHash replies. The sequence is only used for transactions with
+// metadata.
+func NewNodeFromPrefix(b []byte, typ NodeType, sequence uint32) (Hashable, error) {
+	if len(b) < 4 {
+		return nil, fmt.Errorf("NewNodeFromPrefix: Short node: %X", b)
+	}
+	prefix, body := HashPrefix(binary.BigEndian.Uint32(b[:4])), b[4:]
+	var (
+		node Hashable
+		err  error
+	)
+	switch prefix {
+	case HP_INNER_NODE:
+		node, err = newInnerNodeFromWire(body, typ, false)
+		sequence = 0
+	case HP_LEAF_NODE:
+		node, err = NewDecoder(bytes.NewReader(body)).LedgerEntry()
+		typ, sequence = NT_ACCOUNT_NODE, 0
+	case HP_TRANSACTION_NODE:
+		var tx *TransactionWithMetaData
+		if tx, err = NewDecoder(bytes.NewReader(body)).TransactionWithMetadata(); err == nil {
+			tx.LedgerSequence = sequence
+		}
+		node, typ = tx, NT_TRANSACTION_NODE
+	default:
+		return nil, fmt.Errorf("NewNodeFromPrefix: Unknown hash prefix: %s", prefix.String())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("NewNodeFromPrefix: %s", err.Error())
+	}
+	return node, setPrefix(node, typ, prefix, sequence, body)
+}
+
+// NodePrefix returns the hash prefix format of a node as used by
+// TMGetObjectByHash replies. The raw value is used if present as encoding
+// is not lossless for every node.
+func NodePrefix(h Hashable) ([]byte, error) {
+	if raw := h.Raw(); len(raw) > 9 {
+		return append([]byte(nil), raw[9:]...), nil
+	}
+	enc := NewEncoder()
+	if err := enc.node(h); err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), enc.buf.Bytes()[9:]...), nil
+}
+
+// NodeWire returns the wire format of a node as used by TMLedgerData. Ledger
+// headers have neither a hash prefix nor a wire type.
+func NodeWire(h Hashable) ([]byte, error) {
+	b, err := NodePrefix(h)
+	if err != nil {
+		return nil, err
+	}
+	body := b[4:]
+	switch h.(type) {
+	case *Ledger:
+		return body, nil
+	case *InnerNode:
+		return append(body, byte(WT_INNER)), nil
+	case *TransactionWithMetaData:
+		return append(body, byte(WT_TRANSACTION_WITH_META)), nil
+	case LedgerEntry:
+		return append(body, byte(WT_ACCOUNT_STATE)), nil
+	default:
+		return nil, fmt.Errorf("NodeWire: Unknown type: %T", h)
+	}
+}
+
+func newInnerNodeFromWire(b []byte, typ NodeType, compressed bool) (*InnerNode, error) {
+	inner := &InnerNode{Type: typ}
+	switch {
+	case compressed && len(b)%33 == 0:
+		for i := 0; i < len(b); i += 33 {
+			pos := b[i+32]
+			if pos > 15 {
+				return nil, fmt.Errorf("Bad compressed inner node position: %d", pos)
+			}
+			copy(inner.Children[pos][:], b[i:i+32])
+		}
+	case !compressed && len(b) == 16*32:
+		for i := range inner.Children {
+			copy(inner.Children[i][:], b[i*32:(i+1)*32])
+		}
+	default:
+		return nil, fmt.Errorf("Bad inner node length: %d", len(b))
+	}
+	return inner, nil
+}
+
+// setPrefix sets the raw value of a node to the prefix format and its hash
+// to the SHA512Half of the hash prefix and body.
+func setPrefix(node Hashable, typ NodeType, prefix HashPrefix, sequence uint32, body []byte) error {
+	var buf bytes.Buffer
+	for _, v := range []interface{}{sequence, sequence, typ, prefix, body} {
+		if err := write(&buf, v); err != nil {
+			return err
+		}
+	}
+	hash, err := crypto.Sha512Half(buf.Bytes()[9:])
+	if err != nil {
+		return err
+	}
+	node.SetHash(hash)
+	node.SetRaw(buf.Bytes())
+	return nil
+}
@@ -0,0 +1,62 @@
+package data
+
+import (
+	"fmt"
+)
+
+// NodeId identifies a node in a radix tree by the nibbles of the path
+// leading to it and its depth. The root node has a zero path and depth.
+type NodeId struct {
+	Path  Hash256
+	Depth uint8
+}
+
+var RootNodeId NodeId
+
+// Expects the 33 byte peer protocol encoding of path and depth
+func NewNodeId(b []byte) (*NodeId, error) {
+	if len(b) != 33 {
+		return nil, fmt.Errorf("NewNodeId: Wrong length %X", b)
+	}
+	var id NodeId
+	copy(id.Path[:], b[:32])
+	id.Depth = b[32]
+	if id.Depth > 64 {
+		return nil, fmt.Errorf("NewNodeId: Bad depth %d", id.Depth)
+	}
+	return &id, nil
+}
+
+func (n NodeId) Bytes() []byte {
+	return append(n.Path.Bytes(), n.Depth)
+}
+
+func (n NodeId) IsRoot() bool {
+	return n.Depth == 0
+}
+
+// Branch returns the position of the child of this node which leads to key
+func (n NodeId) Branch(key Hash256) int {
+	b := key[n.Depth/2]
+	if n.Depth%2 == 0 {
+		return int(b >> 4)
+	}
+	return int(b & 0x0F)
+}
+
+func (n NodeId) Child(branch int) NodeId {
+	child := NodeId{
+		Path:  n.Path,
+		Depth: n.Depth + 1,
+	}
+	if n.Depth%2 == 0 {
+		child.Path[n.Depth/2] |= byte(branch) << 4
+	} else {
+		child.Path[n.Depth/2] |= byte(branch)
+	}
+	return child
+}
+
+func (n NodeId) String() string {
+	return fmt.Sprintf("%d:%s", n.Depth, n.Path.TruncatedString(int(n.Depth+1)/2))
+}
@@ -12,6 +12,11 @@ func CheckSignature(h Hashable) (bool, error) {
 			return false, err
 		}
 		return crypto.Verify(v.SigningPubKey.Bytes(), v.Signature.Bytes(), v.Hash().Bytes())
+	case *Proposal:
+		if err := NewEncoder().Proposal(v); err != nil {
+			return false, err
+		}
+		return crypto.Verify(v.PublicKey.Bytes(), v.Signature.Bytes(), v.Hash().Bytes())
 	case *SetFee, *Amendment:
 		return true, nil
 	case Transaction:
@@ -1,6 +1,7 @@
 package data
 
 import (
+	"sync/atomic"
 	"time"
 )
 
@@ -9,6 +10,13 @@ const (
 	rippleTimeFormat string = "2006-Jan-02 15:04:05"
 )
 
+// DefaultCloseResolution is the close time resolution in seconds used by the
+// network when it is not known from a ledger
+const DefaultCloseResolution = 30
+
+// clockOffset is the number of seconds added to the local clock by Now
+var clockOffset int64
+
 type RippleTime struct {
 	T uint32
 }
@@ -29,10 +37,27 @@ func (t *RippleTime) time() time.Time {
 	return time.Unix(int64(t.T)+rippleTimeEpoch, 0)
 }
 
+// Now returns the network time, which is the local time adjusted by the
+// offset estimated from peers
 func Now() *RippleTime {
+	return &RippleTime{uint32(int64(convertToRippleTime(time.Now())) + ClockOffset())}
+}
+
+// LocalNow returns the unadjusted local time
+func LocalNow() *RippleTime {
 	return &RippleTime{convertToRippleTime(time.Now())}
 }
 
+// SetClockOffset sets the seconds by which the local clock is behind the
+// network
+func SetClockOffset(seconds int64) {
+	atomic.StoreInt64(&clockOffset, seconds)
+}
+
+func ClockOffset() int64 {
+	return atomic.LoadInt64(&clockOffset)
+}
+
 func (t *RippleTime) SetString(s string) error {
 	v, err := time.Parse(rippleTimeFormat, s)
 	if err != nil {
@@ -0,0 +1,404 @@
+package ledger
+
+import (
+	"fmt"
+	"github.com/donovanhide/ripple/data"
+	"github.com/donovanhide/ripple/storage"
+	"github.com/golang/glog"
+	"sync"
+	"time"
+)
+
+const (
+	backfillRequestTimeout = 10 * time.Second
+	backfillByHashAttempts = 2
+	backfillMaxNodes       = 256
+	backfillMaxLedgers     = 8
+	backfillFullBelow      = 1 << 20
+	backfillAcquireTimeout = 2 * time.Minute
+)
+
+// acquireNode is a node of a state or transaction tree which is either
+// wanted from peers or waiting for pending children to be acquired.
+type acquireNode struct {
+	acquisition *acquisition
+	typ         data.NodeType
+	id          data.NodeId
+	hash        data.Hash256
+	parent      *acquireNode
+	pending     int
+	requested   time.Time
+	attempts    int
+}
+
+type acquisition struct {
+	ledger  *data.Ledger
+	started time.Time
+	updated time.Time
+	pending int
+}
+
+// Backfill acquires missing historical ledgers from peers. The header of a
+// ledger is acquired first and then the state and transaction trees are
+// walked from the roots named in the header. Each node is only accepted if
+// its hash is wanted by its parent, so a complete tree is verified. Nodes are
+// saved to the DB as they arrive and the header is saved once both trees are
+// complete. Subtrees which are already in the DB are not requested again.
+// Headers must be verified by the caller before they are added. The nodes of
+// transaction trees are requested first and each ledger is reported as soon
+// as its transaction tree is complete, so that submissions can be found
+// without waiting for the state tree.
+type Backfill struct {
+	db               storage.DB
+	acquiring        map[uint32]*acquisition
+	wanted           map[data.Hash256][]*acquireNode
+	fullBelow        map[data.Hash256]struct{}
+	completed        []*data.Ledger
+	transactions     []*data.Ledger
+	transactionsOnly bool
+	sweeping         bool
+	swept            []*data.Ledger
+	received         uint64
+	mu               sync.Mutex
+}
+
+func NewBackfill(db storage.DB) *Backfill {
+	return &Backfill{
+		db:        db,
+		acquiring: make(map[uint32]*acquisition),
+		wanted:    make(map[data.Hash256][]*acquireNode),
+		fullBelow: make(map[data.Hash256]struct{}),
+	}
+}
+
+// Header starts the acquisition of a ledger. The header must already have
+// its hash set and be verified against a validated hash or the parent hash
+// of the next ledger.
+func (b *Backfill) Header(ledger *data.Ledger) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.acquiring[ledger.LedgerSequence]; ok {
+		return
+	}
+	now := time.Now()
+	a := &acquisition{
+		ledger:  ledger,
+		started: now,
+		updated: now,
+	}
+	b.acquiring[ledger.LedgerSequence] = a
+	var roots []*acquireNode
+	for typ, hash := range map[data.NodeType]data.Hash256{
+		data.NT_ACCOUNT_NODE:     ledger.StateHash,
+		data.NT_TRANSACTION_NODE: ledger.TransactionHash,
+	} {
+		if typ == data.NT_ACCOUNT_NODE && b.transactionsOnly {
+			continue
+		}
+		if !hash.IsZero() {
+			roots = append(roots, &acquireNode{
+				acquisition: a,
+				typ:         typ,
+				id:          data.RootNodeId,
+				hash:        hash,
+			})
+		}
+	}
+	a.pending = len(roots)
+	if a.pending == 0 {
+		b.complete(a)
+	}
+	for _, root := range roots {
+		b.resolve(root)
+	}
+}
+
+// Node adds a node received from a peer and returns false if the node was
+// not wanted by any acquisition.
+func (b *Backfill) Node(node data.Hashable) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	waiting, ok := b.wanted[node.Hash()]
+	if !ok {
+		return false
+	}
+	if inner, ok := node.(*data.InnerNode); ok && inner.Type != waiting[0].typ {
+		glog.Errorf("Backfill: Wrong inner node type: %s %s", node.Hash().String(), inner.Type)
+		return true
+	}
+	if err := b.db.Insert(node); err != nil {
+		glog.Errorln("Backfill: Insert:", err.Error())
+		return true
+	}
+	delete(b.wanted, node.Hash())
+	b.received++
+	now := time.Now()
+	for _, n := range waiting {
+		n.acquisition.updated = now
+		b.expand(n, node)
+	}
+	return true
+}
+
+// Completed returns the headers of the ledgers which have been completed
+// since the last call.
+func (b *Backfill) Completed() []*data.Ledger {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	completed := b.completed
+	b.completed = nil
+	return completed
+}
+
+// Transactions returns the headers of the ledgers whose transaction trees
+// have been completed since the last call
+func (b *Backfill) Transactions() []*data.Ledger {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	transactions := b.transactions
+	b.transactions = nil
+	return transactions
+}
+
+// TransactionsOnly stops the state trees of ledgers being acquired. Ledgers
+// are then never completed or saved, but their transaction trees are still
+// reported. It must be called before any headers are added.
+func (b *Backfill) TransactionsOnly() {
+	b.mu.Lock()
+	b.transactionsOnly = true
+	b.mu.Unlock()
+}
+
+func (b *Backfill) Acquiring() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.acquiring)
+}
+
+// Requests returns up to max wanted nodes of ledgers within the range which
+// have not been requested recently, transaction nodes first. Nodes are
+// requested by id until they have failed to arrive a few times and then by
+// hash.
+func (b *Backfill) Requests(r *data.LedgerRange, max int) []*data.NodeRequest {
+	type requestKey struct {
+		sequence uint32
+		typ      data.NodeType
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	requests := make(map[requestKey]*data.NodeRequest)
+	var (
+		ordered []*data.NodeRequest
+		count   int
+	)
+	for _, typ := range []data.NodeType{data.NT_TRANSACTION_NODE, data.NT_ACCOUNT_NODE} {
+		for hash, waiting := range b.wanted {
+			if count >= max {
+				break
+			}
+			n := waiting[0]
+			if n.typ != typ {
+				continue
+			}
+			ledger := n.acquisition.ledger
+			if ledger.LedgerSequence < r.Start || ledger.LedgerSequence > r.End {
+				continue
+			}
+			if now.Sub(n.requested) < backfillRequestTimeout {
+				continue
+			}
+			n.requested = now
+			n.attempts++
+			count++
+			key := requestKey{ledger.LedgerSequence, n.typ}
+			request, ok := requests[key]
+			if !ok {
+				request = &data.NodeRequest{
+					LedgerSequence: ledger.LedgerSequence,
+					LedgerHash:     ledger.Hash(),
+					Type:           n.typ,
+				}
+				requests[key] = request
+				ordered = append(ordered, request)
+			}
+			if n.attempts > backfillByHashAttempts {
+				request.Hashes = append(request.Hashes, hash)
+			} else {
+				request.Ids = append(request.Ids, n.id)
+			}
+		}
+	}
+	return ordered
+}
+
+// Acquired returns the headers of the ledgers being acquired
+func (b *Backfill) Acquired() []*data.Ledger {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ledgers := make([]*data.Ledger, 0, len(b.acquiring))
+	for _, a := range b.acquiring {
+		ledgers = append(ledgers, a.ledger)
+	}
+	return ledgers
+}
+
+// Parent returns the parent hash named by the header of the ledger with the
+// given sequence if it is being acquired
+func (b *Backfill) Parent(seq uint32) (data.Hash256, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if a, ok := b.acquiring[seq]; ok {
+		return a.ledger.PreviousLedger, true
+	}
+	return data.Hash256{}, false
+}
+
+// Expire abandons the acquisitions which have received no nodes for longer
+// than timeout and returns their headers
+func (b *Backfill) Expire(timeout time.Duration) []*data.Ledger {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var expired []*data.Ledger
+	stale := make(map[*acquisition]bool)
+	for seq, a := range b.acquiring {
+		if time.Since(a.updated) > timeout {
+			stale[a] = true
+			delete(b.acquiring, seq)
+			expired = append(expired, a.ledger)
+		}
+	}
+	if len(stale) == 0 {
+		return nil
+	}
+	for hash, waiting := range b.wanted {
+		var kept []*acquireNode
+		for _, n := range waiting {
+			if !stale[n.acquisition] {
+				kept = append(kept, n)
+			}
+		}
+		if len(kept) == 0 {
+			delete(b.wanted, hash)
+		} else {
+			b.wanted[hash] = kept
+		}
+	}
+	return expired
+}
+
+// StartSweep remembers the ledgers completed from now on, and those
+// completed but not yet collected, until they are passed to Sweep
+func (b *Backfill) StartSweep() {
+	b.mu.Lock()
+	b.swept = append([]*data.Ledger(nil), b.completed...)
+	b.sweeping = true
+	b.mu.Unlock()
+}
+
+// Sweep runs f while holding the lock, so that no node is inserted into or
+// found in the DB until it returns, and then clears the subtrees known to be
+// complete as f may have deleted some of them. f is passed the headers of
+// the ledgers being acquired and of those completed since StartSweep or the
+// previous call and must not call the Backfill or the Manager.
+func (b *Backfill) Sweep(f func(ledgers []*data.Ledger) error) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ledgers := b.swept
+	for _, a := range b.acquiring {
+		ledgers = append(ledgers, a.ledger)
+	}
+	b.swept = nil
+	err := f(ledgers)
+	b.fullBelow = make(map[data.Hash256]struct{})
+	return err
+}
+
+// EndSweep stops remembering completed ledgers
+func (b *Backfill) EndSweep() {
+	b.mu.Lock()
+	b.swept, b.sweeping = nil, false
+	b.mu.Unlock()
+}
+
+func (b *Backfill) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return fmt.Sprintf("Acquiring: %d Wanted: %d Received: %d", len(b.acquiring), len(b.wanted), b.received)
+}
+
+// resolve marks a node as full below if it and all its children are known
+// or otherwise wants it from peers
+func (b *Backfill) resolve(n *acquireNode) {
+	if _, ok := b.fullBelow[n.hash]; ok {
+		b.full(n)
+		return
+	}
+	if node, err := b.db.Get(n.hash); err == nil {
+		b.expand(n, node)
+		return
+	}
+	b.wanted[n.hash] = append(b.wanted[n.hash], n)
+}
+
+func (b *Backfill) expand(n *acquireNode, node data.Hashable) {
+	inner, ok := node.(*data.InnerNode)
+	if !ok {
+		b.full(n)
+		return
+	}
+	var children []*acquireNode
+	inner.Each(func(pos int, child data.Hash256) error {
+		children = append(children, &acquireNode{
+			acquisition: n.acquisition,
+			typ:         n.typ,
+			id:          n.id.Child(pos),
+			hash:        child,
+			parent:      n,
+		})
+		return nil
+	})
+	n.pending = len(children)
+	if n.pending == 0 {
+		b.full(n)
+		return
+	}
+	for _, child := range children {
+		b.resolve(child)
+	}
+}
+
+func (b *Backfill) full(n *acquireNode) {
+	if len(b.fullBelow) >= backfillFullBelow {
+		b.fullBelow = make(map[data.Hash256]struct{})
+	}
+	b.fullBelow[n.hash] = struct{}{}
+	if n.parent == nil && n.typ == data.NT_TRANSACTION_NODE {
+		b.transactions = append(b.transactions, n.acquisition.ledger)
+	}
+	if n.parent == nil {
+		if n.acquisition.pending--; n.acquisition.pending == 0 {
+			b.complete(n.acquisition)
+		}
+		return
+	}
+	if n.parent.pending--; n.parent.pending == 0 {
+		b.full(n.parent)
+	}
+}
+
+func (b *Backfill) complete(a *acquisition) {
+	delete(b.acquiring, a.ledger.LedgerSequence)
+	if b.sweeping {
+		b.swept = append(b.swept, a.ledger)
+	}
+	if b.transactionsOnly {
+		return
+	}
+	if err := b.db.Insert(a.ledger); err != nil {
+		glog.Errorln("Backfill: Ledger Insert:", err.Error())
+		return
+	}
+	glog.V(1).Infof("Backfill: Completed: %d %0.04f/secs", a.ledger.LedgerSequence, time.Since(a.started).Seconds())
+	b.completed = append(b.completed, a.ledger)
+}
@@ -0,0 +1,191 @@
+package ledger
+
+import (
+	"github.com/donovanhide/ripple/data"
+	"github.com/donovanhide/ripple/storage"
+	"github.com/donovanhide/ripple/testing/fixtures"
+	"testing"
+	"time"
+)
+
+func TestBackfill(t *testing.T) {
+	db := storage.NewEmptyMemoryDB()
+	b := NewBackfill(db)
+	fixture := fixtures.NewLedger(t, 10)
+	ledger, root, leaves := fixture.Ledger, fixture.Root, fixture.Leaves
+	all := &data.LedgerRange{Start: 1, End: 100}
+	b.Header(ledger)
+	requests := b.Requests(all, backfillMaxNodes)
+	if len(requests) != 1 || len(requests[0].Ids) != 1 || !requests[0].Ids[0].IsRoot() {
+		t.Fatalf("Expected root request got: %+v", requests)
+	}
+	if requests[0].LedgerHash != ledger.Hash() || requests[0].Type != data.NT_TRANSACTION_NODE {
+		t.Errorf("Wrong request: %+v", requests[0])
+	}
+	if len(b.Requests(&data.LedgerRange{Start: 11, End: 100}, backfillMaxNodes)) != 0 {
+		t.Errorf("Ledger outside of range requested")
+	}
+	if !b.Node(root) {
+		t.Fatalf("Root should be wanted")
+	}
+	requests = b.Requests(all, 1)
+	if len(requests) != 1 || len(requests[0].Ids) != 1 {
+		t.Fatalf("Expected a single request got: %+v", requests)
+	}
+	requests = b.Requests(all, backfillMaxNodes)
+	if len(requests) != 1 || len(requests[0].Ids) != len(leaves)-1 {
+		t.Fatalf("Expected %d remaining children got: %+v", len(leaves)-1, requests)
+	}
+	for _, leaf := range leaves {
+		if !b.Node(leaf) {
+			t.Fatalf("Leaf should be wanted: %s", leaf.Hash().String())
+		}
+	}
+	if b.Node(leaves[0]) {
+		t.Errorf("Leaf should not be wanted twice")
+	}
+	if completed := b.Completed(); len(completed) != 1 || completed[0] != ledger {
+		t.Fatalf("Expected completed ledger got: %v", completed)
+	}
+	if transactions := b.Transactions(); len(transactions) != 1 || transactions[0] != ledger {
+		t.Fatalf("Expected transaction tree got: %v", transactions)
+	}
+	if _, err := db.Get(ledger.Hash()); err != nil {
+		t.Errorf("Ledger not saved: %s", err.Error())
+	}
+	next := fixtures.NewLedger(t, 11).Ledger
+	next.TransactionHash = ledger.TransactionHash
+	if err := data.NewEncoder().Node(next); err != nil {
+		t.Fatal(err)
+	}
+	b.Header(next)
+	if len(b.Completed()) != 1 || b.Acquiring() != 0 {
+		t.Errorf("Ledger with known tree should complete immediately")
+	}
+}
+
+func TestBackfillTransactionsOnly(t *testing.T) {
+	db := storage.NewEmptyMemoryDB()
+	b := NewBackfill(db)
+	b.TransactionsOnly()
+	fixture := fixtures.NewLedger(t, 10)
+	ledger, root, leaves := fixture.Ledger, fixture.Root, fixture.Leaves
+	ledger.StateHash = data.Hash256{1}
+	if err := data.NewEncoder().Node(ledger); err != nil {
+		t.Fatal(err)
+	}
+	b.Header(ledger)
+	requests := b.Requests(&data.LedgerRange{Start: 1, End: 100}, backfillMaxNodes)
+	if len(requests) != 1 || requests[0].Type != data.NT_TRANSACTION_NODE {
+		t.Fatalf("Expected transaction root request got: %+v", requests)
+	}
+	for _, node := range append([]data.Hashable{root}, leaves...) {
+		b.Node(node)
+	}
+	if transactions := b.Transactions(); len(transactions) != 1 || transactions[0] != ledger {
+		t.Fatalf("Expected transaction tree got: %v", transactions)
+	}
+	if len(b.Completed()) != 0 || b.Acquiring() != 0 {
+		t.Fatalf("Ledger completed without its state tree: %s", b.String())
+	}
+	if _, err := db.Get(ledger.Hash()); err != storage.ErrNotFound {
+		t.Errorf("Incomplete ledger saved")
+	}
+}
+
+func TestBackfillExpire(t *testing.T) {
+	b := NewBackfill(storage.NewEmptyMemoryDB())
+	fixture := fixtures.NewLedger(t, 10)
+	ledger, root := fixture.Ledger, fixture.Root
+	b.Header(ledger)
+	if expired := b.Expire(time.Minute); len(expired) != 0 {
+		t.Fatalf("Expired too soon: %v", expired)
+	}
+	b.acquiring[10].updated = time.Now().Add(-2 * time.Minute)
+	if expired := b.Expire(time.Minute); len(expired) != 1 || expired[0] != ledger {
+		t.Fatalf("Expected expired ledger got: %v", expired)
+	}
+	if b.Acquiring() != 0 || len(b.Requests(&data.LedgerRange{Start: 1, End: 100}, backfillMaxNodes)) != 0 {
+		t.Fatalf("Expired ledger still acquiring: %s", b.String())
+	}
+	if b.Node(root) {
+		t.Errorf("Root of expired ledger should not be wanted")
+	}
+}
+
+func TestManagerExpected(t *testing.T) {
+	db := storage.NewEmptyMemoryDB()
+	m, err := NewManager(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.ledgers = data.NewLedgerSet(1, 20)
+	complete := fixtures.NewLedger(t, 12).Ledger
+	complete.PreviousLedger = data.Hash256{11}
+	if err := data.NewEncoder().Node(complete); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Insert(complete); err != nil {
+		t.Fatal(err)
+	}
+	m.complete(complete)
+	acquiring := fixtures.NewLedger(t, 10).Ledger
+	acquiring.PreviousLedger = data.Hash256{9}
+	if err := data.NewEncoder().Node(acquiring); err != nil {
+		t.Fatal(err)
+	}
+	m.backfill.Header(acquiring)
+	for seq, expected := range map[uint32]data.Hash256{11: {11}, 9: {9}} {
+		if hash, ok := m.expected(seq); !ok || hash != expected {
+			t.Errorf("Wrong expected hash for %d: %s %t", seq, hash.String(), ok)
+		}
+	}
+	if _, ok := m.expected(10); ok {
+		t.Errorf("Ledger without a known child should not be verifiable")
+	}
+	taken := m.take(&data.LedgerRange{Start: 1, End: 20, Max: 10})
+	if len(taken) != 2 || taken.Sorted()[0] != 9 || taken[1] != 11 {
+		t.Errorf("Wrong ledgers taken: %v", taken)
+	}
+}
+
+func TestBackfillSweep(t *testing.T) {
+	db := storage.NewEmptyMemoryDB()
+	b := NewBackfill(db)
+	fixture := fixtures.NewLedger(t, 10)
+	missing := data.Hash256{byte(data.RootNodeId.Branch(fixture.Leaves[0].Hash())^1) << 4}
+	acquiring := fixtures.NewLedgerWith(t, 11, fixture.Leaves[:1], missing)
+	b.StartSweep()
+	defer b.EndSweep()
+	b.Header(fixture.Ledger)
+	for _, node := range append([]data.Hashable{fixture.Root}, fixture.Leaves...) {
+		b.Node(node)
+	}
+	b.Header(acquiring.Ledger)
+	done := make(chan struct{})
+	err := b.Sweep(func(ledgers []*data.Ledger) error {
+		if len(ledgers) != 2 || ledgers[0] != fixture.Ledger || ledgers[1] != acquiring.Ledger {
+			t.Errorf("Expected completed and acquiring ledgers got: %v", ledgers)
+		}
+		go func() {
+			b.Node(acquiring.Root)
+			close(done)
+		}()
+		select {
+		case <-done:
+			t.Error("Node added during sweep")
+		case <-time.After(50 * time.Millisecond):
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	b.Sweep(func(ledgers []*data.Ledger) error {
+		if len(ledgers) != 1 || ledgers[0] != acquiring.Ledger {
+			t.Errorf("Expected acquiring ledger got: %v", ledgers)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,184 @@
+package ledger
+
+import (
+	"github.com/donovanhide/ripple/data"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A single position taken by a validator during a round
+type PositionUpdate struct {
+	TxSetHash data.Hash256
+	CloseTime uint32
+	Sequence  uint32
+	Received  time.Time
+}
+
+type Position struct {
+	PublicKey data.PublicKey
+	Updates   []PositionUpdate
+}
+
+type Round struct {
+	PreviousLedger data.Hash256
+	Started        time.Time
+	Last           time.Time
+	Positions      map[data.PublicKey]*Position
+}
+
+type RoundSummary struct {
+	PreviousLedger data.Hash256
+	Started        time.Time
+	Duration       float64
+	Proposers      int
+	Updates        int
+	TxSets         map[data.Hash256]int
+	CloseTimes     map[string]int
+	Majority       data.Hash256
+	Agreement      float64
+	Positions      map[data.PublicKey]PositionUpdate
+}
+
+// Consensus tracks the proposals of each validator, grouped into rounds by
+// the previous ledger they are building on.
+type Consensus struct {
+	rounds      map[data.Hash256]*Round
+	order       []data.Hash256
+	history     int
+	subscribers map[chan *RoundSummary]struct{}
+	mu          sync.RWMutex
+}
+
+func NewConsensus(history int) *Consensus {
+	return &Consensus{
+		rounds:      make(map[data.Hash256]*Round),
+		history:     history,
+		subscribers: make(map[chan *RoundSummary]struct{}),
+	}
+}
+
+func (p *Position) Current() *PositionUpdate {
+	return &p.Updates[len(p.Updates)-1]
+}
+
+// Add records a proposal and returns the updated summary of its round.
+// Stale and repeated proposals return nil.
+func (c *Consensus) Add(proposal *data.Proposal) *RoundSummary {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	round, ok := c.rounds[proposal.PreviousLedger]
+	if !ok {
+		round = &Round{
+			PreviousLedger: proposal.PreviousLedger,
+			Started:        now,
+			Positions:      make(map[data.PublicKey]*Position),
+		}
+		c.rounds[proposal.PreviousLedger] = round
+		c.order = append(c.order, proposal.PreviousLedger)
+		for len(c.order) > c.history {
+			delete(c.rounds, c.order[0])
+			c.order = c.order[1:]
+		}
+	}
+	position, ok := round.Positions[proposal.PublicKey]
+	if !ok {
+		position = &Position{PublicKey: proposal.PublicKey}
+		round.Positions[proposal.PublicKey] = position
+	} else if position.Current().Sequence >= proposal.Sequence {
+		return nil
+	}
+	position.Updates = append(position.Updates, PositionUpdate{
+		TxSetHash: proposal.LedgerHash,
+		CloseTime: proposal.CloseTime,
+		Sequence:  proposal.Sequence,
+		Received:  now,
+	})
+	round.Last = now
+	summary := round.Summary()
+	for s := range c.subscribers {
+		select {
+		case s <- summary:
+		default:
+		}
+	}
+	return summary
+}
+
+func (c *Consensus) Summary(previous data.Hash256) (*RoundSummary, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	round, ok := c.rounds[previous]
+	if !ok {
+		return nil, false
+	}
+	return round.Summary(), true
+}
+
+// Summaries returns the summary of every remembered round, oldest first
+func (c *Consensus) Summaries() []*RoundSummary {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	summaries := make([]*RoundSummary, len(c.order))
+	for i, previous := range c.order {
+		summaries[i] = c.rounds[previous].Summary()
+	}
+	return summaries
+}
+
+// Subscribe returns a channel which receives a summary every time a round
+// changes. Summaries are dropped if the channel is not drained.
+func (c *Consensus) Subscribe() chan *RoundSummary {
+	s := make(chan *RoundSummary, 100)
+	c.mu.Lock()
+	c.subscribers[s] = struct{}{}
+	c.mu.Unlock()
+	return s
+}
+
+func (c *Consensus) Unsubscribe(s chan *RoundSummary) {
+	c.mu.Lock()
+	delete(c.subscribers, s)
+	c.mu.Unlock()
+}
+
+func (r *Round) Summary() *RoundSummary {
+	summary := &RoundSummary{
+		PreviousLedger: r.PreviousLedger,
+		Started:        r.Started,
+		Duration:       r.Last.Sub(r.Started).Seconds(),
+		Proposers:      len(r.Positions),
+		TxSets:         make(map[data.Hash256]int),
+		CloseTimes:     make(map[string]int),
+		Positions:      make(map[data.PublicKey]PositionUpdate),
+	}
+	for key, position := range r.Positions {
+		current := position.Current()
+		summary.Updates += len(position.Updates) - 1
+		summary.TxSets[current.TxSetHash]++
+		summary.CloseTimes[data.NewRippleTime(current.CloseTime).String()]++
+		summary.Positions[key] = *current
+	}
+	var sets []data.Hash256
+	for set := range summary.TxSets {
+		sets = append(sets, set)
+	}
+	// Ties are broken by the lowest hash so the majority is stable
+	sort.Sort(hashSlice(sets))
+	for _, set := range sets {
+		if summary.TxSets[set] > summary.TxSets[summary.Majority] {
+			summary.Majority = set
+		}
+	}
+	if summary.Proposers > 0 {
+		summary.Agreement = float64(summary.TxSets[summary.Majority]) / float64(summary.Proposers)
+	}
+	return summary
+}
+
+type hashSlice []data.Hash256
+
+func (s hashSlice) Len() int           { return len(s) }
+func (s hashSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s hashSlice) Less(i, j int) bool { return s[i].Compare(s[j]) < 0 }
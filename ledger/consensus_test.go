@@ -0,0 +1,50 @@
+package ledger
+
+import (
+	"github.com/donovanhide/ripple/data"
+	"testing"
+)
+
+func newProposal(validator byte, sequence uint32, previous, txSet byte) *data.Proposal {
+	p := &data.Proposal{
+		Sequence:  sequence,
+		CloseTime: 470000000,
+	}
+	p.PublicKey[0] = validator
+	p.PreviousLedger[0] = previous
+	p.LedgerHash[0] = txSet
+	return p
+}
+
+func TestConsensus(t *testing.T) {
+	c := NewConsensus(2)
+	updates := c.Subscribe()
+	defer c.Unsubscribe(updates)
+	c.Add(newProposal(1, 0, 1, 0xA))
+	c.Add(newProposal(2, 0, 1, 0xB))
+	c.Add(newProposal(3, 0, 1, 0xA))
+	if c.Add(newProposal(2, 0, 1, 0xA)) != nil {
+		t.Fatalf("Repeated proposal should be ignored")
+	}
+	summary := c.Add(newProposal(2, 1, 1, 0xA))
+	if summary == nil {
+		t.Fatalf("Expected summary")
+	}
+	if summary.Proposers != 3 || summary.Updates != 1 {
+		t.Errorf("Wrong counts: %+v", summary)
+	}
+	if summary.Majority[0] != 0xA || summary.Agreement != 1 {
+		t.Errorf("Wrong majority: %s %f", summary.Majority, summary.Agreement)
+	}
+	if len(updates) != 4 {
+		t.Errorf("Expected 4 streamed summaries got: %d", len(updates))
+	}
+	c.Add(newProposal(1, 0, 2, 0xC))
+	c.Add(newProposal(1, 0, 3, 0xD))
+	if _, ok := c.Summary(data.Hash256{1}); ok {
+		t.Errorf("Oldest round should have been forgotten")
+	}
+	if len(c.Summaries()) != 2 {
+		t.Errorf("Expected 2 rounds got: %d", len(c.Summaries()))
+	}
+}
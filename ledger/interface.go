@@ -8,5 +8,11 @@ type Sync interface {
 	Current(uint32)
 	Missing(*data.LedgerRange) *data.Work
 	Submit([]data.Hashable)
+	AcquireTxSet(data.Hash256, []data.Hashable) []data.NodeId
+	Get(data.Hash256) (data.Hashable, error)
+	LedgerHash(uint32) (data.Hash256, bool)
+	Range() (uint32, uint32)
+	Track(data.Transaction) (*Submission, error)
+	Submission(data.Hash256) (*Submission, bool)
 	Copy() *RadixMap
 }
@@ -5,17 +5,35 @@ import (
 	"github.com/donovanhide/ripple/data"
 	"github.com/donovanhide/ripple/storage"
 	"github.com/golang/glog"
+	"sync"
 	"time"
 )
 
+// managerMaxHashes is the number of recent ledger hashes kept in memory.
+// Older ones are looked up in the ledger index of the DB.
+const managerMaxHashes = 1 << 16
+
 type Manager struct {
-	missing  chan chan *data.Work
-	incoming chan []data.Hashable
-	current  chan uint32
-	db       storage.DB
-	ledgers  *data.LedgerSet
-	started  time.Time
-	stats    map[string]uint64
+	missing     chan chan *data.Work
+	pruned      chan chan uint32
+	incoming    chan []data.Hashable
+	current     chan uint32
+	db          storage.DB
+	ledgers     *data.LedgerSet
+	consensus   *Consensus
+	txSets      *TxSets
+	validators  *Validators
+	backfill    *Backfill
+	submissions *Submissions
+	hashes      map[uint32]data.Hash256
+	resolution  uint8
+	checked     uint32
+	latest      uint32
+	first       uint32
+	last        uint32
+	mu          sync.RWMutex
+	started     time.Time
+	stats       map[string]uint64
 }
 
 func NewManager(db storage.DB) (*Manager, error) {
@@ -25,14 +43,56 @@ func NewManager(db storage.DB) (*Manager, error) {
 		return nil, err
 	}
 	glog.Infof("Manager: Created Ledger in %0.4f secs", time.Now().Sub(start).Seconds())
-	return &Manager{
-		missing:  make(chan chan *data.Work),
-		incoming: make(chan []data.Hashable, 1000),
-		current:  make(chan uint32),
-		db:       db,
-		ledgers:  ledgers,
-		stats:    make(map[string]uint64),
-	}, nil
+	m := &Manager{
+		missing:     make(chan chan *data.Work),
+		pruned:      make(chan chan uint32),
+		incoming:    make(chan []data.Hashable, 1000),
+		current:     make(chan uint32),
+		db:          db,
+		ledgers:     ledgers,
+		consensus:   NewConsensus(256),
+		txSets:      NewTxSets(256),
+		validators:  NewValidators(256, 3),
+		backfill:    NewBackfill(db),
+		submissions: NewSubmissions(),
+		hashes:      make(map[uint32]data.Hash256),
+		resolution:  data.DefaultCloseResolution,
+		stats:       make(map[string]uint64),
+		latest:      ledgers.Last(),
+	}
+	m.seed()
+	return m, nil
+}
+
+// seed remembers the hashes of the most recent ledgers already in the DB and
+// the longest run of them, so that they are served and announced after a
+// restart. Ledgers can only be served if the DB has a ledger index.
+func (m *Manager) seed() {
+	index, ok := storage.AsLedgerIndex(m.db)
+	if !ok {
+		return
+	}
+	for seq := m.ledgers.Last(); seq > 0 && len(m.hashes) < managerMaxHashes; seq-- {
+		if !m.ledgers.Has(seq) {
+			continue
+		}
+		if hash, ok := index.LedgerHash(seq); ok {
+			m.hashes[seq] = hash
+		}
+	}
+	var first uint32
+	for seq := uint32(0); seq <= m.ledgers.Max(); seq++ {
+		if !m.ledgers.Has(seq) {
+			first = 0
+			continue
+		}
+		if first == 0 {
+			first = seq
+		}
+		if m.last == 0 || seq-first > m.last-m.first {
+			m.first, m.last = first, seq
+		}
+	}
 }
 
 func (m *Manager) Start() {
@@ -52,32 +112,64 @@ func (m *Manager) Start() {
 			for _, item := range in {
 				switch v := item.(type) {
 				case *data.Validation:
-					continue
+					m.stats["validations"]++
+					m.checkClock(v)
+					m.validators.Add(v)
+					m.submissions.Update(m.validators)
 				case *data.Proposal:
-					continue
+					m.stats["proposals"]++
+					m.consensus.Add(v)
 				case *data.Ledger:
-					m.stats["ledgers"]++
-					wait := m.ledgers.Set(v.LedgerSequence)
-					glog.V(2).Infof("Manager: Received: %d %0.04f/secs ", v.LedgerSequence, wait.Seconds())
-					if err := m.db.Insert(v); err != nil {
-						glog.Errorln("Manager: Ledger Insert:", err.Error())
+					if hash, ok := m.expected(v.LedgerSequence); ok && hash == v.Hash() {
+						m.backfill.Header(v)
+					} else {
+						glog.V(2).Infof("Manager: Unverified header: %d %s", v.LedgerSequence, v.Hash().String())
+					}
+				case *data.InnerNode, data.LedgerEntry:
+					if !m.backfill.Node(v) {
+						glog.V(2).Infoln("Manager: Unwanted node:", v.Hash().String())
 					}
 				case *data.TransactionWithMetaData:
-					m.stats["transactions"]++
-					if err := m.db.Insert(v); err != nil {
-						glog.Errorln("Manager: Transaction Insert:", err.Error())
+					if m.backfill.Node(v) {
+						m.stats["transactions"]++
 					}
 				case data.Transaction:
 					held.Add(v)
 					fmt.Println(item.String(), held.Len())
 				}
 			}
+			for _, ledger := range m.backfill.Completed() {
+				m.stats["ledgers"]++
+				wait := m.ledgers.Set(ledger.LedgerSequence)
+				glog.V(2).Infof("Manager: Received: %d %0.04f/secs ", ledger.LedgerSequence, wait.Seconds())
+				m.complete(ledger)
+				if ledger.LedgerSequence >= m.validators.Latest() && ledger.CloseResolution > 0 {
+					m.resolution = ledger.CloseResolution
+				}
+			}
+			for _, ledger := range m.backfill.Transactions() {
+				m.submissions.Ledger(m.db, ledger)
+				m.submissions.Update(m.validators)
+			}
 		case missing := <-m.missing:
-			continue
 			work := <-missing
 			m.ledgers.Extend(work.End)
-			work.MissingLedgers = m.ledgers.TakeMiddle(work.LedgerRange)
+			for _, ledger := range m.backfill.Expire(backfillAcquireTimeout) {
+				glog.V(1).Infoln("Manager: Expired:", ledger.LedgerSequence)
+			}
+			if acquiring := uint32(m.backfill.Acquiring()); acquiring < backfillMaxLedgers {
+				if work.Max > backfillMaxLedgers-acquiring {
+					work.Max = backfillMaxLedgers - acquiring
+				}
+				work.MissingLedgers = m.take(m.submissionRange(work.LedgerRange))
+				if len(work.MissingLedgers) == 0 {
+					work.MissingLedgers = m.take(work.LedgerRange)
+				}
+			}
+			work.Requests = m.backfill.Requests(work.LedgerRange, backfillMaxNodes)
 			missing <- work
+		case pruned := <-m.pruned:
+			pruned <- m.ledgers.Prune(<-pruned)
 		}
 	}
 }
@@ -90,16 +182,253 @@ func (m *Manager) Submit(items []data.Hashable) {
 	m.incoming <- items
 }
 
-func (m *Manager) Missing(*data.LedgerRange) *data.Work {
+// Missing asks the manager for work within r. The channel is unbuffered so
+// that the request cannot be received back in place of the reply.
+func (m *Manager) Missing(r *data.LedgerRange) *data.Work {
 	c := make(chan *data.Work)
 	m.missing <- c
+	c <- &data.Work{LedgerRange: r}
 	return <-c
 }
+
+// take takes up to r.Max missing ledgers within r whose headers can be
+// verified, which are the validated ledgers and the parents of the ledgers
+// which are complete or being acquired
+func (m *Manager) take(r *data.LedgerRange) data.LedgerSlice {
+	candidates := m.validators.Sequences()
+	for _, ledger := range m.backfill.Acquired() {
+		candidates = append(candidates, ledger.LedgerSequence-1)
+	}
+	m.mu.RLock()
+	for seq := range m.hashes {
+		if _, ok := m.hashes[seq-1]; !ok {
+			candidates = append(candidates, seq-1)
+		}
+	}
+	m.mu.RUnlock()
+	taken := make(data.LedgerSlice, 0, r.Max)
+	for _, seq := range candidates {
+		if uint32(len(taken)) >= r.Max {
+			break
+		}
+		if seq >= r.Start && seq <= r.End {
+			taken = append(taken, m.ledgers.TakeMiddle(&data.LedgerRange{Start: seq, End: seq, Max: 1})...)
+		}
+	}
+	return taken
+}
+
+// expected returns the hash which the header of a ledger must have to be
+// acquired. This is the validated hash for the sequence or else the parent
+// hash named by the header of the next ledger, if it is complete or being
+// acquired.
+func (m *Manager) expected(seq uint32) (data.Hash256, bool) {
+	if hash, ok := m.validators.Validated(seq); ok {
+		return hash, true
+	}
+	if parent, ok := m.backfill.Parent(seq + 1); ok {
+		return parent, true
+	}
+	child, ok := m.LedgerHash(seq + 1)
+	if !ok {
+		return data.Hash256{}, false
+	}
+	node, err := m.db.Get(child)
+	if err != nil {
+		return data.Hash256{}, false
+	}
+	ledger, ok := node.(*data.Ledger)
+	if !ok {
+		return data.Hash256{}, false
+	}
+	return ledger.PreviousLedger, true
+}
+
+// submissionRange narrows r to the ledgers in which pending submissions
+// could appear, so that they are acquired first
+func (m *Manager) submissionRange(r *data.LedgerRange) *data.LedgerRange {
+	from := m.submissions.From()
+	if from <= r.Start {
+		return r
+	}
+	return &data.LedgerRange{
+		Start: from,
+		End:   r.End,
+		Max:   r.Max,
+	}
+}
+
+// checkClock compares the signing time of the first validation of each new
+// ledger with the network time and warns if they differ by more than the
+// close time resolution
+func (m *Manager) checkClock(v *data.Validation) {
+	if v.LedgerSequence <= m.checked || v.SigningTime == 0 {
+		return
+	}
+	m.checked = v.LedgerSequence
+	drift := int64(data.Now().Uint32()) - int64(v.SigningTime)
+	if drift > int64(m.resolution) || drift < -int64(m.resolution) {
+		glog.Warningf("Manager: Ledger: %d signed at %s which is %ds from network time %s with offset %ds", v.LedgerSequence, data.NewRippleTime(v.SigningTime).String(), drift, data.Now().String(), data.ClockOffset())
+	}
+}
+
+// Track starts tracking a signed transaction submitted to peers. Its
+// LastLedgerSequence is compared with the sequence expected to be closing
+// at the current network time.
+func (m *Manager) Track(tx data.Transaction) (*Submission, error) {
+	return m.submissions.Track(tx, m.validators.Current(data.Now().Uint32()))
+}
+
+// AcquireTransactionsOnly stops the state trees of ledgers being acquired,
+// which is enough to track submissions. No ledgers are then completed. It
+// must be called before Start.
+func (m *Manager) AcquireTransactionsOnly() {
+	m.backfill.TransactionsOnly()
+}
+
+func (m *Manager) Submission(hash data.Hash256) (*Submission, bool) {
+	return m.submissions.Get(hash)
+}
+
+func (m *Manager) AcquireTxSet(hash data.Hash256, nodes []data.Hashable) []data.NodeId {
+	return m.txSets.Acquire(hash, nodes)
+}
+
+// complete remembers the hash of a complete ledger, which must already be
+// in the set of ledgers, and updates the longest run of contiguous complete
+// ledgers which can be served to peers
+func (m *Manager) complete(ledger *data.Ledger) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	seq := ledger.LedgerSequence
+	m.hashes[seq] = ledger.Hash()
+	if seq > m.latest {
+		m.latest = seq
+	}
+	first, last := seq, seq
+	if m.last > 0 && seq == m.last+1 {
+		first = m.first
+	}
+	for ; first > 0 && m.ledgers.Has(first-1); first-- {
+	}
+	if m.last > 0 && seq+1 == m.first {
+		last = m.last
+	}
+	for ; m.ledgers.Has(last + 1); last++ {
+	}
+	if m.last == 0 || last-first >= m.last-m.first {
+		m.first, m.last = first, last
+	}
+	if len(m.hashes) > managerMaxHashes {
+		m.evict()
+	}
+}
+
+// evict forgets the lowest quarter of the hashes. Without a ledger index the
+// evicted ledgers can no longer be served, so the run is shortened.
+func (m *Manager) evict() {
+	var sequences data.LedgerSlice
+	for seq := range m.hashes {
+		sequences = append(sequences, seq)
+	}
+	sequences.Sorted()
+	for _, seq := range sequences[:len(sequences)-managerMaxHashes*3/4] {
+		delete(m.hashes, seq)
+	}
+	if _, ok := storage.AsLedgerIndex(m.db); ok {
+		return
+	}
+	switch lowest := sequences[len(sequences)-managerMaxHashes*3/4]; {
+	case m.last < lowest:
+		m.first, m.last = 0, 0
+	case m.first < lowest:
+		m.first = lowest
+	}
+}
+
+func (m *Manager) Get(hash data.Hash256) (data.Hashable, error) {
+	return m.db.Get(hash)
+}
+
+// LedgerHash returns the hash of a complete ledger, looking in the ledger
+// index of the DB for those no longer in memory
+func (m *Manager) LedgerHash(seq uint32) (data.Hash256, bool) {
+	m.mu.RLock()
+	hash, ok := m.hashes[seq]
+	m.mu.RUnlock()
+	if index, isIndex := storage.AsLedgerIndex(m.db); !ok && isIndex {
+		return index.LedgerHash(seq)
+	}
+	return hash, ok
+}
+
+// retained returns the hashes of the complete ledgers from cutoff onwards,
+// including those stored before the manager started if the DB indexes them
+func (m *Manager) retained(cutoff uint32) []data.Hash256 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	index, _ := storage.AsLedgerIndex(m.db)
+	var hashes []data.Hash256
+	for seq := cutoff; seq <= m.latest && seq >= cutoff; seq++ {
+		if hash, ok := m.hashes[seq]; ok {
+			hashes = append(hashes, hash)
+		} else if index != nil {
+			if hash, ok := index.LedgerHash(seq); ok {
+				hashes = append(hashes, hash)
+			}
+		}
+	}
+	return hashes
+}
+
+// prune forgets the ledgers below cutoff and returns how many complete
+// ledgers were removed from the set
+func (m *Manager) prune(cutoff uint32) uint32 {
+	c := make(chan uint32)
+	m.pruned <- c
+	c <- cutoff
+	removed := <-c
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for seq := range m.hashes {
+		if seq < cutoff {
+			delete(m.hashes, seq)
+		}
+	}
+	switch {
+	case m.last < cutoff:
+		m.first, m.last = 0, 0
+	case m.first < cutoff:
+		m.first = cutoff
+	}
+	return removed
+}
+
+// Latest returns the highest complete ledger
+func (m *Manager) Latest() uint32 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.latest
+}
+
+// Range returns the longest known run of contiguous complete ledgers
+func (m *Manager) Range() (uint32, uint32) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.first, m.last
+}
+
 func (m *Manager) Copy() *RadixMap { return nil }
 
+func (m *Manager) Consensus() *Consensus { return m.consensus }
+
+func (m *Manager) TxSets() *TxSets { return m.txSets }
+
+func (m *Manager) Validators() *Validators { return m.validators }
+
 func (m *Manager) String() string {
 	diff := time.Now().Sub(m.started).Seconds()
 	ledgers, transactions := m.stats["ledgers"], m.stats["transactions"]
 	ledgerRate, txRate := float64(ledgers)/diff, float64(transactions)/diff
-	return fmt.Sprintf("%d %0.4f/sec Tx: %d %0.4f/sec Got: %d Max: %d", ledgers, ledgerRate, transactions, txRate, m.ledgers.Count(), m.ledgers.Max())
+	return fmt.Sprintf("%d %0.4f/sec Tx: %d %0.4f/sec Got: %d Max: %d %s", ledgers, ledgerRate, transactions, txRate, m.ledgers.Count(), m.ledgers.Max(), m.backfill.String())
 }
@@ -0,0 +1,68 @@
+package ledger
+
+import (
+	"github.com/donovanhide/ripple/data"
+	"github.com/donovanhide/ripple/storage"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestManagerSeed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := storage.NewLogDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	hashes := make(map[uint32]data.Hash256)
+	for _, seq := range []uint32{32600, 32601, 32602, 32605} {
+		ledger := data.NewEmptyLedger(seq)
+		if err := data.NewEncoder().Node(ledger); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Insert(ledger); err != nil {
+			t.Fatal(err)
+		}
+		hashes[seq] = ledger.Hash()
+	}
+	m, err := NewManager(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first, last := m.Range(); first != 32600 || last != 32602 || m.Latest() != 32605 {
+		t.Fatalf("Wrong range: %d-%d latest: %d", first, last, m.Latest())
+	}
+	for seq, expected := range hashes {
+		if hash, ok := m.LedgerHash(seq); !ok || hash != expected {
+			t.Errorf("Wrong hash for %d: %s %t", seq, hash.String(), ok)
+		}
+	}
+}
+
+func TestManagerEvict(t *testing.T) {
+	m, err := NewManager(storage.NewEmptyMemoryDB())
+	if err != nil {
+		t.Fatal(err)
+	}
+	end := uint32(managerMaxHashes + 2)
+	m.ledgers = data.NewLedgerSet(1, end)
+	for seq := uint32(1); seq < end; seq++ {
+		m.ledgers.Set(seq)
+		m.complete(&data.Ledger{LedgerHeader: data.LedgerHeader{LedgerSequence: seq}})
+	}
+	if len(m.hashes) > managerMaxHashes {
+		t.Fatalf("Too many hashes: %d", len(m.hashes))
+	}
+	first, last := m.Range()
+	if _, ok := m.LedgerHash(first); !ok || last != end-1 {
+		t.Errorf("Range includes evicted ledgers: %d-%d", first, last)
+	}
+	if _, ok := m.LedgerHash(first - 1); ok {
+		t.Errorf("Ledger not evicted: %d", first-1)
+	}
+}
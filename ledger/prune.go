@@ -0,0 +1,219 @@
+package ledger
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/donovanhide/ripple/data"
+	"github.com/donovanhide/ripple/storage"
+	"github.com/golang/glog"
+	"time"
+)
+
+const pruneBatchSize = 1000
+
+// Pruner deletes the nodes of ledgers older than the last Keep complete
+// ledgers from the DB of a Manager by mark and sweep. Every node reachable
+// from the retained ledgers and from the ledgers being acquired is marked
+// and then every other node stored for an older ledger is deleted.
+// Ingestion continues while pruning, so before each batch of deletes the
+// retained ledgers are marked again and then, while the backfill is held so
+// that no node can be inserted or found in the DB, the ledgers being acquired
+// or completed since the previous batch are marked and the batch is deleted.
+// Nodes stored for retained ledgers are never deleted. Headers are deleted
+// first, so that a ledger whose tree is partly deleted is never complete.
+type Pruner struct {
+	Keep    uint32
+	manager *Manager
+	db      storage.DB
+	marked  map[data.Hash256]struct{}
+}
+
+type PruneStats struct {
+	Cutoff  uint32
+	Ledgers uint32
+	Marked  int
+	Deleted int
+	Elapsed time.Duration
+}
+
+func (s *PruneStats) String() string {
+	return fmt.Sprintf("Cutoff: %d Ledgers: %d Marked: %d Deleted: %d Elapsed: %0.4f secs", s.Cutoff, s.Ledgers, s.Marked, s.Deleted, s.Elapsed.Seconds())
+}
+
+func NewPruner(m *Manager, keep uint32) (*Pruner, error) {
+	if _, ok := storage.AsIterable(m.db); !ok {
+		return nil, fmt.Errorf("Cannot iterate: %T", m.db)
+	}
+	if _, ok := storage.AsDeleter(m.db); !ok {
+		return nil, fmt.Errorf("Cannot delete from: %T", m.db)
+	}
+	if keep == 0 {
+		return nil, fmt.Errorf("Must keep at least one ledger")
+	}
+	return &Pruner{
+		Keep:    keep,
+		manager: m,
+		db:      m.db,
+	}, nil
+}
+
+// Run prunes every interval until the process exits
+func (p *Pruner) Run(interval time.Duration) {
+	for {
+		stats, err := p.Prune()
+		if err != nil {
+			glog.Errorln("Pruner:", err.Error())
+		} else if stats != nil {
+			glog.Infoln("Pruner:", stats.String())
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Prune runs a mark and sweep. It returns nil stats if there is nothing
+// old enough to prune.
+func (p *Pruner) Prune() (*PruneStats, error) {
+	latest := p.manager.Latest()
+	if latest < p.Keep {
+		return nil, nil
+	}
+	start := time.Now()
+	stats := &PruneStats{Cutoff: latest - p.Keep + 1}
+	p.marked = make(map[data.Hash256]struct{})
+	defer func() { p.marked = nil }()
+	p.manager.backfill.StartSweep()
+	defer p.manager.backfill.EndSweep()
+	if err := p.sweep(stats, nil); err != nil {
+		return nil, err
+	}
+	var headers, nodes []data.Hash256
+	err := p.db.(storage.Iterable).Each(func(node data.Hashable) error {
+		if _, ok := p.marked[node.Hash()]; ok || nodeSequence(node) >= stats.Cutoff {
+			return nil
+		}
+		if _, ok := node.(*data.Ledger); ok {
+			headers = append(headers, node.Hash())
+		} else {
+			nodes = append(nodes, node.Hash())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := p.sweep(stats, headers); err != nil {
+		return nil, err
+	}
+	stats.Ledgers = p.manager.prune(stats.Cutoff)
+	if err := p.sweep(stats, nodes); err != nil {
+		return nil, err
+	}
+	stats.Marked = len(p.marked)
+	stats.Elapsed = time.Since(start)
+	return stats, nil
+}
+
+// nodeSequence returns the ledger for which a node was stored. Nodes
+// without a raw value are never deleted.
+func nodeSequence(node data.Hashable) uint32 {
+	if ledger, ok := node.(*data.Ledger); ok {
+		return ledger.LedgerSequence
+	}
+	if raw := node.Raw(); len(raw) > 9 {
+		return binary.BigEndian.Uint32(raw[:4])
+	}
+	return ^uint32(0)
+}
+
+// mark marks the trees of the retained ledgers. Marked subtrees are not
+// walked again, so marking again is cheap.
+func (p *Pruner) mark(cutoff uint32) error {
+	for _, hash := range p.manager.retained(cutoff) {
+		if err := p.markTree(hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// markLedgers marks the trees of ledgers from the backfill. Headers are only
+// stored once acquired, so the roots are marked rather than the header.
+func (p *Pruner) markLedgers(ledgers []*data.Ledger) error {
+	for _, ledger := range ledgers {
+		if err := p.markTree(ledger.StateHash); err != nil {
+			return err
+		}
+		if err := p.markTree(ledger.TransactionHash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// markTree marks a node and its descendants. Missing nodes are skipped as
+// the ledgers being acquired are incomplete.
+func (p *Pruner) markTree(hash data.Hash256) error {
+	if hash.IsZero() {
+		return nil
+	}
+	if _, ok := p.marked[hash]; ok {
+		return nil
+	}
+	node, err := p.db.Get(hash)
+	if err == storage.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	p.marked[hash] = struct{}{}
+	switch v := node.(type) {
+	case *data.Ledger:
+		if err := p.markTree(v.StateHash); err != nil {
+			return err
+		}
+		return p.markTree(v.TransactionHash)
+	case *data.InnerNode:
+		return v.Each(func(_ int, child data.Hash256) error {
+			return p.markTree(child)
+		})
+	}
+	return nil
+}
+
+// sweep deletes the unmarked nodes in batches, marking again before each.
+// With no hashes it only marks.
+func (p *Pruner) sweep(stats *PruneStats, hashes []data.Hash256) error {
+	deleter := p.db.(storage.Deleter)
+	for first := true; first || len(hashes) > 0; first = false {
+		n := pruneBatchSize
+		if n > len(hashes) {
+			n = len(hashes)
+		}
+		// The retained ledgers come from the manager, which uses the
+		// backfill, so must be marked before it is held
+		if err := p.mark(stats.Cutoff); err != nil {
+			return err
+		}
+		err := p.manager.backfill.Sweep(func(ledgers []*data.Ledger) error {
+			if err := p.markLedgers(ledgers); err != nil {
+				return err
+			}
+			for _, hash := range hashes[:n] {
+				if _, ok := p.marked[hash]; ok {
+					continue
+				}
+				if err := deleter.Delete(hash); err != nil {
+					return err
+				}
+				stats.Deleted++
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		hashes = hashes[n:]
+	}
+	return nil
+}
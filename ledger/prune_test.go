@@ -0,0 +1,86 @@
+package ledger
+
+import (
+	"github.com/donovanhide/ripple/data"
+	"github.com/donovanhide/ripple/storage"
+	"github.com/donovanhide/ripple/testing/fixtures"
+	"testing"
+)
+
+func TestPruner(t *testing.T) {
+	db := storage.NewEmptyMemoryDB()
+	m, err := NewManager(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.ledgers = data.NewLedgerSet(1, 20)
+	fixture := fixtures.NewLedger(t, 10)
+	old, oldRoot, leaves := fixture.Ledger, fixture.Root, fixture.Leaves
+	if len(leaves) < 5 {
+		t.Fatalf("Too few leaves: %d", len(leaves))
+	}
+	fixture = fixtures.NewLedgerWith(t, 11, leaves[:2])
+	kept, keptRoot := fixture.Ledger, fixture.Root
+	for _, node := range append(leaves, old, oldRoot, kept, keptRoot) {
+		if err := db.Insert(node); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, ledger := range []*data.Ledger{old, kept} {
+		m.ledgers.Set(ledger.LedgerSequence)
+		m.complete(ledger)
+	}
+	// A leaf stored for a newer ledger and a ledger still being acquired
+	recent, err := data.NewNodeFromPrefix(leaves[2].Raw()[9:], data.NT_TRANSACTION_NODE, 12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Insert(recent); err != nil {
+		t.Fatal(err)
+	}
+	missing := data.Hash256{byte(data.RootNodeId.Branch(leaves[3].Hash())^1) << 4}
+	fixture = fixtures.NewLedgerWith(t, 13, leaves[3:4], missing)
+	acquiring, acquiringRoot := fixture.Ledger, fixture.Root
+	if err := db.Insert(acquiringRoot); err != nil {
+		t.Fatal(err)
+	}
+	m.backfill.Header(acquiring)
+	if m.backfill.Acquiring() != 1 {
+		t.Fatal("Ledger not being acquired")
+	}
+	go m.Start()
+
+	if _, err := NewPruner(m, 0); err == nil {
+		t.Fatal("Pruner keeping no ledgers created")
+	}
+	p, err := NewPruner(m, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := p.Prune()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Cutoff != 11 || stats.Ledgers != 1 || stats.Deleted != len(leaves)-2 {
+		t.Fatalf("Wrong stats: %s", stats.String())
+	}
+	for _, node := range []data.Hashable{kept, keptRoot, leaves[0], leaves[1], leaves[2], leaves[3], acquiringRoot} {
+		if _, err := db.Get(node.Hash()); err != nil {
+			t.Errorf("Retained node deleted: %s", node.Hash().String())
+		}
+	}
+	for _, node := range append([]data.Hashable{old, oldRoot}, leaves[4:]...) {
+		if _, err := db.Get(node.Hash()); err != storage.ErrNotFound {
+			t.Errorf("Pruned node found: %s", node.Hash().String())
+		}
+	}
+	if _, ok := m.LedgerHash(10); ok {
+		t.Error("Pruned ledger hash found")
+	}
+	if first, last := m.Range(); first != 11 || last != 11 {
+		t.Errorf("Wrong range: %d-%d", first, last)
+	}
+	if stats, err := p.Prune(); err != nil || stats.Deleted != 0 {
+		t.Fatalf("Nothing should be pruned: %v %v", stats, err)
+	}
+}
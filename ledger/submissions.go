@@ -0,0 +1,199 @@
+package ledger
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/donovanhide/ripple/data"
+	"github.com/donovanhide/ripple/storage"
+	"sync"
+	"time"
+)
+
+// ledgerInterval is the typical number of seconds between ledger closes
+const ledgerInterval = 4
+
+type SubmissionStatus int
+
+const (
+	Pending SubmissionStatus = iota
+	Included
+	Validated
+	Expired
+)
+
+var submissionStatusMap = map[SubmissionStatus]string{
+	Pending:   "Pending",
+	Included:  "Included",
+	Validated: "Validated",
+	Expired:   "Expired",
+}
+
+// Submission is a transaction which has been sent to peers. It is Included
+// once found in the complete transaction tree of a ledger and Validated once
+// that ledger is the validated one for its sequence. It is Expired if a
+// ledger beyond its LastLedgerSequence is validated first. Expires is the
+// network time around which the LastLedgerSequence should close.
+type Submission struct {
+	Hash               data.Hash256
+	Account            data.Account
+	Sequence           uint32
+	LastLedgerSequence uint32
+	Expires            *data.RippleTime `json:",omitempty"`
+	Submitted          time.Time
+	Current            uint32
+	Status             SubmissionStatus
+	LedgerSequence     uint32
+	LedgerHash         data.Hash256
+	signature          []byte
+}
+
+// Submissions tracks transactions submitted to peers until they are
+// validated or expire
+type Submissions struct {
+	submissions map[data.Hash256]*Submission
+	mu          sync.Mutex
+}
+
+func NewSubmissions() *Submissions {
+	return &Submissions{
+		submissions: make(map[data.Hash256]*Submission),
+	}
+}
+
+// Track starts tracking a signed transaction. Current is the latest ledger
+// sequence known at submission, before which the transaction cannot appear.
+func (s *Submissions) Track(tx data.Transaction, current uint32) (*Submission, error) {
+	base := tx.GetBase()
+	if base.TxnSignature == nil {
+		return nil, fmt.Errorf("Transaction not signed: %s", tx.Hash().String())
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if existing, ok := s.submissions[tx.Hash()]; ok {
+		copied := *existing
+		return &copied, nil
+	}
+	sub := &Submission{
+		Hash:      tx.Hash(),
+		Account:   base.Account,
+		Sequence:  base.Sequence,
+		Submitted: time.Now(),
+		Current:   current,
+		signature: base.TxnSignature.Bytes(),
+	}
+	if base.LastLedgerSequence != nil {
+		sub.LastLedgerSequence = *base.LastLedgerSequence
+	}
+	if current > 0 && sub.LastLedgerSequence > 0 {
+		if sub.LastLedgerSequence < current {
+			return nil, fmt.Errorf("Transaction expired: %s LastLedgerSequence: %d Current: %d", sub.Hash.String(), sub.LastLedgerSequence, current)
+		}
+		sub.Expires = data.NewRippleTime(data.Now().Uint32() + (sub.LastLedgerSequence-current)*ledgerInterval)
+	}
+	s.submissions[sub.Hash] = sub
+	copied := *sub
+	return &copied, nil
+}
+
+// Get returns a copy of the submission with the given hash
+func (s *Submissions) Get(hash data.Hash256) (*Submission, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub, ok := s.submissions[hash]
+	if !ok {
+		return nil, false
+	}
+	copied := *sub
+	return &copied, true
+}
+
+// From returns the lowest sequence at which a pending submission could
+// appear or zero if nothing is pending
+func (s *Submissions) From() uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var from uint32
+	for _, sub := range s.submissions {
+		if sub.Status == Pending && (from == 0 || sub.Current < from) {
+			from = sub.Current
+		}
+	}
+	return from
+}
+
+// Ledger looks for pending submissions in the complete transaction tree of a
+// ledger. A transaction's position in the tree is its hash, so only the path
+// to each one is read.
+func (s *Submissions) Ledger(db storage.DB, ledger *data.Ledger) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sub := range s.submissions {
+		if sub.Status != Pending || ledger.LedgerSequence < sub.Current {
+			continue
+		}
+		if sub.LastLedgerSequence > 0 && ledger.LedgerSequence > sub.LastLedgerSequence {
+			continue
+		}
+		if sub.find(db, ledger.TransactionHash) {
+			sub.Status, sub.LedgerSequence, sub.LedgerHash = Included, ledger.LedgerSequence, ledger.Hash()
+		}
+	}
+}
+
+// Update checks included submissions against the validated ledgers and
+// expires pending ones which can no longer be included
+func (s *Submissions) Update(validators *Validators) {
+	latest := validators.Latest()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sub := range s.submissions {
+		if sub.Status == Included {
+			hash, ok := validators.Validated(sub.LedgerSequence)
+			switch {
+			case ok && hash == sub.LedgerHash:
+				sub.Status = Validated
+			case ok:
+				sub.Status, sub.LedgerSequence, sub.LedgerHash = Pending, 0, data.Hash256{}
+			}
+		}
+		if sub.Status == Pending && sub.LastLedgerSequence > 0 && latest > sub.LastLedgerSequence {
+			sub.Status = Expired
+		}
+	}
+}
+
+func (sub *Submission) find(db storage.DB, root data.Hash256) bool {
+	id := data.RootNodeId
+	for hash := root; !hash.IsZero(); {
+		node, err := db.Get(hash)
+		if err != nil {
+			return false
+		}
+		switch v := node.(type) {
+		case *data.InnerNode:
+			branch := id.Branch(sub.Hash)
+			hash, id = v.Children[branch], id.Child(branch)
+		case *data.TransactionWithMetaData:
+			return sub.matches(v)
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// matches compares the account, sequence and signature because the hash of
+// a leaf is not the hash of its transaction
+func (sub *Submission) matches(tx *data.TransactionWithMetaData) bool {
+	base := tx.GetBase()
+	return base.Account == sub.Account && base.Sequence == sub.Sequence &&
+		base.TxnSignature != nil && bytes.Equal(base.TxnSignature.Bytes(), sub.signature)
+}
+
+func (s SubmissionStatus) String() string {
+	return submissionStatusMap[s]
+}
+
+func (s SubmissionStatus) MarshalText() ([]byte, error) {
+	return []byte(submissionStatusMap[s]), nil
+}
@@ -0,0 +1,79 @@
+package ledger
+
+import (
+	"github.com/donovanhide/ripple/data"
+	"github.com/donovanhide/ripple/storage"
+	"github.com/donovanhide/ripple/testing/fixtures"
+	"testing"
+)
+
+func TestSubmissions(t *testing.T) {
+	db := storage.NewEmptyMemoryDB()
+	fixture := fixtures.NewLedger(t, 10)
+	ledger, root, leaves := fixture.Ledger, fixture.Root, fixture.Leaves
+	for _, node := range append(leaves, root) {
+		if err := db.Insert(node); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := NewSubmissions()
+	if _, err := s.Track(&data.Payment{}, 5); err == nil {
+		t.Fatal("Unsigned transaction tracked")
+	}
+	tx := leaves[0].(*data.TransactionWithMetaData)
+	if _, err := s.Track(tx, 5); err != nil {
+		t.Fatal(err)
+	}
+	if from := s.From(); from != 5 {
+		t.Fatalf("Wrong from: %d", from)
+	}
+	s.Ledger(db, data.NewEmptyLedger(11))
+	s.Ledger(db, ledger)
+	sub, ok := s.Get(tx.Hash())
+	if !ok || sub.Status != Included || sub.LedgerSequence != 10 || sub.LedgerHash != ledger.Hash() {
+		t.Fatalf("Transaction not included: %+v", sub)
+	}
+	if s.From() != 0 {
+		t.Fatal("Included transaction still pending")
+	}
+	v := NewValidators(10, 1)
+	v.Trust([]data.PublicKey{{}}, 1)
+	for seq := uint32(10); seq <= 11; seq++ {
+		validation := &data.Validation{LedgerSequence: seq}
+		if seq == 10 {
+			validation.LedgerHash = ledger.Hash()
+		}
+		v.Add(validation)
+	}
+	s.Update(v)
+	if sub, _ := s.Get(tx.Hash()); sub.Status != Validated {
+		t.Fatalf("Transaction not validated: %s", sub.Status)
+	}
+}
+
+func TestSubmissionsExpired(t *testing.T) {
+	leaves := fixtures.Leaves(t, 10)
+	tx := leaves[0].(*data.TransactionWithMetaData)
+	last := uint32(10)
+	tx.GetBase().LastLedgerSequence = &last
+	s := NewSubmissions()
+	if _, err := s.Track(tx, 11); err == nil {
+		t.Fatal("Expired transaction tracked")
+	}
+	sub, err := s.Track(tx, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expires := data.Now().Uint32() + 5*ledgerInterval; sub.Expires == nil || sub.Expires.Uint32() > expires || sub.Expires.Uint32() < expires-1 {
+		t.Fatalf("Wrong expiry: %v", sub.Expires)
+	}
+	v := NewValidators(10, 1)
+	v.Trust([]data.PublicKey{{}}, 1)
+	for seq := uint32(10); seq <= 12; seq++ {
+		v.Add(&data.Validation{LedgerSequence: seq})
+	}
+	s.Update(v)
+	if sub, _ := s.Get(tx.Hash()); sub.Status != Expired {
+		t.Fatalf("Transaction not expired: %s", sub.Status)
+	}
+}
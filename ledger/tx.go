@@ -34,3 +34,7 @@ func (s CanonicalTxSet) Sort(lastClosedLedger data.Hash256) {
 func (s *CanonicalTxSet) Add(tx data.Transaction) {
 	(*s).s = append((*s).s, tx)
 }
+
+func (s CanonicalTxSet) Transactions() []data.Transaction {
+	return s.s
+}
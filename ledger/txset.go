@@ -0,0 +1,191 @@
+package ledger
+
+import (
+	"fmt"
+	"github.com/donovanhide/ripple/data"
+	"sync"
+	"time"
+)
+
+const txSetRequestTimeout = 3 * time.Second
+
+type wantedNode struct {
+	id        data.NodeId
+	requested time.Time
+}
+
+// TxSet is a candidate transaction set which is being, or has been, acquired
+// from peers. Every node is checked against the hash its parent expects, so
+// a complete set has a verified root.
+type TxSet struct {
+	Hash      data.Hash256
+	Map       *RadixMap
+	Started   time.Time
+	Completed time.Time
+	wanted    map[data.Hash256]*wantedNode
+}
+
+type TxSetDiff struct {
+	Left, Right data.Hash256
+	Added       []data.Hash256
+	Dropped     []data.Hash256
+}
+
+// TxSets acquires candidate transaction sets named by proposals and
+// TMHaveTransactionSet messages and remembers the most recent ones.
+type TxSets struct {
+	sets    map[data.Hash256]*TxSet
+	order   []data.Hash256
+	history int
+	mu      sync.Mutex
+}
+
+func NewTxSets(history int) *TxSets {
+	return &TxSets{
+		sets:    make(map[data.Hash256]*TxSet),
+		history: history,
+	}
+}
+
+func newTxSet(hash data.Hash256) *TxSet {
+	set := &TxSet{
+		Hash:    hash,
+		Map:     NewEmptyRadixMap(),
+		Started: time.Now(),
+		wanted:  make(map[data.Hash256]*wantedNode),
+	}
+	set.Map.root = hash
+	set.wanted[hash] = &wantedNode{id: data.RootNodeId}
+	return set
+}
+
+// Acquire adds any received nodes to the set with the given hash and returns
+// the ids of the nodes which should be requested next. Nodes which have been
+// requested recently are not returned again until the request times out.
+func (s *TxSets) Acquire(hash data.Hash256, nodes []data.Hashable) []data.NodeId {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	set, ok := s.sets[hash]
+	if !ok {
+		if hash.IsZero() {
+			return nil
+		}
+		set = newTxSet(hash)
+		s.sets[hash] = set
+		s.order = append(s.order, hash)
+		for len(s.order) > s.history {
+			delete(s.sets, s.order[0])
+			s.order = s.order[1:]
+		}
+	}
+	for _, node := range nodes {
+		set.add(node)
+	}
+	return set.next(time.Now())
+}
+
+// Get returns the set with the given hash if it has been fully acquired
+func (s *TxSets) Get(hash data.Hash256) (*TxSet, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if set, ok := s.sets[hash]; ok && set.IsComplete() {
+		return set, true
+	}
+	return nil, false
+}
+
+// Compare returns the transactions in the right set which are not in the
+// left set as added and those only in the left set as dropped.
+func (s *TxSets) Compare(left, right data.Hash256) (*TxSetDiff, error) {
+	l, lok := s.Get(left)
+	r, rok := s.Get(right)
+	if !lok || !rok {
+		return nil, fmt.Errorf("Transaction sets not acquired: %s %s", left.String(), right.String())
+	}
+	leftTxs, rightTxs := l.keys(), r.keys()
+	diff := &TxSetDiff{
+		Left:  left,
+		Right: right,
+	}
+	for hash := range rightTxs {
+		if _, ok := leftTxs[hash]; !ok {
+			diff.Added = append(diff.Added, hash)
+		}
+	}
+	for hash := range leftTxs {
+		if _, ok := rightTxs[hash]; !ok {
+			diff.Dropped = append(diff.Dropped, hash)
+		}
+	}
+	return diff, nil
+}
+
+func (set *TxSet) IsComplete() bool {
+	return !set.Completed.IsZero()
+}
+
+func (set *TxSet) add(node data.Hashable) {
+	wanted, ok := set.wanted[node.Hash()]
+	if !ok {
+		return
+	}
+	delete(set.wanted, node.Hash())
+	set.Map.nodes[node.Hash()] = &RadixNode{
+		Node:  node,
+		Depth: wanted.id.Depth,
+	}
+	if inner, ok := node.(*data.InnerNode); ok {
+		inner.Each(func(pos int, child data.Hash256) error {
+			if _, ok := set.Map.nodes[child]; !ok {
+				set.wanted[child] = &wantedNode{id: wanted.id.Child(pos)}
+			}
+			return nil
+		})
+	}
+	if len(set.wanted) == 0 {
+		set.Completed = time.Now()
+		set.Map.full = true
+	}
+}
+
+func (set *TxSet) next(now time.Time) []data.NodeId {
+	var ids []data.NodeId
+	for _, wanted := range set.wanted {
+		if now.Sub(wanted.requested) > txSetRequestTimeout {
+			wanted.requested = now
+			ids = append(ids, wanted.id)
+		}
+	}
+	return ids
+}
+
+func (set *TxSet) keys() map[data.Hash256]struct{} {
+	keys := make(map[data.Hash256]struct{})
+	set.Map.Walk(func(key data.Hash256, node *RadixNode) error {
+		if _, ok := node.Node.(data.Transaction); ok {
+			keys[key] = struct{}{}
+		}
+		return nil
+	})
+	return keys
+}
+
+// Transactions returns the transactions of a complete set in canonical order
+// for application on top of the last closed ledger.
+func (set *TxSet) Transactions(lastClosedLedger data.Hash256) (*CanonicalTxSet, error) {
+	if !set.IsComplete() {
+		return nil, fmt.Errorf("Transaction set not acquired: %s", set.Hash.String())
+	}
+	var txs CanonicalTxSet
+	err := set.Map.Walk(func(key data.Hash256, node *RadixNode) error {
+		if tx, ok := node.Node.(data.Transaction); ok {
+			txs.Add(tx)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	txs.Sort(lastClosedLedger)
+	return &txs, nil
+}
@@ -0,0 +1,68 @@
+package ledger
+
+import (
+	"github.com/donovanhide/ripple/data"
+	internal "github.com/donovanhide/ripple/testing"
+	"testing"
+)
+
+func txSetNodes(t *testing.T) (*data.InnerNode, []data.Hashable) {
+	var (
+		children []data.Hashable
+		used     [16]bool
+	)
+	wire := make([]byte, 16*32+1)
+	wire[16*32] = byte(data.WT_INNER)
+	for _, test := range internal.Transactions {
+		node, err := data.NewNodeFromWire(append(test.Bytes(), byte(data.WT_TRANSACTION)), data.NT_TRANSACTION_NODE, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		branch := data.RootNodeId.Branch(node.Hash())
+		if used[branch] {
+			continue
+		}
+		used[branch] = true
+		copy(wire[branch*32:], node.Hash().Bytes())
+		children = append(children, node)
+	}
+	root, err := data.NewNodeFromWire(wire, data.NT_TRANSACTION_NODE, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return root.(*data.InnerNode), children
+}
+
+func TestTxSetAcquire(t *testing.T) {
+	root, children := txSetNodes(t)
+	sets := NewTxSets(2)
+	if ids := sets.Acquire(root.Hash(), nil); len(ids) != 1 || !ids[0].IsRoot() {
+		t.Fatalf("Expected root request got: %v", ids)
+	}
+	if ids := sets.Acquire(root.Hash(), nil); len(ids) != 0 {
+		t.Fatalf("Root should not be requested again before timeout: %v", ids)
+	}
+	if ids := sets.Acquire(root.Hash(), []data.Hashable{root}); len(ids) != len(children) {
+		t.Fatalf("Expected %d children got: %v", len(children), ids)
+	}
+	if _, ok := sets.Get(root.Hash()); ok {
+		t.Fatalf("Set should not be complete")
+	}
+	sets.Acquire(root.Hash(), children)
+	set, ok := sets.Get(root.Hash())
+	if !ok {
+		t.Fatalf("Set should be complete")
+	}
+	txs, err := set.Transactions(data.Hash256{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txs.Transactions()) != len(children) {
+		t.Errorf("Expected %d transactions got: %d", len(children), len(txs.Transactions()))
+	}
+	empty := data.Hash256{0xFF}
+	sets.Acquire(empty, nil)
+	if _, err := sets.Compare(root.Hash(), empty); err == nil {
+		t.Errorf("Compare should fail for incomplete set")
+	}
+}
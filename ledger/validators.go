@@ -0,0 +1,344 @@
+package ledger
+
+import (
+	"github.com/donovanhide/ripple/data"
+	"sort"
+	"sync"
+	"time"
+)
+
+type ValidatorOutcome uint8
+
+const (
+	Agreed ValidatorOutcome = iota
+	Disagreed
+	Missed
+)
+
+// ValidatorStats is the rolling record of a single validator. The fee and
+// amendment votes are the most recent ones seen, which are only included in
+// validations of flag ledgers.
+type ValidatorStats struct {
+	PublicKey        data.PublicKey
+	Trusted          bool
+	First            time.Time
+	Last             time.Time
+	FirstSequence    uint32
+	LastSequence     uint32
+	Validations      uint64
+	Agreed           uint64
+	Disagreed        uint64
+	Missed           uint64
+	Agreement        float64
+	RecentMisses     int
+	Amendments       []data.Hash256
+	LoadFee          *uint32
+	BaseFee          *uint64
+	ReserveBase      *uint32
+	ReserveIncrement *uint32
+	recent           []ValidatorOutcome
+}
+
+type ValidatorReport struct {
+	ValidatedSequence uint32
+	ValidatedHash     data.Hash256
+	MedianAgreement   float64
+	Validators        []*ValidatorStats
+}
+
+// Validators compares the validations of each validator with the final
+// validated ledger. Only the validations of trusted validators are counted.
+// A sequence is final once a quorum of them have validated a sequence lag
+// ledgers later and the validated ledger is the one with the most trusted
+// validations, ties going to the lowest hash, if it has a quorum too.
+// Sequences more than window ledgers beyond the validated ledger are ignored.
+type Validators struct {
+	validators map[data.PublicKey]*ValidatorStats
+	pending    map[uint32]map[data.PublicKey]data.Hash256
+	trusted    map[data.PublicKey]bool
+	quorum     int
+	window     int
+	lag        uint32
+	latest     uint32
+	signed     uint32
+	validated  uint32
+	hash       data.Hash256
+	history    map[uint32]data.Hash256
+	mu         sync.RWMutex
+}
+
+func NewValidators(window int, lag uint32) *Validators {
+	return &Validators{
+		validators: make(map[data.PublicKey]*ValidatorStats),
+		pending:    make(map[uint32]map[data.PublicKey]data.Hash256),
+		trusted:    make(map[data.PublicKey]bool),
+		history:    make(map[uint32]data.Hash256),
+		window:     window,
+		lag:        lag,
+	}
+}
+
+// Trust sets the validators whose validations are counted and how many of
+// them must agree on a ledger for it to be validated. A quorum of zero is
+// eighty percent of the trusted validators.
+func (v *Validators) Trust(keys []data.PublicKey, quorum int) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.trusted = make(map[data.PublicKey]bool, len(keys))
+	for _, key := range keys {
+		v.trusted[key] = true
+	}
+	if quorum <= 0 {
+		quorum = (len(v.trusted)*4 + 4) / 5
+	}
+	v.quorum = quorum
+	for key, stats := range v.validators {
+		stats.Trusted = v.trusted[key]
+	}
+}
+
+func (v *Validators) Add(validation *data.Validation) {
+	now := time.Now()
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	key, seq := validation.SigningPubKey, validation.LedgerSequence
+	stats, ok := v.validators[key]
+	if !ok {
+		stats = &ValidatorStats{
+			PublicKey:     key,
+			Trusted:       v.trusted[key],
+			First:         now,
+			FirstSequence: seq,
+		}
+		v.validators[key] = stats
+	}
+	stats.Last = now
+	stats.Validations++
+	if seq < stats.FirstSequence {
+		stats.FirstSequence = seq
+	}
+	if seq > stats.LastSequence {
+		stats.LastSequence = seq
+	}
+	if len(validation.Amendments) > 0 {
+		stats.Amendments = []data.Hash256(validation.Amendments)
+	}
+	if validation.LoadFee != nil {
+		stats.LoadFee = validation.LoadFee
+	}
+	if validation.BaseFee != nil {
+		stats.BaseFee = validation.BaseFee
+	}
+	if validation.ReserveBase != nil {
+		stats.ReserveBase = validation.ReserveBase
+	}
+	if validation.ReserveIncrement != nil {
+		stats.ReserveIncrement = validation.ReserveIncrement
+	}
+	if seq <= v.validated || (v.validated > 0 && seq > v.validated+uint32(v.window)) {
+		return
+	}
+	// Untrusted validations are kept so that their validators are scored,
+	// but only trusted ones count towards the majority
+	validations, ok := v.pending[seq]
+	if !ok {
+		validations = make(map[data.PublicKey]data.Hash256)
+		v.pending[seq] = validations
+	}
+	validations[key] = validation.LedgerHash
+	if !stats.Trusted {
+		return
+	}
+	if _, ok := v.majority(validations); ok && seq > v.latest {
+		v.latest, v.signed = seq, validation.SigningTime
+	}
+	var final []uint32
+	for pending, validations := range v.pending {
+		if _, ok := v.majority(validations); ok && pending+v.lag <= v.latest {
+			final = append(final, pending)
+		}
+	}
+	sort.Sort(sequenceSlice(final))
+	for _, seq := range final {
+		v.finalise(seq)
+	}
+	for pending := range v.pending {
+		if pending <= v.validated || pending+uint32(v.window) <= v.latest {
+			delete(v.pending, pending)
+		}
+	}
+}
+
+// majority returns the hash with the most validations from trusted
+// validators, ties going to the lowest hash, if it has a quorum
+func (v *Validators) majority(validations map[data.PublicKey]data.Hash256) (data.Hash256, bool) {
+	counts := make(map[data.Hash256]int)
+	var hashes []data.Hash256
+	for key, hash := range validations {
+		if !v.trusted[key] {
+			continue
+		}
+		if counts[hash] == 0 {
+			hashes = append(hashes, hash)
+		}
+		counts[hash]++
+	}
+	sort.Sort(hashSlice(hashes))
+	var validated data.Hash256
+	for _, hash := range hashes {
+		if counts[hash] > counts[validated] {
+			validated = hash
+		}
+	}
+	return validated, v.quorum > 0 && counts[validated] >= v.quorum
+}
+
+func (v *Validators) finalise(seq uint32) {
+	validations := v.pending[seq]
+	delete(v.pending, seq)
+	validated, _ := v.majority(validations)
+	v.validated, v.hash = seq, validated
+	v.history[seq] = validated
+	if len(v.history) > v.window {
+		for old := range v.history {
+			if old+uint32(v.window) <= seq {
+				delete(v.history, old)
+			}
+		}
+	}
+	for key, stats := range v.validators {
+		if stats.FirstSequence > seq {
+			continue
+		}
+		hash, ok := validations[key]
+		switch {
+		case !ok:
+			stats.Missed++
+			stats.record(Missed, v.window)
+		case hash == validated:
+			stats.Agreed++
+			stats.record(Agreed, v.window)
+		default:
+			stats.Disagreed++
+			stats.record(Disagreed, v.window)
+		}
+	}
+}
+
+func (s *ValidatorStats) record(outcome ValidatorOutcome, window int) {
+	s.recent = append(s.recent, outcome)
+	if len(s.recent) > window {
+		s.recent = s.recent[len(s.recent)-window:]
+	}
+	var agreed int
+	s.RecentMisses = 0
+	for _, outcome := range s.recent {
+		switch outcome {
+		case Agreed:
+			agreed++
+		case Missed:
+			s.RecentMisses++
+		}
+	}
+	s.Agreement = float64(agreed) / float64(len(s.recent))
+}
+
+// Validated returns the hash of the validated ledger with the given sequence
+// if it is within the window of recently finalised sequences
+func (v *Validators) Validated(seq uint32) (data.Hash256, bool) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	hash, ok := v.history[seq]
+	return hash, ok
+}
+
+// Sequences returns the recently finalised sequences, highest first
+func (v *Validators) Sequences() data.LedgerSlice {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	sequences := make(data.LedgerSlice, 0, len(v.history))
+	for seq := range v.history {
+		sequences = append(sequences, seq)
+	}
+	sort.Sort(sort.Reverse(sequences))
+	return sequences
+}
+
+// Latest returns the highest finalised sequence
+func (v *Validators) Latest() uint32 {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.validated
+}
+
+// Current estimates the sequence of the ledger closing at the network time
+// now from the latest sequence with a quorum and the time it was signed
+func (v *Validators) Current(now uint32) uint32 {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	if v.latest == 0 || v.signed == 0 || now <= v.signed {
+		return v.latest
+	}
+	return v.latest + (now-v.signed)/ledgerInterval
+}
+
+// Report returns a copy of the record of every validator, ordered by public key
+func (v *Validators) Report() *ValidatorReport {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	report := &ValidatorReport{
+		ValidatedSequence: v.validated,
+		ValidatedHash:     v.hash,
+	}
+	var agreements []float64
+	for _, stats := range v.validators {
+		copied := *stats
+		copied.recent = nil
+		report.Validators = append(report.Validators, &copied)
+		if len(stats.recent) > 0 {
+			agreements = append(agreements, stats.Agreement)
+		}
+	}
+	sort.Sort(validatorSlice(report.Validators))
+	if len(agreements) > 0 {
+		sort.Float64s(agreements)
+		report.MedianAgreement = agreements[len(agreements)/2]
+	}
+	return report
+}
+
+// Behind returns the validators from keys whose agreement over the window
+// is more than tolerance below the median of all validators. Validators
+// which have never been seen are always returned.
+func (v *Validators) Behind(keys []data.PublicKey, tolerance float64) []*ValidatorStats {
+	report := v.Report()
+	seen := make(map[data.PublicKey]*ValidatorStats)
+	for _, stats := range report.Validators {
+		seen[stats.PublicKey] = stats
+	}
+	var behind []*ValidatorStats
+	for _, key := range keys {
+		stats, ok := seen[key]
+		switch {
+		case !ok:
+			behind = append(behind, &ValidatorStats{PublicKey: key})
+		case stats.Agreement < report.MedianAgreement-tolerance:
+			behind = append(behind, stats)
+		}
+	}
+	return behind
+}
+
+type sequenceSlice []uint32
+
+func (s sequenceSlice) Len() int           { return len(s) }
+func (s sequenceSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s sequenceSlice) Less(i, j int) bool { return s[i] < s[j] }
+
+type validatorSlice []*ValidatorStats
+
+func (s validatorSlice) Len() int      { return len(s) }
+func (s validatorSlice) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s validatorSlice) Less(i, j int) bool {
+	return s[i].PublicKey.String() < s[j].PublicKey.String()
+}
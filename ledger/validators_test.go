@@ -0,0 +1,121 @@
+package ledger
+
+import (
+	"github.com/donovanhide/ripple/data"
+	"testing"
+)
+
+func newValidation(validator byte, sequence uint32, hash byte) *data.Validation {
+	v := &data.Validation{LedgerSequence: sequence}
+	v.SigningPubKey[0] = validator
+	v.LedgerHash[0] = hash
+	return v
+}
+
+func TestValidators(t *testing.T) {
+	v := NewValidators(10, 1)
+	v.Trust([]data.PublicKey{{1}, {2}, {3}}, 2)
+	fee := uint64(10)
+	for seq := uint32(1); seq <= 4; seq++ {
+		v.Add(newValidation(1, seq, byte(seq)))
+		v.Add(newValidation(2, seq, byte(seq)))
+		if seq != 2 {
+			v.Add(newValidation(3, seq, 0xFF))
+		}
+	}
+	flag := newValidation(1, 5, 5)
+	flag.BaseFee = &fee
+	flag.Amendments = data.Vector256{{0xA}}
+	v.Add(flag)
+	v.Add(newValidation(2, 5, 5))
+	report := v.Report()
+	if report.ValidatedSequence != 4 || report.ValidatedHash[0] != 4 {
+		t.Fatalf("Wrong validated ledger: %d %s", report.ValidatedSequence, report.ValidatedHash)
+	}
+	if len(report.Validators) != 3 || report.MedianAgreement != 1 {
+		t.Fatalf("Wrong report: %+v", report)
+	}
+	first, third := report.Validators[0], report.Validators[2]
+	if first.Agreed != 4 || first.Agreement != 1 || *first.BaseFee != fee || len(first.Amendments) != 1 {
+		t.Errorf("Wrong first validator: %+v", first)
+	}
+	if third.Disagreed != 3 || third.Missed != 1 || third.Agreement != 0 {
+		t.Errorf("Wrong third validator: %+v", third)
+	}
+	behind := v.Behind([]data.PublicKey{first.PublicKey, third.PublicKey, {4}}, 0.1)
+	if len(behind) != 2 || behind[0].PublicKey != third.PublicKey {
+		t.Errorf("Wrong validators behind: %+v", behind)
+	}
+}
+
+func TestValidatorsTrusted(t *testing.T) {
+	v := NewValidators(10, 1)
+	v.Trust([]data.PublicKey{{1}, {2}, {3}}, 0)
+	// Untrusted validators and a trusted validator far ahead are not counted
+	for key := byte(4); key < 10; key++ {
+		v.Add(newValidation(key, 1, 0xFF))
+		v.Add(newValidation(key, 2, 0xFF))
+	}
+	v.Add(newValidation(1, 1000, 0xFF))
+	if report := v.Report(); report.ValidatedSequence != 0 || len(report.Validators) != 7 {
+		t.Fatalf("Validated without a quorum: %+v", report)
+	}
+	// Validations arriving out of order
+	for _, seq := range []uint32{2, 1} {
+		for key := byte(1); key <= 3; key++ {
+			v.Add(newValidation(key, seq, byte(seq)))
+		}
+	}
+	if hash, ok := v.Validated(1); !ok || hash[0] != 1 {
+		t.Fatalf("Wrong validated ledger: %s %t", hash, ok)
+	}
+	for _, stats := range v.Report().Validators {
+		if trusted := stats.PublicKey[0] <= 3; stats.Trusted != trusted || (trusted && stats.Agreed != 1) {
+			t.Errorf("Wrong validator: %+v", stats)
+		}
+	}
+	v.Add(newValidation(1, 100, 100))
+	v.Add(newValidation(2, 100, 100))
+	v.Add(newValidation(3, 100, 100))
+	if v.Latest() != 1 || len(v.pending) > 2 {
+		t.Errorf("Validations beyond the window counted: %d %d", v.Latest(), len(v.pending))
+	}
+}
+
+func TestValidatorsCurrent(t *testing.T) {
+	v := NewValidators(10, 1)
+	v.Trust([]data.PublicKey{{1}}, 1)
+	if current := v.Current(1000); current != 0 {
+		t.Fatalf("Current without validations: %d", current)
+	}
+	validation := newValidation(1, 20, 20)
+	validation.SigningTime = 1000
+	v.Add(validation)
+	for now, expected := range map[uint32]uint32{
+		900:                     20,
+		1000:                    20,
+		1000 + ledgerInterval*3: 23,
+	} {
+		if current := v.Current(now); current != expected {
+			t.Errorf("Current at %d: Expected %d got %d", now, expected, current)
+		}
+	}
+}
+
+func TestValidatorsUntrustedFirst(t *testing.T) {
+	v := NewValidators(10, 1)
+	v.Trust([]data.PublicKey{{1}, {2}}, 2)
+	for seq := uint32(1); seq <= 4; seq++ {
+		v.Add(newValidation(9, seq, byte(seq)))
+		v.Add(newValidation(1, seq, byte(seq)))
+		v.Add(newValidation(2, seq, byte(seq)))
+	}
+	if v.Latest() != 3 {
+		t.Fatalf("Wrong validated ledger: %d", v.Latest())
+	}
+	for _, stats := range v.Report().Validators {
+		if stats.Agreed != 3 || stats.Missed != 0 || stats.Agreement != 1 {
+			t.Errorf("Wrong validator: %+v", stats)
+		}
+	}
+}
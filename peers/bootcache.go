@@ -0,0 +1,191 @@
+package peers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const maxBootcache = 1000
+
+// BootcacheEntry is the connection history of an endpoint. Valence counts
+// consecutive successes when positive and consecutive failures when negative.
+type BootcacheEntry struct {
+	Host        string
+	Port        string
+	Valence     int
+	Successes   uint64
+	Failures    uint64
+	LastSeen    time.Time
+	LastSuccess time.Time
+	LastFailure time.Time
+}
+
+// Bootcache remembers the endpoints discovered from peers so that they can be
+// dialled after a restart, best first.
+type Bootcache struct {
+	path    string
+	entries map[string]*BootcacheEntry
+	dirty   bool
+	mu      sync.Mutex
+}
+
+// LoadBootcache reads the cache at path. A missing file gives an empty
+// cache and an empty path gives a cache which is never saved.
+func LoadBootcache(path string) (*Bootcache, error) {
+	b := &Bootcache{
+		path:    path,
+		entries: make(map[string]*BootcacheEntry),
+	}
+	if path == "" {
+		return b, nil
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []*BootcacheEntry
+	if err := json.NewDecoder(f).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("Bad bootcache: %s %s", path, err.Error())
+	}
+	for _, e := range entries {
+		b.entries[e.key()] = e
+	}
+	return b, nil
+}
+
+func (e *BootcacheEntry) key() string {
+	return fmt.Sprintf("%s:%s", e.Host, e.Port)
+}
+
+func (b *Bootcache) entry(c *PeerConnection) *BootcacheEntry {
+	e, ok := b.entries[c.String()]
+	if !ok {
+		e = &BootcacheEntry{Host: c.Host, Port: c.Port}
+		b.entries[c.String()] = e
+	}
+	b.dirty = true
+	return e
+}
+
+// Seen records that the endpoint was announced by a peer
+func (b *Bootcache) Seen(c *PeerConnection) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.entry(c).LastSeen = time.Now()
+}
+
+func (b *Bootcache) Success(c *PeerConnection) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e := b.entry(c)
+	if e.Valence < 0 {
+		e.Valence = 0
+	}
+	e.Valence++
+	e.Successes++
+	e.LastSuccess = time.Now()
+}
+
+func (b *Bootcache) Failure(c *PeerConnection) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e := b.entry(c)
+	if e.Valence > 0 {
+		e.Valence = 0
+	}
+	e.Valence--
+	e.Failures++
+	e.LastFailure = time.Now()
+}
+
+// Valence returns zero for unknown endpoints
+func (b *Bootcache) Valence(c *PeerConnection) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if e, ok := b.entries[c.String()]; ok {
+		return e.Valence
+	}
+	return 0
+}
+
+// Endpoints returns copies of the entries ranked by valence and then by
+// how recently they were seen
+func (b *Bootcache) Endpoints() []*BootcacheEntry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.ranked()
+}
+
+func (b *Bootcache) ranked() []*BootcacheEntry {
+	var entries []*BootcacheEntry
+	for _, e := range b.entries {
+		copied := *e
+		entries = append(entries, &copied)
+	}
+	sort.Sort(bootcacheSlice(entries))
+	return entries
+}
+
+// Save writes the cache if it has changed, keeping only the best entries.
+// The file is replaced atomically.
+func (b *Bootcache) Save() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.path == "" || !b.dirty {
+		return nil
+	}
+	entries := b.ranked()
+	if len(entries) > maxBootcache {
+		for _, e := range entries[maxBootcache:] {
+			delete(b.entries, e.key())
+		}
+		entries = entries[:maxBootcache]
+	}
+	out, err := json.MarshalIndent(entries, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(b.path), filepath.Base(b.path))
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(out); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), b.path); err != nil {
+		return err
+	}
+	b.dirty = false
+	return nil
+}
+
+type bootcacheSlice []*BootcacheEntry
+
+func (s bootcacheSlice) Len() int      { return len(s) }
+func (s bootcacheSlice) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s bootcacheSlice) Less(i, j int) bool {
+	switch {
+	case s[i].Valence != s[j].Valence:
+		return s[i].Valence > s[j].Valence
+	case !s[i].LastSeen.Equal(s[j].LastSeen):
+		return s[i].LastSeen.After(s[j].LastSeen)
+	default:
+		return s[i].key() < s[j].key()
+	}
+}
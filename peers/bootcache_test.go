@@ -0,0 +1,54 @@
+package peers
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBootcache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bootcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "bootcache.json")
+	b, err := LoadBootcache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	good := &PeerConnection{Host: "good", Port: "51235"}
+	bad := &PeerConnection{Host: "bad", Port: "51235"}
+	unknown := &PeerConnection{Host: "unknown", Port: "51235"}
+	b.Seen(bad)
+	b.Seen(unknown)
+	b.Seen(good)
+	b.Success(bad)
+	b.Failure(bad)
+	b.Failure(bad)
+	b.Success(good)
+	b.Success(good)
+	if b.Valence(good) != 2 || b.Valence(bad) != -2 || b.Valence(unknown) != 0 {
+		t.Fatalf("Wrong valences: %d %d %d", b.Valence(good), b.Valence(bad), b.Valence(unknown))
+	}
+	if err := b.Save(); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadBootcache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := loaded.Endpoints()
+	if len(entries) != 3 {
+		t.Fatalf("Wrong number of entries: %d", len(entries))
+	}
+	for i, host := range []string{"good", "unknown", "bad"} {
+		if entries[i].Host != host {
+			t.Fatalf("Wrong rank for %s: %d", entries[i].Host, i)
+		}
+	}
+	if entries[2].Successes != 1 || entries[2].Failures != 2 || entries[2].LastSeen.IsZero() {
+		t.Fatalf("Wrong history: %+v", entries[2])
+	}
+}
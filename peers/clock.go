@@ -0,0 +1,144 @@
+package peers
+
+import (
+	"github.com/donovanhide/ripple/crypto"
+	"github.com/donovanhide/ripple/data"
+	"github.com/golang/glog"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	clockMinSamples = 3
+	clockMaxSamples = 64
+	clockExpiry     = time.Hour
+	clockOutlier    = 60   // seconds from the median beyond which a sample is dropped
+	clockMaxOffset  = 3600 // seconds beyond which the offset is capped
+)
+
+type clockSample struct {
+	offset   int64
+	received time.Time
+}
+
+// NetworkClock estimates the offset of the local clock from the network
+// times sent by peers in their handshakes and sets it for data.Now. Only
+// peers we connected to or trust are sampled, so inbound connections cannot
+// drag the clock, and the offset is capped.
+type NetworkClock struct {
+	samples map[string]*clockSample
+	offset  int64
+	mu      sync.Mutex
+}
+
+func NewNetworkClock() *NetworkClock {
+	return &NetworkClock{
+		samples: make(map[string]*clockSample),
+	}
+}
+
+// Add records the network time sent by a peer, replacing any earlier sample
+// from the same peer, and returns the new offset. Samples from peers which
+// are not trusted are ignored.
+func (c *NetworkClock) Add(key crypto.Hash, networkTime uint32, trusted bool) int64 {
+	if key == nil || networkTime == 0 || !trusted {
+		return c.Offset()
+	}
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.samples[key.String()] = &clockSample{
+		offset:   int64(networkTime) - int64(data.LocalNow().Uint32()),
+		received: now,
+	}
+	c.expire(now)
+	offset, ok := c.estimate()
+	if !ok {
+		return c.offset
+	}
+	if abs(offset) > clockMaxOffset {
+		glog.Warningf("Clock: Offset of %ds capped at %ds", offset, clockMaxOffset)
+		if offset < 0 {
+			offset = -clockMaxOffset
+		} else {
+			offset = clockMaxOffset
+		}
+	}
+	if offset == c.offset {
+		return c.offset
+	}
+	glog.Infof("Clock: Offset: %ds Samples: %d", offset, len(c.samples))
+	if abs(offset) > data.DefaultCloseResolution {
+		glog.Warningf("Clock: Local clock is %ds from the network which is beyond the close time resolution of %ds", offset, data.DefaultCloseResolution)
+	}
+	c.offset = offset
+	data.SetClockOffset(offset)
+	return offset
+}
+
+func (c *NetworkClock) Offset() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.offset
+}
+
+// expire drops old samples and then the oldest ones beyond the maximum. The
+// lock must be held.
+func (c *NetworkClock) expire(now time.Time) {
+	var oldest string
+	for key, sample := range c.samples {
+		if now.Sub(sample.received) > clockExpiry {
+			delete(c.samples, key)
+			continue
+		}
+		if oldest == "" || sample.received.Before(c.samples[oldest].received) {
+			oldest = key
+		}
+	}
+	if len(c.samples) > clockMaxSamples {
+		delete(c.samples, oldest)
+	}
+}
+
+// estimate returns the median of the samples which are close to the median
+// of all samples. The lock must be held.
+func (c *NetworkClock) estimate() (int64, bool) {
+	if len(c.samples) < clockMinSamples {
+		return 0, false
+	}
+	var offsets []int64
+	for _, sample := range c.samples {
+		offsets = append(offsets, sample.offset)
+	}
+	median := medianOffset(offsets)
+	var kept []int64
+	for _, offset := range offsets {
+		if abs(offset-median) <= clockOutlier {
+			kept = append(kept, offset)
+		}
+	}
+	return medianOffset(kept), true
+}
+
+func medianOffset(offsets []int64) int64 {
+	sort.Sort(offsetSlice(offsets))
+	n := len(offsets)
+	if n%2 == 0 {
+		return (offsets[n/2-1] + offsets[n/2]) / 2
+	}
+	return offsets[n/2]
+}
+
+func abs(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+type offsetSlice []int64
+
+func (s offsetSlice) Len() int           { return len(s) }
+func (s offsetSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s offsetSlice) Less(i, j int) bool { return s[i] < s[j] }
@@ -0,0 +1,54 @@
+package peers
+
+import (
+	"github.com/donovanhide/ripple/crypto"
+	"github.com/donovanhide/ripple/data"
+	"testing"
+)
+
+func TestNetworkClock(t *testing.T) {
+	defer data.SetClockOffset(0)
+	c := NewNetworkClock()
+	keys := make([]crypto.Hash, 6)
+	for i := range keys {
+		var err error
+		if keys[i], err = crypto.NewRipplePublicNode(newTestKey(t).PublicCompressed()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := data.LocalNow().Uint32()
+	if offset := c.Add(keys[0], now+40, true); offset != 0 {
+		t.Fatalf("Offset from a single sample: %d", offset)
+	}
+	c.Add(keys[1], now+42, true)
+	if offset := c.Add(keys[1], now+40, true); offset != 0 {
+		t.Fatalf("Offset from two samples: %d", offset)
+	}
+	c.Add(keys[2], now+3600, true)
+	c.Add(keys[3], now-3600, true)
+	if offset := c.Add(keys[4], now+40, true); offset < 39 || offset > 41 {
+		t.Fatalf("Outliers not dropped: %d", offset)
+	}
+	if offset := c.Add(keys[5], now+40000, false); offset < 39 || offset > 41 {
+		t.Fatalf("Untrusted sample used: %d", offset)
+	}
+	if drift := int64(data.Now().Uint32()) - int64(data.LocalNow().Uint32()); drift != c.Offset() {
+		t.Fatalf("Now not adjusted: %d", drift)
+	}
+}
+
+func TestNetworkClockCapped(t *testing.T) {
+	defer data.SetClockOffset(0)
+	c := NewNetworkClock()
+	now := data.LocalNow().Uint32()
+	for i := 0; i < clockMinSamples; i++ {
+		key, err := crypto.NewRipplePublicNode(newTestKey(t).PublicCompressed())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Add(key, now-2*clockMaxOffset, true)
+	}
+	if offset := c.Offset(); offset != -clockMaxOffset {
+		t.Fatalf("Offset not capped: %d", offset)
+	}
+}
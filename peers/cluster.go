@@ -0,0 +1,186 @@
+package peers
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"fmt"
+	"github.com/donovanhide/ripple/crypto"
+	"github.com/donovanhide/ripple/data"
+	"github.com/donovanhide/ripple/peers/protocol"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// clusterStale is the age in seconds after which a member's report is no
+// longer used for the cluster load
+const clusterStale = 90
+
+type ClusterMember struct {
+	PublicKey  string
+	Name       string
+	Address    string
+	Load       uint32
+	ReportTime data.RippleTime
+}
+
+// Cluster is a set of our own nodes which trust each other. Members are not
+// charged for the load they cause and exchange their load and the balances
+// of heavy hosts through TMCluster messages.
+type Cluster struct {
+	members map[string]*ClusterMember
+	mu      sync.RWMutex
+}
+
+// NewCluster parses node public keys separated by commas
+func NewCluster(keys string) (*Cluster, error) {
+	c := &Cluster{
+		members: make(map[string]*ClusterMember),
+	}
+	for _, key := range strings.Split(keys, ",") {
+		if key = strings.TrimSpace(key); key == "" {
+			continue
+		}
+		hash, err := crypto.NewRippleHashCheck(key, crypto.RIPPLE_NODE_PUBLIC)
+		if err != nil {
+			return nil, fmt.Errorf("Bad cluster member: %s: %s", key, err.Error())
+		}
+		c.members[hash.String()] = &ClusterMember{PublicKey: hash.String()}
+	}
+	return c, nil
+}
+
+func (c *Cluster) Size() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.members)
+}
+
+func (c *Cluster) Member(key crypto.Hash) bool {
+	if key == nil {
+		return false
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	_, ok := c.members[key.String()]
+	return ok
+}
+
+// Get returns a copy of the member with the given key
+func (c *Cluster) Get(key crypto.Hash) *ClusterMember {
+	if key == nil {
+		return nil
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	member, ok := c.members[key.String()]
+	if !ok {
+		return nil
+	}
+	copied := *member
+	return &copied
+}
+
+// Members returns copies of all members ordered by public key
+func (c *Cluster) Members() []*ClusterMember {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var members []*ClusterMember
+	for _, member := range c.members {
+		copied := *member
+		members = append(members, &copied)
+	}
+	sort.Sort(clusterMemberSlice(members))
+	return members
+}
+
+// Update applies the reports of members which are newer than those already
+// held and returns the number applied. Reports for other nodes are ignored.
+func (c *Cluster) Update(nodes []*protocol.TMClusterNode) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var updated int
+	for _, node := range nodes {
+		member, ok := c.members[node.GetPublicKey()]
+		if !ok || node.GetReportTime() <= member.ReportTime.Uint32() {
+			continue
+		}
+		member.Name = node.GetNodeName()
+		member.Address = node.GetAddress()
+		member.Load = node.GetNodeLoad()
+		member.ReportTime.SetUint32(node.GetReportTime())
+		updated++
+	}
+	return updated
+}
+
+// Load returns the median load of the members with recent reports
+func (c *Cluster) Load() uint32 {
+	now := data.Now().Uint32()
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var loads []int
+	for _, member := range c.members {
+		if reported := member.ReportTime.Uint32(); reported > 0 && now-reported < clusterStale {
+			loads = append(loads, int(member.Load))
+		}
+	}
+	if len(loads) == 0 {
+		return 0
+	}
+	sort.Ints(loads)
+	return uint32(loads[len(loads)/2])
+}
+
+// Message reports self along with the recent reports of other members, so
+// that members which are not directly connected still hear of each other
+func (c *Cluster) Message(self *ClusterMember, balances map[string]float64) *protocol.TMCluster {
+	msg := &protocol.TMCluster{
+		ClusterNodes: []*protocol.TMClusterNode{newClusterNode(self)},
+	}
+	now := data.Now().Uint32()
+	for _, member := range c.Members() {
+		if member.PublicKey == self.PublicKey {
+			continue
+		}
+		if reported := member.ReportTime.Uint32(); reported > 0 && now-reported < clusterStale {
+			msg.ClusterNodes = append(msg.ClusterNodes, newClusterNode(member))
+		}
+	}
+	for host, balance := range balances {
+		msg.LoadSources = append(msg.LoadSources, &protocol.TMLoadSource{
+			Name: proto.String(host),
+			Cost: proto.Uint32(uint32(balance)),
+		})
+	}
+	return msg
+}
+
+// clusterBalances reads the balances of heavy hosts from a TMCluster message
+func clusterBalances(msg *protocol.TMCluster) map[string]float64 {
+	balances := make(map[string]float64)
+	for _, source := range msg.GetLoadSources() {
+		balances[source.GetName()] += float64(source.GetCost())
+	}
+	return balances
+}
+
+func newClusterNode(member *ClusterMember) *protocol.TMClusterNode {
+	node := &protocol.TMClusterNode{
+		PublicKey:  proto.String(member.PublicKey),
+		ReportTime: proto.Uint32(member.ReportTime.Uint32()),
+		NodeLoad:   proto.Uint32(member.Load),
+	}
+	if member.Name != "" {
+		node.NodeName = proto.String(member.Name)
+	}
+	if member.Address != "" {
+		node.Address = proto.String(member.Address)
+	}
+	return node
+}
+
+type clusterMemberSlice []*ClusterMember
+
+func (s clusterMemberSlice) Len() int           { return len(s) }
+func (s clusterMemberSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s clusterMemberSlice) Less(i, j int) bool { return s[i].PublicKey < s[j].PublicKey }
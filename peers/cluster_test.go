@@ -0,0 +1,108 @@
+package peers
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/donovanhide/ripple/crypto"
+	"github.com/donovanhide/ripple/data"
+	"github.com/donovanhide/ripple/peers/protocol"
+	"strings"
+	"testing"
+)
+
+func newTestNodeKeys(t *testing.T, n int) []crypto.Hash {
+	var keys []crypto.Hash
+	for i := 0; i < n; i++ {
+		key, err := crypto.NewRipplePublicNode(newTestKey(t).PublicCompressed())
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func TestCluster(t *testing.T) {
+	if _, err := NewCluster("bad"); err == nil {
+		t.Fatal("Bad member accepted")
+	}
+	keys := newTestNodeKeys(t, 4)
+	c, err := NewCluster(strings.Join([]string{keys[0].String(), keys[1].String(), keys[2].String()}, ", "))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Size() != 3 || !c.Member(keys[1]) || c.Member(keys[3]) || c.Member(nil) {
+		t.Fatal("Wrong members")
+	}
+	now := data.Now().Uint32()
+	report := func(key crypto.Hash, load, at uint32) *protocol.TMClusterNode {
+		return &protocol.TMClusterNode{
+			PublicKey:  proto.String(key.String()),
+			ReportTime: proto.Uint32(at),
+			NodeLoad:   proto.Uint32(load),
+		}
+	}
+	nodes := []*protocol.TMClusterNode{
+		report(keys[0], 10, now),
+		report(keys[1], 30, now),
+		report(keys[2], 20, now-clusterStale),
+		report(keys[3], 40, now),
+	}
+	if updated := c.Update(nodes); updated != 3 {
+		t.Fatalf("Wrong number of reports applied: %d", updated)
+	}
+	if updated := c.Update([]*protocol.TMClusterNode{report(keys[0], 50, now-1)}); updated != 0 {
+		t.Fatal("Older report applied")
+	}
+	if load := c.Load(); load != 30 {
+		t.Fatalf("Wrong load: %d", load)
+	}
+	self := c.Get(keys[0])
+	msg := c.Message(self, map[string]float64{"a": 2000})
+	if len(msg.ClusterNodes) != 2 || msg.ClusterNodes[0].GetPublicKey() != keys[0].String() {
+		t.Fatalf("Wrong cluster message: %s", msg)
+	}
+	if balances := clusterBalances(msg); balances["a"] != 2000 {
+		t.Fatalf("Wrong balances: %v", balances)
+	}
+}
+
+func TestClusterResources(t *testing.T) {
+	r := NewResourceManager()
+	r.Charge("a", feeInvalidSignature, 1)
+	r.Charge("b", feeQuery, 1)
+	exported := r.Export()
+	if len(exported) != 1 || exported["a"] < resourceGossip {
+		t.Fatalf("Wrong export: %v", exported)
+	}
+	other := NewResourceManager()
+	other.Import("node", map[string]float64{"a": resourceDrop})
+	if d := other.Charge("a", feeQuery, 1); d != Drop || !other.Banned("a") {
+		t.Fatalf("Imported balance ignored: %d", d)
+	}
+	if d := other.Charge("b", feeQuery, 1); d != Ok {
+		t.Fatalf("Wrong disposition: %d", d)
+	}
+}
+
+func TestClusterMemberNotCharged(t *testing.T) {
+	keys := newTestNodeKeys(t, 1)
+	c, err := NewCluster(keys[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewResourceManager()
+	peer := newTestPeer(&PeerConnection{Host: "a", Port: "1"})
+	peer.resources = r
+	peer.PublicKey = keys[0]
+	if peer.JoinCluster(c) {
+		t.Fatal("Unverified peer joined cluster")
+	}
+	peer.UpdateStatus(Verified)
+	if !peer.JoinCluster(c) {
+		t.Fatal("Member not joined")
+	}
+	peer.charge(feeInvalidSignature, 10)
+	if balance, _ := r.Balance("a"); balance != 0 || peer.Status == Banned {
+		t.Fatalf("Cluster member charged: %f", balance)
+	}
+}
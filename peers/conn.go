@@ -26,6 +26,7 @@ type PeerConnection struct {
 	Host    string
 	Port    string
 	Trusted bool
+	Inbound bool
 	Conn    net.Conn
 }
 
@@ -33,8 +34,12 @@ type Conn struct {
 	Host     string
 	Port     string
 	Resolved string
+	Inbound  bool
 	*sslconn.Conn
-	conn net.Conn
+	conn     net.Conn
+	reader   *bufio.Reader
+	recorder *protocol.Recorder
+	label    func() string
 }
 
 func Listen(m *Manager, port string) {
@@ -65,9 +70,10 @@ func Listen(m *Manager, port string) {
 
 func NewConn(p *PeerConnection) (*Conn, error) {
 	c := &Conn{
-		Host: p.Host,
-		Port: p.Port,
-		conn: p.Conn,
+		Host:    p.Host,
+		Port:    p.Port,
+		Inbound: p.Inbound,
+		conn:    p.Conn,
 	}
 	names, err := net.LookupAddr(c.Host)
 	if err == nil {
@@ -84,15 +90,26 @@ func NewConn(p *PeerConnection) (*Conn, error) {
 	config := &sslconn.Config{
 		CipherList: defaultCipher,
 	}
-	if c.Conn, err = sslconn.NewConn(c.conn, c.conn, config, false); err != nil {
+	if c.Conn, err = sslconn.NewConn(c.conn, c.conn, config, c.Inbound); err != nil {
 		return c, fmt.Errorf("Connect: %s", err.Error())
 	}
 	if err := c.Handshake(); err != nil {
 		return c, fmt.Errorf("Connect: %s", err.Error())
 	}
+	c.reader = bufio.NewReaderSize(c, peerBuffer)
 	return c, nil
 }
 
+// upgrade performs the HTTP upgrade handshake over the TLS connection
+func (c *Conn) upgrade(m *Manager) (*Handshake, error) {
+	c.conn.SetDeadline(time.Now().Add(peerTimeout))
+	defer c.conn.SetDeadline(time.Time{})
+	if c.Inbound {
+		return m.acceptUpgrade(c, c.reader)
+	}
+	return m.requestUpgrade(c, c.reader, c.String())
+}
+
 func (c *Conn) run(incoming chan protocol.ExtendedMessage, outgoing chan proto.Message) {
 	go c.writePump(outgoing)
 	c.readPump(incoming)
@@ -105,7 +122,10 @@ func (c *Conn) run(incoming chan protocol.ExtendedMessage, outgoing chan proto.M
 
 func (c *Conn) writePump(out chan proto.Message) {
 	w := bufio.NewWriterSize(c, peerBuffer)
-	encoder := protocol.NewEncoder(w)
+	var encoder protocol.MessageEncoder = protocol.NewEncoder(w)
+	if c.recorder != nil {
+		encoder = c.recorder.Encoder(w, c.label)
+	}
 	var err error
 	for msg := range out {
 		if err = encoder.Encode(msg); err != nil {
@@ -121,8 +141,10 @@ func (c *Conn) writePump(out chan proto.Message) {
 }
 
 func (c *Conn) readPump(in chan protocol.ExtendedMessage) {
-	r := bufio.NewReaderSize(c, peerBuffer)
-	decoder := protocol.NewDecoder(r)
+	var decoder protocol.MessageDecoder = protocol.NewDecoder(c.reader)
+	if c.recorder != nil {
+		decoder = c.recorder.Decoder(c.reader, c.label)
+	}
 	for {
 		msg, err := decoder.Decode()
 		if err != nil {
@@ -0,0 +1,290 @@
+package peers
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"encoding/json"
+	"fmt"
+	"github.com/donovanhide/ripple/crypto"
+	"github.com/donovanhide/ripple/peers/protocol"
+	"github.com/golang/glog"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fullHistoryStart is the first ledger of the history held by the network
+const fullHistoryStart = 32570
+
+// CrawlNode is what was learnt about one endpoint of the network
+type CrawlNode struct {
+	Address       string
+	Depth         int
+	Reachable     bool
+	Error         string `json:",omitempty"`
+	PublicKey     string `json:",omitempty"`
+	Name          string `json:",omitempty"`
+	Version       string `json:",omitempty"`
+	CurrentLedger uint32 `json:",omitempty"`
+	MinLedger     uint32 `json:",omitempty"`
+	MaxLedger     uint32 `json:",omitempty"`
+	Neighbours    []string
+}
+
+// FullHistory is true if the node holds every ledger from the start of the
+// history
+func (n *CrawlNode) FullHistory() bool {
+	return n.MinLedger > 0 && n.MinLedger <= fullHistoryStart
+}
+
+// CrawlGraph is the result of a crawl. Nodes are ordered by address.
+type CrawlGraph struct {
+	Started  time.Time
+	Finished time.Time
+	Nodes    []*CrawlNode
+}
+
+// Crawler connects to peers, asks each one for the endpoints it knows and
+// follows them breadth first
+type Crawler struct {
+	MaxDepth int
+	MaxNodes int
+	Workers  int
+	Timeout  time.Duration
+	manager  *Manager
+}
+
+func NewCrawler(key crypto.Key, name string) (*Crawler, error) {
+	publicKey, err := crypto.NewRipplePublicNode(key.PublicCompressed())
+	if err != nil {
+		return nil, err
+	}
+	return &Crawler{
+		MaxDepth: 3,
+		MaxNodes: 1000,
+		Workers:  20,
+		Timeout:  10 * time.Second,
+		manager: &Manager{
+			Config:    &Config{Key: key, Name: name},
+			PublicKey: publicKey,
+		},
+	}, nil
+}
+
+// Crawl visits the seeds and then each level of endpoints they lead to until
+// MaxDepth or MaxNodes is reached
+func (c *Crawler) Crawl(seeds []string) *CrawlGraph {
+	graph := &CrawlGraph{Started: time.Now()}
+	seen := make(map[string]bool)
+	var level []string
+	for _, seed := range seeds {
+		if !seen[seed] {
+			seen[seed] = true
+			level = append(level, seed)
+		}
+	}
+	for depth := 0; len(level) > 0 && depth <= c.MaxDepth; depth++ {
+		glog.Infof("Crawler: Depth: %d Nodes: %d", depth, len(level))
+		nodes := c.visit(level, depth)
+		graph.Nodes = append(graph.Nodes, nodes...)
+		level = nil
+		for _, node := range nodes {
+			for _, address := range node.Neighbours {
+				if !seen[address] && len(seen) < c.MaxNodes {
+					seen[address] = true
+					level = append(level, address)
+				}
+			}
+		}
+	}
+	sort.Sort(crawlNodeSlice(graph.Nodes))
+	graph.Finished = time.Now()
+	return graph
+}
+
+// visit probes the addresses of one level on a pool of workers
+func (c *Crawler) visit(addresses []string, depth int) []*CrawlNode {
+	work := make(chan string)
+	results := make(chan *CrawlNode)
+	var wg sync.WaitGroup
+	for i := 0; i < c.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for address := range work {
+				node := c.probe(address)
+				node.Depth = depth
+				results <- node
+			}
+		}()
+	}
+	go func() {
+		for _, address := range addresses {
+			work <- address
+		}
+		close(work)
+		wg.Wait()
+		close(results)
+	}()
+	var nodes []*CrawlNode
+	for node := range results {
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+// probe connects to a single address, performs the handshake and waits for
+// the peer's endpoints and status until the timeout
+func (c *Crawler) probe(address string) *CrawlNode {
+	node := &CrawlNode{Address: address}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		node.Error = err.Error()
+		return node
+	}
+	conn, err := NewConn(&PeerConnection{Host: host, Port: port})
+	if err != nil {
+		node.Error = err.Error()
+		if conn != nil && conn.conn != nil {
+			conn.conn.Close()
+		}
+		return node
+	}
+	defer conn.conn.Close()
+	handshake, err := conn.upgrade(c.manager)
+	if err != nil {
+		node.Error = fmt.Sprintf("Handshake: %s", err.Error())
+		return node
+	}
+	node.Reachable = true
+	node.PublicKey, node.Name, node.Version = handshake.PublicKey.String(), handshake.Name, handshake.Protocol
+	incoming := make(chan protocol.ExtendedMessage, 10)
+	outgoing := make(chan proto.Message, 10)
+	go conn.run(incoming, outgoing)
+	defer func() {
+		close(outgoing)
+		conn.conn.Close()
+		for range incoming {
+		}
+	}()
+	outgoing <- &protocol.TMGetPeers{DoWeNeedThis: proto.Uint32(1)}
+	timeout := time.After(c.Timeout)
+	var endpoints, status bool
+	for !endpoints || !status {
+		select {
+		case <-timeout:
+			return node
+		case in, ok := <-incoming:
+			if !ok {
+				return node
+			}
+			switch msg := in.(type) {
+			case *protocol.Hello:
+				node.Name, node.Version = msg.GetFullVersion(), msg.Version
+				node.CurrentLedger = msg.GetLedgerIndex()
+			case *protocol.TMStatusChange:
+				node.CurrentLedger, node.MinLedger, node.MaxLedger = msg.GetLedgerSeq(), msg.GetFirstSeq(), msg.GetLastSeq()
+				status = true
+			case *protocol.TMEndpoints:
+				node.Neighbours = neighbours(msg)
+				endpoints = true
+			case *protocol.Ping:
+				if msg.IsPing {
+					outgoing <- protocol.NewPong()
+				}
+			}
+		}
+	}
+	return node
+}
+
+// neighbours returns the addresses of the directly connected peers of the
+// sender of msg
+func neighbours(msg *protocol.TMEndpoints) []string {
+	var addresses []string
+	for _, endpoint := range msg.GetEndpoints() {
+		if endpoint.GetHops() == 1 {
+			addresses = append(addresses, endpoint.GetIpv4().Address())
+		}
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+// Reachable returns the number of nodes which completed the handshake
+func (g *CrawlGraph) Reachable() int {
+	var reachable int
+	for _, node := range g.Nodes {
+		if node.Reachable {
+			reachable++
+		}
+	}
+	return reachable
+}
+
+// Versions counts the reachable nodes by client name
+func (g *CrawlGraph) Versions() map[string]int {
+	versions := make(map[string]int)
+	for _, node := range g.Nodes {
+		if node.Reachable {
+			versions[node.Name]++
+		}
+	}
+	return versions
+}
+
+// FullHistory returns the addresses of the nodes holding full history
+func (g *CrawlGraph) FullHistory() []string {
+	var addresses []string
+	for _, node := range g.Nodes {
+		if node.FullHistory() {
+			addresses = append(addresses, node.Address)
+		}
+	}
+	return addresses
+}
+
+func (g *CrawlGraph) WriteJSON(w io.Writer) error {
+	out, err := json.MarshalIndent(g, "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(out)
+	return err
+}
+
+// WriteDOT writes the graph in the Graphviz format. Unreachable nodes are
+// dashed and nodes holding full history are filled.
+func (g *CrawlGraph) WriteDOT(w io.Writer) error {
+	lines := []string{"digraph network {", "\tnode [shape=box];"}
+	for _, node := range g.Nodes {
+		label := node.Address
+		if node.Reachable {
+			label = fmt.Sprintf("%s\\n%s\\n%d-%d", node.Address, node.Name, node.MinLedger, node.MaxLedger)
+		}
+		var style string
+		switch {
+		case !node.Reachable:
+			style = ", style=dashed"
+		case node.FullHistory():
+			style = ", style=filled"
+		}
+		lines = append(lines, fmt.Sprintf("\t\"%s\" [label=\"%s\"%s];", node.Address, label, style))
+	}
+	for _, node := range g.Nodes {
+		for _, neighbour := range node.Neighbours {
+			lines = append(lines, fmt.Sprintf("\t\"%s\" -> \"%s\";", node.Address, neighbour))
+		}
+	}
+	lines = append(lines, "}\n")
+	_, err := io.WriteString(w, strings.Join(lines, "\n"))
+	return err
+}
+
+type crawlNodeSlice []*CrawlNode
+
+func (s crawlNodeSlice) Len() int           { return len(s) }
+func (s crawlNodeSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s crawlNodeSlice) Less(i, j int) bool { return s[i].Address < s[j].Address }
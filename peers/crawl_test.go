@@ -0,0 +1,57 @@
+package peers
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCrawl(t *testing.T) {
+	sync, _ := newSimLedgers(t)
+	a, b, c := newSimPeer(t, sync, simBehaviour{}), newSimPeer(t, newSimSync(), simBehaviour{}), newSimPeer(t, newSimSync(), simBehaviour{})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreachable := l.Addr().String()
+	l.Close()
+	a.advertise(b.Address(), c.Address())
+	b.advertise(c.Address(), unreachable)
+	crawler, err := NewCrawler(newTestKey(t), "crawler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	crawler.Timeout = time.Second
+	graph := crawler.Crawl([]string{a.Address()})
+	if len(graph.Nodes) != 4 || graph.Reachable() != 3 {
+		t.Fatalf("Wrong nodes: %d reachable: %d", len(graph.Nodes), graph.Reachable())
+	}
+	nodes := make(map[string]*CrawlNode)
+	for _, node := range graph.Nodes {
+		nodes[node.Address] = node
+	}
+	if node := nodes[a.Address()]; node.Depth != 0 || node.MinLedger != simSequence || node.Name != "sim" || node.PublicKey != a.manager.PublicKey.String() {
+		t.Fatalf("Wrong seed: %+v", node)
+	}
+	if node := nodes[c.Address()]; node.Depth != 1 || !node.Reachable {
+		t.Fatalf("Wrong neighbour: %+v", node)
+	}
+	if node := nodes[unreachable]; node.Depth != 2 || node.Reachable || node.Error == "" {
+		t.Fatalf("Wrong unreachable node: %+v", node)
+	}
+	if versions := graph.Versions(); versions["sim"] != 3 {
+		t.Fatalf("Wrong versions: %v", versions)
+	}
+	var dot bytes.Buffer
+	if err := graph.WriteDOT(&dot); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(dot.String(), a.Address()+"\" -> \""+b.Address()) || !strings.Contains(dot.String(), "style=dashed") {
+		t.Fatalf("Wrong DOT: %s", dot.String())
+	}
+	if err := graph.WriteJSON(&dot); err != nil {
+		t.Fatal(err)
+	}
+}
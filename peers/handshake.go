@@ -0,0 +1,248 @@
+package peers
+
+import (
+	"bufio"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/donovanhide/ripple/crypto"
+	"github.com/donovanhide/ripple/data"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var supportedProtocols = []string{"RTXP/1.2"}
+
+// Handshake holds the headers exchanged in the HTTP upgrade request and
+// response which replace the legacy TMHello message
+type Handshake struct {
+	Protocol       string
+	Name           string
+	PublicKey      crypto.Hash
+	NetworkTime    uint32
+	ClosedLedger   data.Hash256
+	PreviousLedger data.Hash256
+}
+
+// A TLS connection which exposes the finished messages of its handshake
+type session interface {
+	io.ReadWriter
+	GetFinishedMessage(int) []byte
+	GetPeerFinishedMessage(int) []byte
+}
+
+// sharedValue is signed by both peers to prove ownership of the public keys
+// they present and that nothing sits between them in the TLS session
+func sharedValue(s session) ([]byte, error) {
+	mine, theirs := sha512.Sum512(s.GetFinishedMessage(1024)), sha512.Sum512(s.GetPeerFinishedMessage(1024))
+	var xor [sha512.Size]byte
+	var zero byte
+	for i := range xor {
+		xor[i] = mine[i] ^ theirs[i]
+		zero |= xor[i]
+	}
+	if zero == 0 {
+		return nil, fmt.Errorf("Identical finished messages")
+	}
+	return crypto.Sha512Half(xor[:])
+}
+
+// requestUpgrade sends the upgrade request for an outgoing connection and
+// checks the response
+func (m *Manager) requestUpgrade(s session, r *bufio.Reader, host string) (*Handshake, error) {
+	shared, err := sharedValue(s)
+	if err != nil {
+		return nil, err
+	}
+	header, err := m.handshakeHeader(shared)
+	if err != nil {
+		return nil, err
+	}
+	header.Set("User-Agent", m.Name)
+	header.Set("Upgrade", strings.Join(supportedProtocols, ", "))
+	header.Set("Connection", "Upgrade")
+	req := &http.Request{
+		Method:     "GET",
+		URL:        &url.URL{Path: "/"},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Host:       host,
+	}
+	if err := req.Write(s); err != nil {
+		return nil, err
+	}
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("Upgrade refused: %s", resp.Status)
+	}
+	if !supported(resp.Header.Get("Upgrade")) {
+		return nil, fmt.Errorf("Unsupported protocol: %s", resp.Header.Get("Upgrade"))
+	}
+	return m.checkHandshake(resp.Header, shared, resp.Header.Get("Server"))
+}
+
+// acceptUpgrade reads the upgrade request of an incoming connection and
+// responds to it
+func (m *Manager) acceptUpgrade(s session, r *bufio.Reader) (*Handshake, error) {
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	var protocol string
+	for _, p := range strings.Split(req.Header.Get("Upgrade"), ",") {
+		if p = strings.TrimSpace(p); supported(p) {
+			protocol = p
+			break
+		}
+	}
+	shared, err := sharedValue(s)
+	if err != nil {
+		return nil, refuse(s, req, err)
+	}
+	switch {
+	case protocol == "":
+		return nil, refuse(s, req, fmt.Errorf("Unsupported protocol: %s", req.Header.Get("Upgrade")))
+	case req.Header.Get("Connect-As") != "Peer":
+		return nil, refuse(s, req, fmt.Errorf("Bad Connect-As: %s", req.Header.Get("Connect-As")))
+	}
+	handshake, err := m.checkHandshake(req.Header, shared, req.Header.Get("User-Agent"))
+	if err != nil {
+		return nil, refuse(s, req, err)
+	}
+	header, err := m.handshakeHeader(shared)
+	if err != nil {
+		return nil, err
+	}
+	header.Set("Server", m.Name)
+	header.Set("Upgrade", protocol)
+	header.Set("Connection", "Upgrade")
+	resp := &http.Response{
+		StatusCode: http.StatusSwitchingProtocols,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Request:    req,
+	}
+	return handshake, resp.Write(s)
+}
+
+func refuse(w io.Writer, req *http.Request, reason error) error {
+	resp := &http.Response{
+		StatusCode: http.StatusBadRequest,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Request:    req,
+		Close:      true,
+	}
+	resp.Write(w)
+	return reason
+}
+
+func supported(protocol string) bool {
+	for _, p := range supportedProtocols {
+		if p == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Manager) handshakeHeader(shared []byte) (http.Header, error) {
+	signature, err := m.Key.Sign(shared)
+	if err != nil {
+		return nil, err
+	}
+	header := make(http.Header)
+	header.Set("Connect-As", "Peer")
+	header.Set("Crawl", "private")
+	header.Set("Public-Key", m.PublicKey.String())
+	header.Set("Session-Signature", base64.StdEncoding.EncodeToString(signature))
+	header.Set("Network-Time", strconv.FormatUint(uint64(data.Now().Uint32()), 10))
+	if m.Sync == nil {
+		return header, nil
+	}
+	if _, last := m.Sync.Range(); last > 0 {
+		if hash, ok := m.Sync.LedgerHash(last); ok {
+			header.Set("Closed-Ledger", hash.String())
+		}
+		if hash, ok := m.Sync.LedgerHash(last - 1); ok {
+			header.Set("Previous-Ledger", hash.String())
+		}
+	}
+	return header, nil
+}
+
+// checkHandshake verifies the session signature against the presented
+// public key and parses the remaining headers
+func (m *Manager) checkHandshake(header http.Header, shared []byte, name string) (*Handshake, error) {
+	publicKey := header.Get("Public-Key")
+	key, err := crypto.ParsePublicKeyFromHash([]byte(publicKey))
+	if err != nil {
+		return nil, fmt.Errorf("Bad public key: %s", publicKey)
+	}
+	signature, err := base64.StdEncoding.DecodeString(header.Get("Session-Signature"))
+	if err != nil {
+		return nil, fmt.Errorf("Bad session signature: %s", err.Error())
+	}
+	ok, err := crypto.Verify(key.SerializeUncompressed(), signature, shared)
+	if err != nil {
+		return nil, fmt.Errorf("Bad session signature verification: %s", err.Error())
+	}
+	if !ok {
+		return nil, fmt.Errorf("Bad session signature: %s public key: %s", header.Get("Session-Signature"), publicKey)
+	}
+	handshake := &Handshake{
+		Protocol: header.Get("Upgrade"),
+		Name:     name,
+	}
+	if handshake.PublicKey, err = crypto.NewRippleHash(publicKey); err != nil {
+		return nil, err
+	}
+	if handshake.PublicKey.String() == m.PublicKey.String() {
+		return nil, fmt.Errorf("Connected to self")
+	}
+	if t := header.Get("Network-Time"); t != "" {
+		networkTime, err := strconv.ParseUint(t, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Bad network time: %s", t)
+		}
+		handshake.NetworkTime = uint32(networkTime)
+	}
+	if err := parseLedgerHeader(header.Get("Closed-Ledger"), &handshake.ClosedLedger); err != nil {
+		return nil, err
+	}
+	if err := parseLedgerHeader(header.Get("Previous-Ledger"), &handshake.PreviousLedger); err != nil {
+		return nil, err
+	}
+	return handshake, nil
+}
+
+// Ledger hashes may be sent as hex or base64
+func parseLedgerHeader(value string, hash *data.Hash256) error {
+	var (
+		b   []byte
+		err error
+	)
+	switch {
+	case value == "":
+		return nil
+	case len(value) == hex.EncodedLen(len(hash)):
+		b, err = hex.DecodeString(value)
+	default:
+		b, err = base64.StdEncoding.DecodeString(value)
+	}
+	if err != nil || len(b) != len(hash) {
+		return fmt.Errorf("Bad ledger hash: %s", value)
+	}
+	copy(hash[:], b)
+	return nil
+}
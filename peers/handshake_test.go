@@ -0,0 +1,100 @@
+package peers
+
+import (
+	"github.com/donovanhide/ripple/crypto"
+	"github.com/donovanhide/ripple/ledger"
+	"github.com/donovanhide/ripple/storage"
+	"net"
+	"testing"
+)
+
+func newTestManager(t *testing.T, name string, key crypto.Key) *Manager {
+	sync, err := ledger.NewManager(storage.NewEmptyMemoryDB())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Manager{
+		Config: &Config{
+			Key:  key,
+			Name: name,
+			Sync: sync,
+		},
+	}
+	if m.PublicKey, err = crypto.NewRipplePublicNode(key.PublicCompressed()); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func newTestKey(t *testing.T) crypto.Key {
+	key, err := crypto.GenerateRootDeterministicKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+type handshakeResult struct {
+	handshake *Handshake
+	err       error
+}
+
+// handshake connects a client to a server over a local TLS connection and
+// returns the handshakes seen by each side
+func handshake(t *testing.T, client, server *Manager) (handshakeResult, handshakeResult) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan handshakeResult)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			accepted <- handshakeResult{err: err}
+			return
+		}
+		defer conn.Close()
+		c, err := NewConn(&PeerConnection{Host: "127.0.0.1", Port: "0", Inbound: true, Conn: conn})
+		if err != nil {
+			accepted <- handshakeResult{err: err}
+			return
+		}
+		h, err := c.upgrade(server)
+		accepted <- handshakeResult{h, err}
+	}()
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	c, err := NewConn(&PeerConnection{Host: host, Port: port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.conn.Close()
+	h, err := c.upgrade(client)
+	return handshakeResult{h, err}, <-accepted
+}
+
+func TestHandshake(t *testing.T) {
+	client := newTestManager(t, "client", newTestKey(t))
+	server := newTestManager(t, "server", newTestKey(t))
+	outbound, inbound := handshake(t, client, server)
+	if outbound.err != nil || inbound.err != nil {
+		t.Fatalf("Handshake failed: %v %v", outbound.err, inbound.err)
+	}
+	if outbound.handshake.PublicKey.String() != server.PublicKey.String() || outbound.handshake.Name != "server" {
+		t.Errorf("Wrong server handshake: %+v", outbound.handshake)
+	}
+	if inbound.handshake.PublicKey.String() != client.PublicKey.String() || inbound.handshake.Name != "client" {
+		t.Errorf("Wrong client handshake: %+v", inbound.handshake)
+	}
+	if outbound.handshake.Protocol != supportedProtocols[0] || outbound.handshake.NetworkTime == 0 {
+		t.Errorf("Wrong protocol or network time: %+v", outbound.handshake)
+	}
+}
+
+func TestHandshakeSelf(t *testing.T) {
+	key := newTestKey(t)
+	outbound, inbound := handshake(t, newTestManager(t, "client", key), newTestManager(t, "server", key))
+	if outbound.err == nil || inbound.err == nil {
+		t.Errorf("Connection to self should fail: %v %v", outbound.err, inbound.err)
+	}
+}
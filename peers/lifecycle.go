@@ -0,0 +1,267 @@
+package peers
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	minBackoff        = 5 * time.Second
+	maxBackoff        = 30 * time.Minute
+	maxFailures       = 8
+	idleTimeout       = 3 * time.Minute
+	slowLatency       = 10 * time.Second
+	lifecycleInterval = 10 * time.Second
+)
+
+// endpoint is an address which has been discovered or configured and which
+// may be dialled when an outbound slot is free
+type endpoint struct {
+	*PeerConnection
+	peer     *Peer
+	active   bool
+	dialing  bool
+	failures int
+	valence  int
+	next     time.Time
+}
+
+func (e *endpoint) connected() bool {
+	return e.active
+}
+
+// backoff doubles the delay before the next attempt with each consecutive
+// failure
+func (e *endpoint) backoff(now time.Time) {
+	e.failures++
+	delay := maxBackoff
+	if e.failures <= 20 {
+		if d := minBackoff << uint(e.failures-1); d < maxBackoff {
+			delay = d
+		}
+	}
+	e.next = now.Add(delay)
+}
+
+// lifecycle tracks the endpoints known to the manager and the peers which
+// occupy the inbound and outbound slots. The outcome of each outbound
+// connection is recorded in the bootcache. It is only used from the
+// manager's run loop.
+type lifecycle struct {
+	maxOutbound int
+	maxInbound  int
+	cache       *Bootcache
+	endpoints   map[string]*endpoint
+	inbound     map[*Peer]struct{}
+	pending     int
+}
+
+func newLifecycle(maxOutbound, maxInbound int, cache *Bootcache) *lifecycle {
+	return &lifecycle{
+		maxOutbound: maxOutbound,
+		maxInbound:  maxInbound,
+		cache:       cache,
+		endpoints:   make(map[string]*endpoint),
+		inbound:     make(map[*Peer]struct{}),
+	}
+}
+
+// add registers an outbound endpoint. An endpoint which is already known is
+// promoted if it is now trusted.
+func (l *lifecycle) add(c *PeerConnection) {
+	if e, ok := l.endpoints[c.String()]; ok {
+		e.Trusted = e.Trusted || c.Trusted
+		return
+	}
+	l.endpoints[c.String()] = &endpoint{PeerConnection: c}
+}
+
+// accept returns false if all inbound slots are taken
+func (l *lifecycle) accept() bool {
+	if len(l.inbound)+l.pending >= l.maxInbound {
+		return false
+	}
+	l.pending++
+	return true
+}
+
+func (l *lifecycle) outbound() int {
+	var count int
+	for _, e := range l.endpoints {
+		if e.dialing || e.connected() {
+			count++
+		}
+	}
+	return count
+}
+
+// dial returns the endpoints which should be connected to now. Trusted
+// endpoints are always returned once their backoff has expired and the
+// remaining slots are filled by the endpoints with the fewest failures and
+// then the best history in the bootcache.
+func (l *lifecycle) dial(now time.Time) []*endpoint {
+	var trusted, candidates []*endpoint
+	for _, e := range l.endpoints {
+		switch {
+		case e.dialing || e.connected() || now.Before(e.next):
+		case e.Trusted:
+			trusted = append(trusted, e)
+		default:
+			e.valence = l.cache.Valence(e.PeerConnection)
+			candidates = append(candidates, e)
+		}
+	}
+	sort.Sort(endpointSlice(candidates))
+	free := l.maxOutbound - l.outbound() - len(trusted)
+	if free < 0 {
+		free = 0
+	}
+	if free < len(candidates) {
+		candidates = candidates[:free]
+	}
+	dial := append(trusted, candidates...)
+	for _, e := range dial {
+		e.dialing = true
+	}
+	return dial
+}
+
+// waiting returns the number of untrusted endpoints which could be dialled
+// now if a slot were free
+func (l *lifecycle) waiting(now time.Time) int {
+	var count int
+	for _, e := range l.endpoints {
+		if !e.Trusted && !e.dialing && !e.connected() && !now.Before(e.next) {
+			count++
+		}
+	}
+	return count
+}
+
+// connected records the result of a connection attempt
+func (l *lifecycle) connected(c *PeerConnection, peer *Peer, err error, now time.Time) {
+	if c.Inbound {
+		l.pending--
+		if err == nil {
+			l.inbound[peer] = struct{}{}
+		}
+		return
+	}
+	e, ok := l.endpoints[c.String()]
+	if !ok {
+		return
+	}
+	e.dialing, e.peer = false, peer
+	if err != nil {
+		l.cache.Failure(c)
+		l.failed(e, now)
+		return
+	}
+	l.cache.Success(c)
+	e.active, e.failures, e.next = true, 0, time.Time{}
+}
+
+// closed records the end of a connection. Outbound endpoints are retried
+// after a backoff so that other candidates get a chance at the slot.
+func (l *lifecycle) closed(c *PeerConnection, peer *Peer, now time.Time) {
+	if c.Inbound {
+		delete(l.inbound, peer)
+		return
+	}
+	if e, ok := l.endpoints[c.String()]; ok && e.active && e.peer == peer {
+		e.active = false
+		l.failed(e, now)
+	}
+}
+
+// failed backs off an endpoint and forgets it after too many consecutive
+// failures unless it is trusted
+func (l *lifecycle) failed(e *endpoint, now time.Time) {
+	e.backoff(now)
+	if !e.Trusted && e.failures > maxFailures {
+		delete(l.endpoints, e.String())
+	}
+}
+
+// evict returns the peers which should be disconnected. Peers which have
+// sent nothing recently are dead. When every outbound slot is taken and
+// candidates are waiting, the slowest untrusted outbound peer which is not a
+// cluster member is replaced.
+func (l *lifecycle) evict(now time.Time) []*Peer {
+	var (
+		evict   []*Peer
+		slowest *Peer
+		latency time.Duration
+	)
+	for peer := range l.inbound {
+		if peer.Idle(now) > idleTimeout {
+			evict = append(evict, peer)
+		}
+	}
+	for _, e := range l.endpoints {
+		if !e.connected() {
+			continue
+		}
+		if e.peer.Idle(now) > idleTimeout {
+			evict = append(evict, e.peer)
+			continue
+		}
+		if e.Trusted || e.peer.InCluster() {
+			continue
+		}
+		if average := e.peer.AverageLatency(); average > slowLatency && average > latency {
+			slowest, latency = e.peer, average
+		}
+	}
+	if slowest != nil && l.outbound() >= l.maxOutbound && l.waiting(now) > 0 {
+		evict = append(evict, slowest)
+	}
+	return evict
+}
+
+// active returns every connected peer
+func (l *lifecycle) active() []*Peer {
+	var peers []*Peer
+	for _, e := range l.endpoints {
+		if e.connected() {
+			peers = append(peers, e.peer)
+		}
+	}
+	for peer := range l.inbound {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// dump returns the state of the last peer of each endpoint and of every
+// inbound peer
+func (l *lifecycle) dump() []*Dump {
+	var dump []*Dump
+	for _, e := range l.endpoints {
+		if e.peer == nil {
+			continue
+		}
+		d := e.peer.GetDump()
+		d.Failures, d.NextAttempt = e.failures, e.next
+		dump = append(dump, d)
+	}
+	for peer := range l.inbound {
+		dump = append(dump, peer.GetDump())
+	}
+	return dump
+}
+
+type endpointSlice []*endpoint
+
+func (s endpointSlice) Len() int      { return len(s) }
+func (s endpointSlice) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s endpointSlice) Less(i, j int) bool {
+	switch {
+	case s[i].failures != s[j].failures:
+		return s[i].failures < s[j].failures
+	case s[i].valence != s[j].valence:
+		return s[i].valence > s[j].valence
+	default:
+		return s[i].String() < s[j].String()
+	}
+}
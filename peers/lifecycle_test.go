@@ -0,0 +1,113 @@
+package peers
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func newTestPeer(c *PeerConnection) *Peer {
+	return &Peer{
+		Conn:      &Conn{Host: c.Host, Port: c.Port, Inbound: c.Inbound},
+		PeerState: NewPeerState(c),
+		PeerStats: NewPeerStats(),
+	}
+}
+
+func newTestBootcache(t *testing.T) *Bootcache {
+	b, err := LoadBootcache("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestLifecycleSlots(t *testing.T) {
+	l := newLifecycle(2, 1, newTestBootcache(t))
+	now := time.Now()
+	l.add(&PeerConnection{Host: "trusted", Port: "1", Trusted: true})
+	for i := 0; i < 3; i++ {
+		l.add(&PeerConnection{Host: fmt.Sprintf("peer%d", i), Port: "1"})
+	}
+	dial := l.dial(now)
+	if len(dial) != 2 || !dial[0].Trusted || dial[1].Host != "peer0" {
+		t.Fatalf("Wrong endpoints dialled: %+v", dial)
+	}
+	if len(l.dial(now)) != 0 {
+		t.Fatal("Dialled beyond the outbound slots")
+	}
+	for _, e := range dial {
+		l.connected(e.PeerConnection, newTestPeer(e.PeerConnection), nil, now)
+	}
+	if !l.accept() || l.accept() {
+		t.Fatal("Wrong inbound slots")
+	}
+	inbound := &PeerConnection{Host: "inbound", Port: "2", Inbound: true}
+	l.connected(inbound, newTestPeer(inbound), nil, now)
+	if l.accept() || len(l.dump()) != 3 {
+		t.Fatal("Inbound peer not tracked")
+	}
+}
+
+func TestLifecycleBackoff(t *testing.T) {
+	l := newLifecycle(1, 0, newTestBootcache(t))
+	now := time.Now()
+	c := &PeerConnection{Host: "peer", Port: "1"}
+	l.add(c)
+	for i := 1; i <= maxFailures; i++ {
+		if len(l.dial(now)) != 1 {
+			t.Fatalf("Endpoint not dialled after %d failures", i-1)
+		}
+		l.connected(c, newTestPeer(c), fmt.Errorf("Refused"), now)
+		e := l.endpoints[c.String()]
+		if delay := e.next.Sub(now); delay != minBackoff<<uint(i-1) && delay != maxBackoff {
+			t.Fatalf("Wrong backoff after %d failures: %s", i, delay)
+		}
+		if len(l.dial(now)) != 0 {
+			t.Fatal("Endpoint dialled during backoff")
+		}
+		now = e.next
+	}
+	l.dial(now)
+	l.connected(c, newTestPeer(c), fmt.Errorf("Refused"), now)
+	if _, ok := l.endpoints[c.String()]; ok {
+		t.Fatal("Untrusted endpoint not forgotten")
+	}
+	trusted := &PeerConnection{Host: "trusted", Port: "1", Trusted: true}
+	l.add(trusted)
+	for i := 0; i <= maxFailures*2; i++ {
+		e := l.endpoints[trusted.String()]
+		if e == nil || len(l.dial(e.next)) != 1 {
+			t.Fatal("Trusted endpoint not redialled")
+		}
+		l.connected(trusted, newTestPeer(trusted), fmt.Errorf("Refused"), e.next)
+	}
+}
+
+func TestLifecycleEvict(t *testing.T) {
+	l := newLifecycle(1, 0, newTestBootcache(t))
+	now := time.Now()
+	slow := &PeerConnection{Host: "slow", Port: "1"}
+	l.add(slow)
+	l.dial(now)
+	peer := newTestPeer(slow)
+	peer.Latencies["LedgerData"] = &Latency{Count: 1, Total: slowLatency * 2}
+	peer.LastReceived = now
+	l.connected(slow, peer, nil, now)
+	if len(l.evict(now)) != 0 {
+		t.Fatal("Slow peer evicted without a replacement")
+	}
+	l.add(&PeerConnection{Host: "waiting", Port: "1"})
+	if evicted := l.evict(now); len(evicted) != 1 || evicted[0] != peer {
+		t.Fatal("Slow peer not evicted")
+	}
+	l.closed(slow, peer, now)
+	if dial := l.dial(now); len(dial) != 1 || dial[0].Host != "waiting" {
+		t.Fatal("Replacement not dialled")
+	}
+	idle := l.endpoints["waiting:1"]
+	l.connected(idle.PeerConnection, newTestPeer(idle.PeerConnection), nil, now)
+	if len(l.evict(now.Add(idleTimeout*2))) != 1 {
+		t.Fatal("Idle peer not evicted")
+	}
+}
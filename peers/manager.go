@@ -1,31 +1,70 @@
 package peers
 
 import (
+	"code.google.com/p/goprotobuf/proto"
 	"encoding/json"
 	"fmt"
 	"github.com/donovanhide/ripple/crypto"
+	"github.com/donovanhide/ripple/data"
 	"github.com/donovanhide/ripple/ledger"
+	"github.com/donovanhide/ripple/peers/protocol"
 	"github.com/golang/glog"
 	"net"
+	"os"
 	"strings"
+	"time"
 )
 
 type Config struct {
-	Key      crypto.Key
-	Name     string
-	Port     string
-	Sync     ledger.Sync
-	MaxPeers int
-	Trusted  string
+	Key             crypto.Key
+	Name            string
+	Port            string
+	Sync            ledger.Sync
+	MaxPeers        int
+	MaxInbound      int
+	Trusted         string
+	Cluster         string
+	Bootcache       string
+	Capture         string
+	Challenge       bool
+	LegacyHandshake bool
 }
 
 type Manager struct {
 	*Config
 	PublicKey crypto.Hash
+	Bootcache *Bootcache
+	Router    *HashRouter
+	Resources *ResourceManager
+	Pow       *ProofOfWorkPool
+	Cluster   *Cluster
+	Clock     *NetworkClock
 	Quit      chan bool
 	Status    chan chan []byte
 	peers     chan *PeerConnection
-	connected chan *Peer
+	connected chan *connection
+	broadcast chan *broadcast
+	capture   *os.File
+	recorder  *protocol.Recorder
+}
+
+// connection is the outcome of a connection attempt or, when closed is set,
+// the end of a successful one
+type connection struct {
+	*PeerConnection
+	peer   *Peer
+	err    error
+	closed bool
+}
+
+// broadcast is a message for every connected peer or, when relay is set,
+// for the peers which have not sent the item with the given hash. The number
+// of peers it was queued for is sent on sent if it is not nil.
+type broadcast struct {
+	msg   proto.Message
+	hash  data.Hash256
+	relay bool
+	sent  chan int
 }
 
 func NewManager(config *Config) (*Manager, error) {
@@ -34,15 +73,37 @@ func NewManager(config *Config) (*Manager, error) {
 		Status:    make(chan chan []byte),
 		Quit:      make(chan bool),
 		peers:     make(chan *PeerConnection, 10),
-		connected: make(chan *Peer, 10),
+		connected: make(chan *connection, 10),
+		broadcast: make(chan *broadcast),
+		Router:    NewHashRouter(routerHold),
+		Resources: NewResourceManager(),
+		Pow:       NewProofOfWorkPool(powWorkers),
+		Clock:     NewNetworkClock(),
 	}
 	var err error
 	mgr.PublicKey, err = crypto.NewRipplePublicNode(mgr.Key.PublicCompressed())
 	if err != nil {
 		return nil, err
 	}
+	if mgr.Bootcache, err = LoadBootcache(config.Bootcache); err != nil {
+		return nil, err
+	}
+	if mgr.Cluster, err = NewCluster(config.Cluster); err != nil {
+		return nil, err
+	}
+	if config.Capture != "" {
+		if mgr.capture, err = os.Create(config.Capture); err != nil {
+			return nil, err
+		}
+		if mgr.recorder, err = protocol.NewRecorder(mgr.capture); err != nil {
+			return nil, err
+		}
+	}
 	go mgr.run()
 	for _, address := range strings.Split(mgr.Trusted, ",") {
+		if address == "" {
+			continue
+		}
 		host, port, err := net.SplitHostPort(address)
 		if err != nil {
 			return nil, fmt.Errorf("Bad trusted peer: %s Part: %s", config.Trusted, address)
@@ -53,15 +114,22 @@ func NewManager(config *Config) (*Manager, error) {
 }
 
 func (m *Manager) run() {
-	seen := make(map[string]struct{})
-	peers := make([]*Peer, 0)
+	l := newLifecycle(m.MaxPeers, m.MaxInbound, m.Bootcache)
+	for _, e := range m.Bootcache.Endpoints() {
+		l.add(&PeerConnection{Host: e.Host, Port: e.Port})
+	}
+	tick := time.NewTicker(lifecycleInterval)
+	defer tick.Stop()
 	go Listen(m, m.Port)
 	for {
 		select {
 		case c := <-m.Status:
-			var dump []*Dump
-			for _, peer := range peers {
-				dump = append(dump, peer.GetDump())
+			dump := l.dump()
+			for _, d := range dump {
+				d.Balance, d.Charges = m.Resources.Balance(d.Host)
+				if d.State.InCluster() {
+					d.Cluster = m.Cluster.Get(d.State.Key())
+				}
 			}
 			out, err := json.MarshalIndent(dump, "", "\t")
 			if err != nil {
@@ -71,31 +139,171 @@ func (m *Manager) run() {
 				c <- out
 			}
 		case c := <-m.peers:
-			if _, ok := seen[c.String()]; !ok {
-				seen[c.String()] = struct{}{}
-				if len(peers) < m.MaxPeers {
-					go m.connectPeer(c)
+			if !c.Inbound {
+				if !c.Trusted {
+					m.Bootcache.Seen(c)
 				}
+				l.add(c)
+				m.dial(l)
+				break
+			}
+			if m.Resources.Banned(c.Host) || m.Resources.Charge(c.Host, feeNewConnection, 1) == Drop {
+				glog.Infof("Peer Manager: Inbound host banned: %s", c.String())
+				c.Conn.Close()
+				break
+			}
+			if !l.accept() {
+				glog.Infof("Peer Manager: Inbound slots full: %s", c.String())
+				c.Conn.Close()
+				break
 			}
-		case peer := <-m.connected:
-			peers = append(peers, peer)
+			go m.connectPeer(c)
+		case b := <-m.broadcast:
+			var sent int
+			peers := l.active()
+			if b.relay {
+				peers = m.Router.Relay(b.hash, peers)
+			}
+			for _, peer := range peers {
+				select {
+				case peer.Outgoing <- b.msg:
+					sent++
+				default:
+					glog.Infof("Peer Manager: Broadcast dropped: %s", peer.String())
+				}
+			}
+			if b.sent != nil {
+				b.sent <- sent
+			}
+		case c := <-m.connected:
+			if c.closed {
+				l.closed(c.PeerConnection, c.peer, time.Now())
+			} else {
+				l.connected(c.PeerConnection, c.peer, c.err, time.Now())
+			}
+			m.dial(l)
+		case <-tick.C:
+			for _, peer := range l.evict(time.Now()) {
+				glog.Infof("Peer Manager: Evicting: %s", peer.String())
+				peer.UpdateStatus(Evicted)
+				peer.Close()
+			}
+			m.dial(l)
+			m.saveBootcache()
+			m.reportCluster(l.active())
+			glog.V(1).Infoln("Peer Manager: Router:", m.Router.Stats())
+			glog.V(1).Infoln("Peer Manager: Proof of work:", m.Pow.Stats())
 		case <-m.Quit:
+			m.saveBootcache()
+			if m.capture != nil {
+				m.capture.Close()
+			}
 			return
 		}
 	}
 }
 
+// reportCluster sends our load and the balances of heavy hosts to the
+// connected cluster members. The load is the number of active peers.
+func (m *Manager) reportCluster(active []*Peer) {
+	if m.Cluster.Size() == 0 {
+		return
+	}
+	self := &ClusterMember{
+		PublicKey:  m.PublicKey.String(),
+		Name:       m.Name,
+		Load:       uint32(len(active)),
+		ReportTime: *data.Now(),
+	}
+	m.Cluster.Update([]*protocol.TMClusterNode{newClusterNode(self)})
+	msg := m.Cluster.Message(self, m.Resources.Export())
+	for _, peer := range active {
+		if !peer.InCluster() {
+			continue
+		}
+		select {
+		case peer.Outgoing <- msg:
+		default:
+			glog.Infof("Peer Manager: Cluster report dropped: %s", peer.String())
+		}
+	}
+	glog.V(1).Infof("Peer Manager: Cluster load: %d", m.Cluster.Load())
+}
+
+func (m *Manager) saveBootcache() {
+	if err := m.Bootcache.Save(); err != nil {
+		glog.Errorln("Peer Manager: Bootcache:", err.Error())
+	}
+}
+
+func (m *Manager) dial(l *lifecycle) {
+	now := time.Now()
+	for _, e := range l.dial(now) {
+		if !e.Trusted && m.Resources.Banned(e.Host) {
+			l.connected(e.PeerConnection, nil, fmt.Errorf("Banned: %s", e.Host), now)
+			continue
+		}
+		go m.connectPeer(e.PeerConnection)
+	}
+}
+
 func (m *Manager) connectPeer(c *PeerConnection) {
 	glog.Infof("Peer Manager: New Peer: %s ", c.String())
 	peer, err := NewPeer(c, m.Sync)
-	if err == nil {
-		go peer.handle(m)
-		glog.Infof("Peer Manager: New Peer: %s successful connection", c.String())
-	} else {
+	if err == nil && !m.LegacyHandshake {
+		err = peer.upgrade(m)
+	}
+	if err != nil {
 		glog.Infof("Peer Manager: New Peer Error: %s", err.Error())
 		peer.UpdateStatus(Disconnected)
+		peer.Close()
+		m.connected <- &connection{PeerConnection: c, peer: peer, err: err}
+		return
+	}
+	glog.Infof("Peer Manager: New Peer: %s successful connection", c.String())
+	peer.Conn.recorder, peer.Conn.label = m.recorder, peer.captureName
+	peer.resources = m.Resources
+	m.connected <- &connection{PeerConnection: c, peer: peer}
+	peer.handle(m)
+	m.connected <- &connection{PeerConnection: c, peer: peer, closed: true}
+}
+
+// Broadcast relays a signed transaction to every connected peer and tracks
+// whether it is included in a validated ledger. It returns the number of
+// peers the transaction was sent to.
+func (m *Manager) Broadcast(tx data.Transaction) (int, error) {
+	if _, err := m.Sync.Track(tx); err != nil {
+		return 0, err
+	}
+	// Copies relayed back by peers are then suppressed by the router
+	msg := protocol.NewTransaction(tx.Raw())
+	hash, _ := routerHash(msg)
+	m.Router.Add(hash, nil)
+	b := &broadcast{
+		msg:   msg,
+		hash:  hash,
+		relay: true,
+		sent:  make(chan int, 1),
+	}
+	m.broadcast <- b
+	sent := <-b.sent
+	if sent == 0 {
+		return 0, fmt.Errorf("No connected peers for: %s", tx.Hash().String())
+	}
+	return sent, nil
+}
+
+// relay forwards a verified item to the peers which have not sent it. A
+// manager without a broadcast channel, such as that of a replay, relays
+// nothing.
+func (m *Manager) relay(msg proto.Message) {
+	if hash, ok := routerHash(msg); ok && m.broadcast != nil {
+		m.broadcast <- &broadcast{
+			msg:   msg,
+			hash:  hash,
+			relay: true,
+		}
 	}
-	m.connected <- peer
 }
 
 func (m *Manager) AddPeer(host, port string, trusted bool, conn net.Conn) {
@@ -103,6 +311,7 @@ func (m *Manager) AddPeer(host, port string, trusted bool, conn net.Conn) {
 		Host:    host,
 		Port:    port,
 		Trusted: trusted,
+		Inbound: conn != nil,
 		Conn:    conn,
 	}
 }
@@ -0,0 +1,150 @@
+package peers
+
+import (
+	"github.com/donovanhide/ripple/data"
+	"github.com/donovanhide/ripple/peers/protocol"
+	internal "github.com/donovanhide/ripple/testing"
+	"github.com/donovanhide/ripple/testing/fixtures"
+	"testing"
+	"time"
+)
+
+func isValidation(msg protocol.ExtendedMessage) bool {
+	_, ok := msg.(*protocol.TMValidation)
+	return ok
+}
+
+func isGetLedger(msg protocol.ExtendedMessage) bool {
+	_, ok := msg.(*protocol.TMGetLedger)
+	return ok
+}
+
+// simSequence is above the first ledger of the history, which is where the
+// MemoryDB starts backfilling
+const simSequence = 32600
+
+// newSimLedgers returns a sync holding two ledgers. The last ledger of a
+// peer's range is the one being built, so only the first is backfilled.
+func newSimLedgers(t *testing.T) (*simSync, *data.Ledger) {
+	sync := newSimSync()
+	for seq := uint32(simSequence); seq <= simSequence+1; seq++ {
+		fixture := fixtures.NewLedger(t, seq)
+		sync.add(t, fixture.Ledger, fixture.Nodes()...)
+	}
+	ledger, err := sync.db.Get(sync.hashes[simSequence])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sync, ledger.(*data.Ledger)
+}
+
+// validateSimLedgers sends validations by the trusted validator of the
+// ledgers of sync until the first is final, so that its header can be
+// verified
+func (n *simNetwork) validateSimLedgers(t *testing.T, peer *simPeer, sync *simSync) {
+	for seq := uint32(simSequence); seq <= simSequence+3; seq++ {
+		hash, ok := sync.hashes[seq]
+		if !ok {
+			hash = data.Hash256{byte(seq)}
+		}
+		peer.send(simValidation(t, n.validator, seq, hash))
+	}
+}
+
+func TestSimulatedBackfill(t *testing.T) {
+	t.Parallel()
+	sync, ledger := newSimLedgers(t)
+	peer := newSimPeer(t, sync, simBehaviour{delay: 50 * time.Millisecond})
+	n := newSimNetwork(t, true, peer)
+	defer n.Close()
+	n.validateSimLedgers(t, peer, sync)
+	waitFor(t, 30*time.Second, "backfill", func() bool {
+		hash, ok := n.ledgers.LedgerHash(simSequence)
+		return ok && hash == ledger.Hash()
+	})
+	if first, last := n.ledgers.Range(); first != simSequence || last != simSequence {
+		t.Fatalf("Wrong range: %d-%d", first, last)
+	}
+}
+
+func TestSimulatedCorruptData(t *testing.T) {
+	t.Parallel()
+	sync, _ := newSimLedgers(t)
+	peer := newSimPeer(t, sync, simBehaviour{corrupt: true})
+	n := newSimNetwork(t, false, peer)
+	defer n.Close()
+	n.validateSimLedgers(t, peer, sync)
+	waitFor(t, 30*time.Second, "charge", func() bool {
+		balance, _ := n.Resources.Balance("127.0.0.1")
+		return balance > 0
+	})
+	if _, ok := n.ledgers.LedgerHash(simSequence); ok {
+		t.Fatal("Corrupt ledger accepted")
+	}
+}
+
+func TestSimulatedValidationRelay(t *testing.T) {
+	t.Parallel()
+	ledger := fixtures.NewLedger(t, 10).Ledger
+	from, to := newSimPeer(t, newSimSync(), simBehaviour{}), newSimPeer(t, newSimSync(), simBehaviour{})
+	n := newSimNetwork(t, true, from, to)
+	defer n.Close()
+	waitFor(t, 10*time.Second, "connections", func() bool {
+		return n.verified(t) == 2
+	})
+	validation := simValidation(t, newTestKey(t), 10, ledger.Hash())
+	from.send(validation)
+	from.send(validation)
+	waitFor(t, 10*time.Second, "relay", func() bool {
+		return len(to.receivedMatching(isValidation)) > 0
+	})
+	time.Sleep(100 * time.Millisecond)
+	if relayed := to.receivedMatching(isValidation); len(relayed) != 1 {
+		t.Fatalf("Validation relayed %d times", len(relayed))
+	}
+	if echoed := from.receivedMatching(isValidation); len(echoed) != 0 {
+		t.Fatal("Validation relayed to its sender")
+	}
+}
+
+func TestSimulatedMisbehaving(t *testing.T) {
+	t.Parallel()
+	ledger := fixtures.NewLedger(t, 10).Ledger
+	peer := newSimPeer(t, newSimSync(), simBehaviour{})
+	n := newSimNetwork(t, false, peer)
+	defer n.Close()
+	key := newTestKey(t)
+	for seq := uint32(1); seq <= 10; seq++ {
+		validation := simValidation(t, key, seq, ledger.Hash())
+		validation.Validation[len(validation.Validation)-1] ^= 0xFF
+		peer.send(validation)
+	}
+	waitFor(t, 10*time.Second, "ban", func() bool {
+		return n.Resources.Banned("127.0.0.1")
+	})
+	select {
+	case <-peer.closed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Misbehaving peer not disconnected")
+	}
+}
+
+// A peer which never answers requests leaves the ledger unacquired, but the
+// requests are still made
+func TestSimulatedDroppedRequests(t *testing.T) {
+	if !*internal.RunSlow {
+		t.Skip("slow")
+	}
+	t.Parallel()
+	sync, _ := newSimLedgers(t)
+	peer := newSimPeer(t, sync, simBehaviour{drop: isGetLedger})
+	n := newSimNetwork(t, true, peer)
+	defer n.Close()
+	waitFor(t, 30*time.Second, "request", func() bool {
+		return len(peer.receivedMatching(isGetLedger)) > 0
+	})
+	time.Sleep(time.Second)
+	if _, ok := n.ledgers.LedgerHash(simSequence); ok {
+		t.Fatal("Ledger acquired without answers")
+	}
+}
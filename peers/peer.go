@@ -3,6 +3,7 @@ package peers
 import (
 	"bytes"
 	"code.google.com/p/goprotobuf/proto"
+	"fmt"
 	"github.com/donovanhide/ripple/crypto"
 	"github.com/donovanhide/ripple/data"
 	"github.com/donovanhide/ripple/ledger"
@@ -19,11 +20,17 @@ const (
 )
 
 type Dump struct {
-	Host     string
-	Port     string
-	Resolved string
-	State    *PeerState
-	Stats    *PeerStats
+	Host        string
+	Port        string
+	Resolved    string
+	Inbound     bool
+	Failures    int
+	NextAttempt time.Time
+	Balance     float64
+	Charges     map[string]uint64
+	Cluster     *ClusterMember `json:",omitempty"`
+	State       *PeerState
+	Stats       *PeerStats
 }
 
 type Peer struct {
@@ -33,19 +40,60 @@ type Peer struct {
 	Outgoing    chan proto.Message
 	synchronous chan proto.Message
 	sync        ledger.Sync
+	closed      chan struct{}
+	resources   *ResourceManager
+	challenged  sync.Once
 }
 
 func NewPeer(c *PeerConnection, sync ledger.Sync) (*Peer, error) {
-	peer := &Peer{
+	peer := newPeer(c, sync)
+	var err error
+	peer.Conn, err = NewConn(c)
+	return peer, err
+}
+
+func newPeer(c *PeerConnection, sync ledger.Sync) *Peer {
+	return &Peer{
 		PeerState:   NewPeerState(c),
 		PeerStats:   NewPeerStats(),
 		Outgoing:    make(chan proto.Message, 10),
 		synchronous: make(chan proto.Message, 100),
 		sync:        sync,
+		closed:      make(chan struct{}),
 	}
-	var err error
-	peer.Conn, err = NewConn(c)
-	return peer, err
+}
+
+// captureName identifies the peer in captures by its node public key, or by
+// its address until the handshake is complete
+func (p *Peer) captureName() string {
+	if key := p.Key(); key != nil {
+		return key.String()
+	}
+	return p.Conn.String()
+}
+
+// reply queues a message for the peer unless it has disconnected, so that
+// goroutines answering the peer never block once serve has returned
+func (p *Peer) reply(msg proto.Message) {
+	select {
+	case p.Outgoing <- msg:
+	case <-p.closed:
+	}
+}
+
+func (p *Peer) upgrade(m *Manager) error {
+	handshake, err := p.Conn.upgrade(m)
+	if err != nil {
+		p.UpdateStatus(HelloFailed)
+		p.Conn.conn.Close()
+		return fmt.Errorf("Handshake: %s", err.Error())
+	}
+	p.ProcessHandshake(handshake)
+	p.JoinCluster(m.Cluster)
+	if m.Clock != nil {
+		m.Clock.Add(handshake.PublicKey, handshake.NetworkTime, !p.Inbound || p.InCluster())
+	}
+	return nil
 }
 
 func (p *Peer) GetDump() *Dump {
@@ -53,74 +101,151 @@ func (p *Peer) GetDump() *Dump {
 		Host:     p.Host,
 		Port:     p.Port,
 		Resolved: p.Resolved,
+		Inbound:  p.Inbound,
 		State:    p.PeerState,
 		Stats:    p.PeerStats,
 	}
 }
 
+// charge bills the host of the peer for count times fee and drops the
+// connection once past the limit. Trusted peers are never dropped and
+// cluster members are never charged.
+func (p *Peer) charge(fee Fee, count int) {
+	if p.resources == nil || count == 0 || p.InCluster() {
+		return
+	}
+	switch p.resources.Charge(p.Host, fee, count) {
+	case Warn:
+		glog.V(1).Infof("%s:Resource warning: %s", p.String(), fee.Name)
+	case Drop:
+		if p.Trusted {
+			glog.Warningf("%s:Resource limit for trusted peer: %s", p.String(), fee.Name)
+			return
+		}
+		glog.Errorf("%s:Resource limit: %s", p.String(), fee.Name)
+		p.UpdateStatus(Banned)
+		p.Close()
+	}
+}
+
+// Close drops the connection, which ends the handling of the peer
+func (p *Peer) Close() {
+	if p.Conn != nil && p.Conn.conn != nil {
+		p.Conn.conn.Close()
+	}
+}
+
 func (p *Peer) handle(m *Manager) {
-	var ready sync.Once
 	incoming := make(chan protocol.ExtendedMessage, 10)
 	outgoing := make(chan proto.Message, 10)
+	go p.Conn.run(incoming, outgoing)
+	p.serve(m, incoming, outgoing)
+}
+
+// serve handles incoming messages and sends replies and requests to
+// outgoing until incoming is closed
+func (p *Peer) serve(m *Manager, incoming chan protocol.ExtendedMessage, outgoing chan proto.Message) {
+	var ready sync.Once
 	deadline := time.NewTimer(time.Second * 5)
 	ping := time.NewTicker(time.Second * 30)
-	go p.Conn.run(incoming, outgoing)
+	announce := time.NewTicker(time.Minute)
+	var announced [2]uint32
+	// idle is the synchronous queue while no request is in flight, so that
+	// requests queued after the last reply are not held until the deadline
+	var idle chan proto.Message
 	for {
 		select {
 		case <-ping.C:
 			outgoing <- protocol.NewPing()
+		case <-announce.C:
+			if first, last := p.sync.Range(); last > 0 && announced != [2]uint32{first, last} {
+				announced = [2]uint32{first, last}
+				outgoing <- protocol.NewStatusChange(first, last)
+			}
 		case <-deadline.C:
 			next := p.takeSynchronous()
 			if next != nil {
 				p.Send(next)
 				outgoing <- next
+				idle = nil
+			} else {
+				idle = p.synchronous
 			}
 			glog.Errorf("%s:Deadline hit", p.String())
 			deadline.Reset(time.Minute * 2)
+		case next := <-idle:
+			idle = nil
+			p.Send(next)
+			outgoing <- next
+			deadline.Reset(time.Minute * 2)
 		case out := <-p.Outgoing:
 			p.Send(out)
 			outgoing <- out
 		case in, ok := <-incoming:
 			if !ok {
 				p.UpdateStatus(Disconnected)
+				close(p.closed)
+				close(outgoing)
+				ping.Stop()
+				announce.Stop()
 				return
 			}
-			if p.Receive(in) != PassThrough {
+			status := p.Receive(in)
+			if status == Unexpected {
+				p.charge(feeUnwantedData, 1)
+			}
+			if status != PassThrough {
 				next := p.takeSynchronous()
 				if next != nil {
 					p.Send(next)
 					outgoing <- next
+					idle = nil
+				} else {
+					idle = p.synchronous
 				}
 				deadline.Reset(time.Minute * 2)
 			}
 			glog.V(2).Infof("%s:%s", p.String(), in.Log())
+			if hash, ok := routerHash(in); ok && m.Router.Duplicate(hash, p) {
+				continue
+			}
 			switch msg := in.(type) {
 			case *protocol.TMEndpoints:
 				p.handleEndpoints(m, msg)
 			case *protocol.Hello:
 				p.handleHello(m, msg)
+			case *protocol.TMCluster:
+				p.handleCluster(m, msg)
 			case *protocol.TMProofWork:
-				go p.handleProofOfWork(msg)
+				go p.handleProofOfWork(m, msg)
 			case *protocol.TMStatusChange:
 				p.handleStatusChange(msg)
 				ready.Do(func() {
 					go p.fillQueue()
 				})
 			case *protocol.TMProposeSet:
-				go p.handleProposeSet(msg)
+				go p.handleProposeSet(m, msg)
+			case *protocol.TMHaveTransactionSet:
+				go p.handleHaveTransactionSet(msg)
 			case *protocol.TMValidation:
-				go p.handleValidation(msg)
+				go p.handleValidation(m, msg)
 			case *protocol.TMTransaction:
-				go p.handleTransaction(msg)
+				go p.handleTransaction(m, msg)
 			case *protocol.TMLedgerData:
 				go p.handleLedgerData(msg)
+			case *protocol.TMGetLedger:
+				go p.handleGetLedger(msg)
 			case *protocol.TMGetObjectByHash:
-				if !msg.GetQuery() {
+				if msg.GetQuery() {
+					go p.handleGetObjectByHash(msg)
+				} else {
 					go p.handleGetObjectByHashReply(msg)
 				}
 			case *protocol.Ping:
 				if msg.IsPing {
-					p.Outgoing <- protocol.NewPong()
+					pong := protocol.NewPong()
+					p.Send(pong)
+					outgoing <- pong
 				}
 			}
 		}
@@ -145,13 +270,33 @@ func (p *Peer) fillQueue() {
 			Max:   20,
 		}
 		work := p.sync.Missing(r)
-		glog.V(1).Infof("%s:Queueing %d-%d %+v", p.String(), start, end, work.MissingLedgers)
-		if len(work.MissingLedgers) < 2 {
-			time.Sleep(5 * time.Second)
+		if len(work.MissingLedgers) == 0 && len(work.Requests) == 0 {
+			select {
+			case <-p.closed:
+				return
+			case <-time.After(time.Second):
+			}
 			continue
 		}
+		glog.V(1).Infof("%s:Queueing %d-%d %+v Requests: %d", p.String(), start, end, work.MissingLedgers, len(work.Requests))
+		var queue []proto.Message
 		for _, ledger := range work.MissingLedgers {
-			p.synchronous <- protocol.NewGetLedger(ledger)
+			queue = append(queue, protocol.NewGetLedger(ledger))
+		}
+		for _, request := range work.Requests {
+			if len(request.Ids) > 0 {
+				queue = append(queue, protocol.NewGetLedgerNodes(request))
+			}
+			if len(request.Hashes) > 0 {
+				queue = append(queue, protocol.NewGetObjectsByHash(request))
+			}
+		}
+		for _, msg := range queue {
+			select {
+			case p.synchronous <- msg:
+			case <-p.closed:
+				return
+			}
 		}
 	}
 }
@@ -190,8 +335,12 @@ func (p *Peer) handleHello(m *Manager, hello *protocol.Hello) {
 		glog.Errorf("%s:%s", p.String(), err.Error())
 		return
 	}
+	p.JoinCluster(m.Cluster)
+	if m.Clock != nil {
+		m.Clock.Add(p.Key(), uint32(hello.GetNetTime()), !p.Inbound || p.InCluster())
+	}
 	port, _ := strconv.ParseUint(m.Port, 10, 32)
-	p.Outgoing <- &protocol.TMHello{
+	reply := &protocol.TMHello{
 		FullVersion:     proto.String(m.Name),
 		ProtoVersion:    proto.Uint32(MAJOR_VERSION),
 		ProtoVersionMin: proto.Uint32(MINOR_VERSION),
@@ -202,41 +351,205 @@ func (p *Peer) handleHello(m *Manager, hello *protocol.Hello) {
 		NodePrivate:     proto.Bool(true),
 		TestNet:         proto.Bool(false),
 	}
+	if m.Challenge && m.Pow != nil && p.Inbound {
+		if reply.ProofOfWork, err = m.Pow.Issue(); err != nil {
+			glog.Errorf("%s:Proof of work challenge: %s", p.String(), err.Error())
+		}
+	}
+	p.reply(reply)
 	if hello.ProofOfWork != nil {
-		go p.handleProofOfWork(hello.ProofOfWork)
+		p.challenged.Do(func() {
+			go p.solveProofOfWork(m, hello.ProofOfWork)
+		})
 	}
 }
 
-func (p *Peer) handleProposeSet(proposeSet *protocol.TMProposeSet) {
+// solveProofOfWork solves the challenge in the peer's hello. A peer only
+// gets one challenge solved per connection.
+func (p *Peer) solveProofOfWork(m *Manager, pow *protocol.TMProofWork) {
+	if m.Pow == nil || pow.Challenge == nil {
+		return
+	}
+	if err := m.Pow.TooHard(pow); err != nil {
+		glog.Errorf("%s:Proof of work %s: %s", p.String(), pow.GetToken(), err.Error())
+		p.charge(feeInvalidData, 1)
+		return
+	}
+	if !m.Pow.Solve(pow, p.Outgoing, p.closed) {
+		glog.Errorf("%s:Proof of work queue full", p.String())
+	}
+}
+
+func (p *Peer) handleProposeSet(m *Manager, proposeSet *protocol.TMProposeSet) {
+	proposal := &data.Proposal{
+		Sequence:  proposeSet.GetProposeSeq(),
+		CloseTime: proposeSet.GetCloseTime(),
+		Signature: data.VariableLength(proposeSet.GetSignature()),
+	}
+	copy(proposal.LedgerHash[:], proposeSet.GetCurrentTxHash())
+	copy(proposal.PreviousLedger[:], proposeSet.GetPreviousledger())
+	copy(proposal.PublicKey[:], proposeSet.GetNodePubKey())
+	ok, err := data.CheckSignature(proposal)
+	if err != nil {
+		glog.Errorf("%s:Bad proposal signature verification: %s", p.String(), err.Error())
+		p.charge(feeInvalidSignature, 1)
+		return
+	}
+	if !ok {
+		glog.Errorf("%s:Bad proposal signature: %X public key: %X", p.String(), proposeSet.GetSignature(), proposeSet.GetNodePubKey())
+		p.charge(feeInvalidSignature, 1)
+		return
+	}
+	if !p.verified(m, proposeSet) {
+		return
+	}
+	p.sync.Submit([]data.Hashable{proposal})
+	p.requestTxSet(proposal.LedgerHash, nil)
+	m.relay(proposeSet)
+}
 
+// verified adds an item whose signature has been checked to the router and
+// returns false if another copy was added first
+func (p *Peer) verified(m *Manager, msg proto.Message) bool {
+	hash, ok := routerHash(msg)
+	return !ok || m.Router.Add(hash, p)
 }
 
-func (p *Peer) handleValidation(validation *protocol.TMValidation) {
+func (p *Peer) handleHaveTransactionSet(have *protocol.TMHaveTransactionSet) {
+	if have.GetStatus() != protocol.TxSetStatus_tsHAVE {
+		return
+	}
+	hash, err := data.NewHash256(have.GetHash())
+	if err != nil {
+		glog.Errorf("%s:%s", p.String(), err.Error())
+		return
+	}
+	p.requestTxSet(*hash, nil)
+}
+
+// requestTxSet adds any received nodes to the candidate transaction set and
+// asks this peer for the nodes that are still missing
+func (p *Peer) requestTxSet(hash data.Hash256, nodes []data.Hashable) {
+	if missing := p.sync.AcquireTxSet(hash, nodes); len(missing) > 0 {
+		p.reply(protocol.NewGetTransactionSet(hash, missing))
+	}
+}
+
+func (p *Peer) handleTxSetData(ledgerData *protocol.TMLedgerData) {
+	hash, err := data.NewHash256(ledgerData.GetLedgerHash())
+	if err != nil {
+		glog.Errorf("%s:%s", p.String(), err.Error())
+		return
+	}
+	var nodes []data.Hashable
+	for _, n := range ledgerData.GetNodes() {
+		node, err := data.NewNodeFromWire(n.GetNodedata(), data.NT_TRANSACTION_NODE, 0)
+		if err != nil {
+			glog.Errorf("%s:Transaction set %s: %s", p.String(), hash.String(), err.Error())
+			p.charge(feeUndecodable, 1)
+			continue
+		}
+		nodes = append(nodes, node)
+	}
+	p.requestTxSet(*hash, nodes)
+}
+
+func (p *Peer) handleValidation(m *Manager, validation *protocol.TMValidation) {
 	glog.Infof("%X", validation.GetValidation())
 	v, err := data.NewDecoder(bytes.NewReader(validation.GetValidation())).Validation()
 	if err != nil {
 		glog.Errorln(err.Error())
+		p.charge(feeUndecodable, 1)
+		return
+	}
+	ok, err := data.CheckSignature(v)
+	if err != nil {
+		glog.Errorf("%s:Bad validation signature verification: %s", p.String(), err.Error())
+		p.charge(feeInvalidSignature, 1)
+		return
+	}
+	if !ok {
+		glog.Errorf("%s:Bad validation signature: %s", p.String(), v.SigningPubKey.String())
+		p.charge(feeInvalidSignature, 1)
+		return
+	}
+	if !p.verified(m, validation) {
 		return
 	}
 	p.sync.Submit([]data.Hashable{v})
+	m.relay(validation)
 }
 
-func (p *Peer) handleTransaction(tx *protocol.TMTransaction) {
+func (p *Peer) handleTransaction(m *Manager, tx *protocol.TMTransaction) {
 	node, err := data.NewDecoder(bytes.NewReader(tx.GetRawTransaction())).Transaction()
 	if err != nil {
 		glog.Errorln(err.Error())
+		p.charge(feeUndecodable, 1)
+		return
+	}
+	// Checking the signature replaces the hash with the signing hash, so a
+	// separate copy is checked
+	signed, err := data.NewDecoder(bytes.NewReader(tx.GetRawTransaction())).Transaction()
+	if err != nil {
+		glog.Errorln(err.Error())
+		return
+	}
+	ok, err := data.CheckSignature(signed)
+	if err != nil || !ok {
+		glog.Errorf("%s:Bad transaction signature: %s", p.String(), node.Hash().String())
+		p.charge(feeInvalidSignature, 1)
+		return
+	}
+	if !p.verified(m, tx) {
 		return
 	}
 	p.sync.Submit([]data.Hashable{node})
+	m.relay(tx)
+}
+
+// handleProofOfWork verifies the peer's responses to our challenges and logs
+// the results of our responses. Challenges outside the hello are refused.
+func (p *Peer) handleProofOfWork(m *Manager, pow *protocol.TMProofWork) {
+	if m.Pow == nil {
+		return
+	}
+	switch {
+	case pow.Challenge != nil:
+		glog.Errorf("%s:Unsolicited proof of work challenge %s", p.String(), pow.GetToken())
+		p.charge(feeUnwantedData, 1)
+	case pow.Response != nil:
+		result := m.Pow.Verify(pow.GetToken(), pow.GetResponse())
+		if result != protocol.TMProofWork_powrOK {
+			glog.Errorf("%s:Proof of work %s: %s", p.String(), pow.GetToken(), result)
+			p.charge(feeInvalidData, 1)
+		}
+		p.reply(&protocol.TMProofWork{
+			Token:  proto.String(pow.GetToken()),
+			Result: result.Enum(),
+		})
+	case pow.Result != nil:
+		if result := pow.GetResult(); result != protocol.TMProofWork_powrOK {
+			glog.Errorf("%s:Proof of work %s rejected: %s", p.String(), pow.GetToken(), result)
+		} else {
+			glog.V(1).Infof("%s:Proof of work %s accepted", p.String(), pow.GetToken())
+		}
+	}
 }
 
-func (p *Peer) handleProofOfWork(pow *protocol.TMProofWork) {
-	glog.Infoln("POW!!!", pow)
-	// work := crypto.NewProofOfWork(pow.Challenge, pow.Target, pow.GetIterations())
-	// proof, err := work.Solve()
-	// if err != nil {
-	// 	glog.Errorf("%s:%s", p.String(), err.Error())
-	// }
+// handleCluster records the reports and balances sent by a cluster member
+func (p *Peer) handleCluster(m *Manager, cluster *protocol.TMCluster) {
+	if m.Cluster == nil {
+		return
+	}
+	if !p.InCluster() {
+		glog.Errorf("%s:Cluster message from non-member", p.String())
+		p.charge(feeUnwantedData, 1)
+		return
+	}
+	m.Cluster.Update(cluster.GetClusterNodes())
+	if m.Resources != nil {
+		m.Resources.Import(p.Key().String(), clusterBalances(cluster))
+	}
 }
 
 func (p *Peer) handleStatusChange(state *protocol.TMStatusChange) {
@@ -251,57 +564,90 @@ func (p *Peer) handleGetObjectByHashReply(reply *protocol.TMGetObjectByHash) {
 		typ = data.NT_TRANSACTION_NODE
 	}
 	for _, obj := range reply.GetObjects() {
-		blob := append(obj.GetData(), obj.GetHash()...)
-		node, err := data.NewDecoder(bytes.NewReader(blob)).Wire(typ)
+		node, err := data.NewNodeFromPrefix(obj.GetData(), typ, reply.GetSeq())
 		if err != nil {
-			glog.Errorf("%s: %s Ledger: %d Blob: %X", p.String(), err.Error(), reply.GetSeq(), blob)
-			return
+			glog.Errorf("%s: %s Ledger: %d Data: %X", p.String(), err.Error(), reply.GetSeq(), obj.GetData())
+			p.charge(feeUndecodable, 1)
+			continue
+		}
+		if !bytes.Equal(node.Hash().Bytes(), obj.GetHash()) {
+			glog.Errorf("%s:Bad object hash: %X expected: %X", p.String(), node.Hash().Bytes(), obj.GetHash())
+			p.charge(feeInvalidData, 1)
+			continue
 		}
-		glog.Infoln(node)
 		nodes = append(nodes, node)
-		// if tx, ok := node.Value.(data.Transaction); ok {
-		// 	tx.SetLedgerSequence(reply.GetSeq())
-		// 	var hash data.Hash256
-		// 	copy(hash[:], obj.GetData()[len(obj.GetData())-32:])
-		// 	tx.SetHash(&hash)
-		// 	l.Incoming <- tx
-		// }
-		// if node.InnerNode != nil {
-		// 	nodes = append(nodes, node.InnerNode)
-		// }
 	}
 	p.sync.Submit(nodes)
-	// if len(nodes) > 0 {
-	// 	p.synchronous <- protocol.NewGetObjects(reply.GetSeq(), nodes)
-	// }
 }
 
 func (p *Peer) handleLedgerData(ledgerData *protocol.TMLedgerData) {
-	//msg.AverageLatency = ((msg.AverageLatency * Latency(msg.Successful)) + Latency(m.Time.Sub(msg.Inflight[i].Sent))) / Latency(msg.Successful+1)
-	if ledgerData.GetType() != protocol.TMLedgerInfoType_liBASE {
-		glog.Infof("%s: Ignoring: %s", ledgerData.Log())
+	if ledgerData.Error != nil {
+		glog.V(1).Infof("%s:Ledger data: %s", p.String(), ledgerData.Log())
 		return
 	}
-	ledger, err := data.NewDecoder(bytes.NewReader(ledgerData.Nodes[0].Nodedata)).Ledger()
+	switch ledgerData.GetType() {
+	case protocol.TMLedgerInfoType_liBASE:
+		p.handleLedgerHeader(ledgerData)
+	case protocol.TMLedgerInfoType_liAS_NODE:
+		p.handleLedgerNodes(ledgerData, data.NT_ACCOUNT_NODE)
+	case protocol.TMLedgerInfoType_liTX_NODE:
+		p.handleLedgerNodes(ledgerData, data.NT_TRANSACTION_NODE)
+	case protocol.TMLedgerInfoType_liTS_CANDIDATE:
+		p.handleTxSetData(ledgerData)
+	default:
+		glog.Infof("%s: Ignoring: %s", p.String(), ledgerData.Log())
+	}
+}
+
+// handleLedgerHeader checks the hash of the header and submits it along with
+// the roots of the state and transaction trees if they were included
+func (p *Peer) handleLedgerHeader(ledgerData *protocol.TMLedgerData) {
+	nodes := ledgerData.GetNodes()
+	if len(nodes) == 0 {
+		glog.Errorf("%s:Empty ledger header: %d", p.String(), ledgerData.GetLedgerSeq())
+		return
+	}
+	ledger, err := data.NewDecoder(bytes.NewReader(nodes[0].GetNodedata())).Ledger()
 	if err != nil {
 		glog.Errorf("%s: %s", p.String(), err.Error())
 		return
 	}
-	glog.Infoln(ledger)
-	p.sync.Submit([]data.Hashable{ledger})
-	// var hash data.Hash256
-	// copy(hash[:], ledgerData.GetLedgerHash())
-	// ledger.SetHash(&hash)
-	// l.Incoming <- ledger
-	// if ledger.TransactionHash.IsZero() {
-	// 	return
-	// }
-	// transactions, err := encoding.ParseUnknownInnerNode(ledgerData.Nodes[2].Nodedata)
-	// if err != nil {
-	// 	glog.Errorf("%s: %s", p.String(), err.Error())
-	// 	return
-	// }
-	// p.synchronous <- protocol.NewGetObjects(ledger.LedgerSequence, []*encoding.InnerNode{transactions})
+	if err := data.NewEncoder().Node(ledger); err != nil {
+		glog.Errorf("%s: %s", p.String(), err.Error())
+		return
+	}
+	if !bytes.Equal(ledger.Hash().Bytes(), ledgerData.GetLedgerHash()) {
+		glog.Errorf("%s:Bad ledger hash: %d %s expected: %X", p.String(), ledger.LedgerSequence, ledger.Hash().String(), ledgerData.GetLedgerHash())
+		p.charge(feeInvalidData, 1)
+		return
+	}
+	items := []data.Hashable{ledger}
+	for i, typ := range []data.NodeType{data.NT_ACCOUNT_NODE, data.NT_TRANSACTION_NODE} {
+		if len(nodes) < i+2 {
+			break
+		}
+		root, err := data.NewNodeFromWire(nodes[i+1].GetNodedata(), typ, ledger.LedgerSequence)
+		if err != nil {
+			glog.Errorf("%s:Ledger %d root: %s", p.String(), ledger.LedgerSequence, err.Error())
+			continue
+		}
+		items = append(items, root)
+	}
+	p.sync.Submit(items)
+}
+
+func (p *Peer) handleLedgerNodes(ledgerData *protocol.TMLedgerData, typ data.NodeType) {
+	var nodes []data.Hashable
+	for _, n := range ledgerData.GetNodes() {
+		node, err := data.NewNodeFromWire(n.GetNodedata(), typ, ledgerData.GetLedgerSeq())
+		if err != nil {
+			glog.Errorf("%s:Ledger %d: %s", p.String(), ledgerData.GetLedgerSeq(), err.Error())
+			p.charge(feeUndecodable, 1)
+			continue
+		}
+		nodes = append(nodes, node)
+	}
+	p.sync.Submit(nodes)
 }
 
 func (p *Peer) handleEndpoints(m *Manager, msg *protocol.TMEndpoints) {
@@ -0,0 +1,26 @@
+package peers
+
+import (
+	"github.com/donovanhide/ripple/peers/protocol"
+	"testing"
+	"time"
+)
+
+func TestPeerReplyAfterClose(t *testing.T) {
+	p := newPeer(&PeerConnection{Host: "127.0.0.1", Port: "51235"}, newSimSync())
+	for i := 0; i < cap(p.Outgoing); i++ {
+		p.reply(protocol.NewPong())
+	}
+	close(p.closed)
+	done := make(chan struct{})
+	go func() {
+		p.reply(protocol.NewPong())
+		p.handleGetLedger(&protocol.TMGetLedger{})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Reply blocked after the peer closed")
+	}
+}
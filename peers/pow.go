@@ -0,0 +1,253 @@
+package peers
+
+import (
+	"bytes"
+	"code.google.com/p/goprotobuf/proto"
+	"crypto/rand"
+	"fmt"
+	"github.com/donovanhide/ripple/crypto"
+	"github.com/donovanhide/ripple/peers/protocol"
+	"github.com/golang/glog"
+	metrics "github.com/rcrowley/go-metrics"
+	"runtime"
+	"sync"
+	"time"
+)
+
+const (
+	powWorkers       = 2
+	powQueue         = 10
+	powTimeout       = time.Minute
+	powExpiry        = 2 * time.Minute
+	powIterations    = 98304
+	powMaxIterations = 1 << 20
+	powParallel      = 2
+)
+
+var powTarget = []byte{
+	0x0C, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF,
+	0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF,
+}
+
+// powHardestTarget is the smallest target a peer may ask us to solve
+var powHardestTarget = []byte{
+	0x00, 0xCF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF,
+	0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF,
+}
+
+type PowStats struct {
+	Solved       uint64
+	Unsolved     uint64
+	Cancelled    uint64
+	Dropped      uint64
+	SolveTime    time.Duration
+	MaxSolveTime time.Duration
+	Issued       uint64
+	Accepted     uint64
+	Rejected     uint64
+}
+
+// powJob is a challenge from a peer. The response is sent on reply unless
+// closed is closed first.
+type powJob struct {
+	challenge *protocol.TMProofWork
+	reply     chan<- proto.Message
+	closed    <-chan struct{}
+}
+
+type powChallenge struct {
+	work    *crypto.ProofOfWork
+	expires time.Time
+	used    bool
+}
+
+// ProofOfWorkPool solves the challenges sent by peers on a fixed number of
+// workers, each of which searches in parallel. It also issues challenges to
+// inbound peers and verifies their responses.
+type ProofOfWorkPool struct {
+	iterations uint32
+	target     []byte
+	jobs       chan *powJob
+	challenges map[string]*powChallenge
+	stats      PowStats
+	mu         sync.Mutex
+}
+
+func NewProofOfWorkPool(workers int) *ProofOfWorkPool {
+	pool := &ProofOfWorkPool{
+		iterations: powIterations,
+		target:     powTarget,
+		jobs:       make(chan *powJob, powQueue),
+		challenges: make(map[string]*powChallenge),
+	}
+	for i := 0; i < workers; i++ {
+		go pool.work()
+	}
+	return pool
+}
+
+// TooHard returns an error if the challenge needs more iterations or a
+// smaller target than we are willing to solve
+func (pool *ProofOfWorkPool) TooHard(challenge *protocol.TMProofWork) error {
+	switch target := challenge.GetTarget(); {
+	case challenge.GetIterations() > powMaxIterations:
+		return fmt.Errorf("Too many iterations: %d", challenge.GetIterations())
+	case len(target) != len(powHardestTarget):
+		return fmt.Errorf("Bad target length: %d", len(target))
+	case bytes.Compare(target, powHardestTarget) < 0:
+		return fmt.Errorf("Target too hard: %X", target)
+	}
+	return nil
+}
+
+// Solve queues a challenge and returns false if the queue is full
+func (pool *ProofOfWorkPool) Solve(challenge *protocol.TMProofWork, reply chan<- proto.Message, closed <-chan struct{}) bool {
+	select {
+	case pool.jobs <- &powJob{challenge, reply, closed}:
+		return true
+	default:
+		pool.mu.Lock()
+		pool.stats.Dropped++
+		pool.mu.Unlock()
+		return false
+	}
+}
+
+func (pool *ProofOfWorkPool) work() {
+	for job := range pool.jobs {
+		pool.solve(job)
+	}
+}
+
+// solve gives up when the peer goes away or the timeout passes
+func (pool *ProofOfWorkPool) solve(job *powJob) {
+	work := crypto.NewProofOfWork(job.challenge.GetChallenge(), job.challenge.GetTarget(), job.challenge.GetIterations())
+	cancel, finished := make(chan struct{}), make(chan struct{})
+	go func() {
+		select {
+		case <-job.closed:
+		case <-time.After(powTimeout):
+		case <-finished:
+			return
+		}
+		close(cancel)
+	}()
+	start := time.Now()
+	workers := runtime.NumCPU()
+	if workers > powParallel {
+		workers = powParallel
+	}
+	nonce, err := work.SolveParallel(workers, cancel)
+	close(finished)
+	elapsed := time.Since(start)
+	pool.mu.Lock()
+	switch {
+	case err != nil:
+		pool.stats.Cancelled++
+	case nonce == nil:
+		pool.stats.Unsolved++
+	default:
+		pool.stats.Solved++
+		pool.stats.SolveTime += elapsed
+		if elapsed > pool.stats.MaxSolveTime {
+			pool.stats.MaxSolveTime = elapsed
+		}
+	}
+	pool.mu.Unlock()
+	if err != nil {
+		glog.V(1).Infof("Proof of work %s: %s", job.challenge.GetToken(), err.Error())
+		return
+	}
+	if nonce == nil {
+		glog.Errorf("Proof of work %s: No solution", job.challenge.GetToken())
+		return
+	}
+	metrics.GetOrRegisterTimer("ProofOfWork.Solve", nil).Update(elapsed)
+	response := &protocol.TMProofWork{
+		Token:    proto.String(job.challenge.GetToken()),
+		Response: nonce,
+	}
+	select {
+	case job.reply <- response:
+	case <-job.closed:
+	}
+}
+
+// Issue creates a new challenge which expires if not answered in time
+func (pool *ProofOfWorkPool) Issue() (*protocol.TMProofWork, error) {
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, err
+	}
+	token := fmt.Sprintf("%X", challenge)
+	now := time.Now()
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	for token, c := range pool.challenges {
+		if now.After(c.expires) {
+			delete(pool.challenges, token)
+		}
+	}
+	pool.challenges[token] = &powChallenge{
+		work:    crypto.NewProofOfWork(challenge, pool.target, pool.iterations),
+		expires: now.Add(powExpiry),
+	}
+	pool.stats.Issued++
+	return &protocol.TMProofWork{
+		Token:      proto.String(token),
+		Iterations: proto.Uint32(pool.iterations),
+		Target:     pool.target,
+		Challenge:  challenge,
+	}, nil
+}
+
+// Verify checks the response to an issued challenge. Each challenge can only
+// be answered once, whether or not the answer is correct.
+func (pool *ProofOfWorkPool) Verify(token string, response []byte) protocol.TMProofWork_PowResult {
+	pool.mu.Lock()
+	c, ok := pool.challenges[token]
+	var used bool
+	if ok {
+		used, c.used = c.used, true
+	}
+	pool.mu.Unlock()
+	result := protocol.TMProofWork_powrOK
+	switch {
+	case !ok:
+		result = protocol.TMProofWork_powrINVALID
+	case used:
+		result = protocol.TMProofWork_powrREUSED
+	case time.Now().After(c.expires):
+		result = protocol.TMProofWork_powrEXPIRED
+	default:
+		if solved, err := c.work.Check(response); err != nil || !solved {
+			result = protocol.TMProofWork_powrINVALID
+		}
+	}
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if result == protocol.TMProofWork_powrOK {
+		pool.stats.Accepted++
+	} else {
+		pool.stats.Rejected++
+	}
+	return result
+}
+
+func (pool *ProofOfWorkPool) Stats() PowStats {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	return pool.stats
+}
+
+func (s PowStats) AverageSolveTime() time.Duration {
+	if s.Solved == 0 {
+		return 0
+	}
+	return s.SolveTime / time.Duration(s.Solved)
+}
+
+func (s PowStats) String() string {
+	return fmt.Sprintf("Solved: %d Unsolved: %d Cancelled: %d Dropped: %d Average: %s Max: %s Issued: %d Accepted: %d Rejected: %d",
+		s.Solved, s.Unsolved, s.Cancelled, s.Dropped, s.AverageSolveTime(), s.MaxSolveTime, s.Issued, s.Accepted, s.Rejected)
+}
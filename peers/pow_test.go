@@ -0,0 +1,96 @@
+package peers
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/donovanhide/ripple/peers/protocol"
+	"testing"
+	"time"
+)
+
+func newTestPool() *ProofOfWorkPool {
+	pool := NewProofOfWorkPool(1)
+	pool.iterations = 64
+	return pool
+}
+
+func TestProofOfWorkPool(t *testing.T) {
+	pool := newTestPool()
+	challenge, err := pool.Issue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := make(chan proto.Message, 1)
+	if !pool.Solve(challenge, reply, make(chan struct{})) {
+		t.Fatal("Challenge not queued")
+	}
+	var response *protocol.TMProofWork
+	select {
+	case msg := <-reply:
+		response = msg.(*protocol.TMProofWork)
+	case <-time.After(10 * time.Second):
+		t.Fatal("Challenge not solved")
+	}
+	if response.GetToken() != challenge.GetToken() {
+		t.Fatalf("Wrong token: %s", response.GetToken())
+	}
+	if result := pool.Verify(response.GetToken(), response.GetResponse()); result != protocol.TMProofWork_powrOK {
+		t.Fatalf("Solution rejected: %s", result)
+	}
+	if result := pool.Verify(response.GetToken(), response.GetResponse()); result != protocol.TMProofWork_powrREUSED {
+		t.Fatalf("Solution reused: %s", result)
+	}
+	if result := pool.Verify("unknown", response.GetResponse()); result != protocol.TMProofWork_powrINVALID {
+		t.Fatalf("Unknown token accepted: %s", result)
+	}
+	expired, err := pool.Issue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.challenges[expired.GetToken()].expires = time.Now().Add(-time.Second)
+	if result := pool.Verify(expired.GetToken(), response.GetResponse()); result != protocol.TMProofWork_powrEXPIRED {
+		t.Fatalf("Expired challenge accepted: %s", result)
+	}
+	stats := pool.Stats()
+	if stats.Solved != 1 || stats.Issued != 2 || stats.Accepted != 1 || stats.Rejected != 3 {
+		t.Fatalf("Wrong stats: %s", stats)
+	}
+}
+
+func TestProofOfWorkCancelled(t *testing.T) {
+	pool := newTestPool()
+	challenge, err := pool.Issue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge.Target = make([]byte, 32)
+	closed := make(chan struct{})
+	close(closed)
+	pool.Solve(challenge, make(chan proto.Message), closed)
+	for start := time.Now(); pool.Stats().Cancelled == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 10*time.Second {
+			t.Fatal("Challenge not cancelled")
+		}
+	}
+}
+
+func TestProofOfWorkTooHard(t *testing.T) {
+	pool := newTestPool()
+	challenge, err := pool.Issue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.TooHard(challenge); err != nil {
+		t.Fatalf("Own challenge refused: %s", err)
+	}
+	for _, modify := range []func(*protocol.TMProofWork){
+		func(c *protocol.TMProofWork) { c.Iterations = proto.Uint32(powMaxIterations + 1) },
+		func(c *protocol.TMProofWork) { c.Target = make([]byte, 32) },
+		func(c *protocol.TMProofWork) { c.Target = powTarget[:16] },
+	} {
+		hard := *challenge
+		modify(&hard)
+		if pool.TooHard(&hard) == nil {
+			t.Errorf("Challenge accepted: %+v", hard)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package protocol
+
+import (
+	"bytes"
+	"code.google.com/p/goprotobuf/proto"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+var captureMagic = [4]byte{'R', 'C', 'A', 'P'}
+
+type Direction uint8
+
+const (
+	Inbound Direction = iota
+	Outbound
+)
+
+func (d Direction) String() string {
+	if d == Outbound {
+		return "Out"
+	}
+	return "In"
+}
+
+type MessageEncoder interface {
+	Encode(msg proto.Message) error
+}
+
+type MessageDecoder interface {
+	Decode() (ExtendedMessage, error)
+}
+
+// Record is a single captured message. Raw is the frame as it appeared on
+// the wire. If the frame could not be decoded Message is nil and Err says why.
+type Record struct {
+	Time      time.Time
+	Direction Direction
+	Peer      string
+	Raw       []byte
+	Message   ExtendedMessage
+	Err       error
+}
+
+type recordHeader struct {
+	Time       int64
+	Direction  Direction
+	PeerLength uint8
+}
+
+// Recorder writes every message passing through the encoders and decoders
+// it wraps to a capture. Each record is a timestamp, the direction, the peer
+// and the message as it appears on the wire. Inbound frames are recorded
+// before they are decoded, so that undecodable messages are captured too.
+// The peer is named by a function, so that it can be identified by its node
+// public key once the handshake is complete.
+type Recorder struct {
+	w   io.Writer
+	buf bytes.Buffer
+	mu  sync.Mutex
+}
+
+func NewRecorder(w io.Writer) (*Recorder, error) {
+	if _, err := w.Write(captureMagic[:]); err != nil {
+		return nil, fmt.Errorf("Capture: Write Magic: %s", err.Error())
+	}
+	return &Recorder{w: w}, nil
+}
+
+func (r *Recorder) record(peer string, direction Direction, frame []byte) error {
+	if len(peer) > 255 {
+		peer = peer[:255]
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.buf.Reset()
+	header := recordHeader{
+		Time:       time.Now().UnixNano(),
+		Direction:  direction,
+		PeerLength: uint8(len(peer)),
+	}
+	binary.Write(&r.buf, binary.BigEndian, header)
+	r.buf.WriteString(peer)
+	r.buf.Write(frame)
+	if _, err := r.w.Write(r.buf.Bytes()); err != nil {
+		return fmt.Errorf("Capture: Write Record: %s", err.Error())
+	}
+	return nil
+}
+
+// readFrame reads the header and body of a single frame into buf
+func readFrame(r io.Reader, buf *bytes.Buffer) error {
+	var header Header
+	if err := binary.Read(io.TeeReader(r, buf), binary.BigEndian, &header); err != nil {
+		if err == io.EOF {
+			return err
+		}
+		return fmt.Errorf("Protocol Decode: Read Header: %s", err.Error())
+	}
+	if _, err := io.CopyN(buf, r, int64(header.Length)); err != nil {
+		return fmt.Errorf("Protocol Decode: Read Body: %s", err.Error())
+	}
+	return nil
+}
+
+// Encoder returns an encoder for w which records each message sent to peer
+func (r *Recorder) Encoder(w io.Writer, peer func() string) MessageEncoder {
+	e := &recordingEncoder{
+		Encoder:  NewEncoder(w),
+		recorder: r,
+		peer:     peer,
+	}
+	e.frame = NewEncoder(&e.buf)
+	return e
+}
+
+// Decoder returns a decoder for rd which records each frame received from
+// peer exactly as it was read
+func (r *Recorder) Decoder(rd io.Reader, peer func() string) MessageDecoder {
+	d := &recordingDecoder{
+		r:        rd,
+		recorder: r,
+		peer:     peer,
+	}
+	d.frame = NewDecoder(&d.reader)
+	return d
+}
+
+type recordingEncoder struct {
+	*Encoder
+	frame    *Encoder
+	buf      bytes.Buffer
+	recorder *Recorder
+	peer     func() string
+}
+
+func (e *recordingEncoder) Encode(msg proto.Message) error {
+	if err := e.Encoder.Encode(msg); err != nil {
+		return err
+	}
+	e.buf.Reset()
+	if err := e.frame.Encode(msg); err != nil {
+		return err
+	}
+	return e.recorder.record(e.peer(), Outbound, e.buf.Bytes())
+}
+
+type recordingDecoder struct {
+	r        io.Reader
+	frame    *Decoder
+	reader   bytes.Reader
+	buf      bytes.Buffer
+	recorder *Recorder
+	peer     func() string
+}
+
+func (d *recordingDecoder) Decode() (ExtendedMessage, error) {
+	d.buf.Reset()
+	if err := readFrame(d.r, &d.buf); err != nil {
+		if err == io.EOF {
+			return nil, fmt.Errorf("Protocol Decode: Read Header: %s", err.Error())
+		}
+		return nil, err
+	}
+	if err := d.recorder.record(d.peer(), Inbound, d.buf.Bytes()); err != nil {
+		return nil, err
+	}
+	d.reader.Reset(d.buf.Bytes())
+	return d.frame.Decode()
+}
+
+// Player reads the records of a capture in order
+type Player struct {
+	r      io.Reader
+	dec    *Decoder
+	reader bytes.Reader
+	buf    bytes.Buffer
+}
+
+func NewPlayer(r io.Reader) (*Player, error) {
+	var magic [4]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil {
+		return nil, fmt.Errorf("Capture: Read Magic: %s", err.Error())
+	}
+	if magic != captureMagic {
+		return nil, fmt.Errorf("Capture: Bad Magic: %X", magic)
+	}
+	p := &Player{r: r}
+	p.dec = NewDecoder(&p.reader)
+	return p, nil
+}
+
+// Next returns io.EOF at the end of the capture. Frames which cannot be
+// decoded are returned with Err set.
+func (p *Player) Next() (*Record, error) {
+	var header recordHeader
+	if err := binary.Read(p.r, binary.BigEndian, &header); err != nil {
+		if err == io.EOF {
+			return nil, err
+		}
+		return nil, fmt.Errorf("Capture: Read Record: %s", err.Error())
+	}
+	peer := make([]byte, header.PeerLength)
+	if _, err := io.ReadFull(p.r, peer); err != nil {
+		return nil, fmt.Errorf("Capture: Read Peer: %s", err.Error())
+	}
+	p.buf.Reset()
+	if err := readFrame(p.r, &p.buf); err != nil {
+		if err == io.EOF {
+			return nil, fmt.Errorf("Capture: Read Frame: %s", err.Error())
+		}
+		return nil, err
+	}
+	record := &Record{
+		Time:      time.Unix(0, header.Time),
+		Direction: header.Direction,
+		Peer:      string(peer),
+		Raw:       append([]byte(nil), p.buf.Bytes()...),
+	}
+	p.reader.Reset(record.Raw)
+	record.Message, record.Err = p.dec.Decode()
+	return record, nil
+}
@@ -0,0 +1,76 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+func TestCapture(t *testing.T) {
+	var capture, wire bytes.Buffer
+	recorder, err := NewRecorder(&capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc := recorder.Encoder(&wire, func() string { return "out:51235" })
+	for _, msg := range []Message{NewPing(), NewStatusChange(10, 20)} {
+		if err := enc.Encode(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// An undecodable frame is recorded before decoding fails
+	binary.Write(&wire, binary.BigEndian, Header{Length: 2, MessageType: 9999})
+	wire.Write([]byte{0xDE, 0xAD})
+	peer := "in:51235"
+	dec := recorder.Decoder(&wire, func() string { return peer })
+	for i := 0; i < 2; i++ {
+		if _, err := dec.Decode(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	peer = "n9KeyOfPeer"
+	if _, err := dec.Decode(); err == nil {
+		t.Fatal("Unknown message type decoded")
+	}
+	player, err := NewPlayer(&capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []*Record
+	for {
+		record, err := player.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	if len(records) != 5 {
+		t.Fatalf("Wrong number of records: %d", len(records))
+	}
+	for i, record := range records[:4] {
+		direction, peer := Outbound, "out:51235"
+		if i >= 2 {
+			direction, peer = Inbound, "in:51235"
+		}
+		if record.Direction != direction || record.Peer != peer || record.Time.IsZero() {
+			t.Fatalf("Wrong record %d: %+v", i, record)
+		}
+	}
+	if ping, ok := records[2].Message.(*Ping); !ok || !ping.IsPing {
+		t.Fatalf("Wrong message: %s", records[2].Message.Log())
+	}
+	status, ok := records[3].Message.(*TMStatusChange)
+	if !ok || status.GetFirstSeq() != 10 || status.GetLastSeq() != 20 {
+		t.Fatalf("Wrong message: %s", records[3].Message.Log())
+	}
+	if bad := records[4]; bad.Peer != "n9KeyOfPeer" || bad.Message != nil || bad.Err == nil || len(bad.Raw) != 8 {
+		t.Fatalf("Wrong undecodable record: %+v", bad)
+	}
+	if _, err := NewPlayer(bytes.NewReader([]byte("JUNK"))); err == nil {
+		t.Fatal("Bad magic accepted")
+	}
+}
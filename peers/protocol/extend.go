@@ -24,6 +24,24 @@ func NewPong() *TMPing {
 	return &TMPing{Type: TMPing_ptPONG.Enum()}
 }
 
+// NewStatusChange announces the range of complete ledgers which can be served
+func NewStatusChange(first, last uint32) *TMStatusChange {
+	return &TMStatusChange{
+		FirstSeq:    proto.Uint32(first),
+		LastSeq:     proto.Uint32(last),
+		NetworkTime: proto.Uint64(uint64(data.Now().Uint32())),
+	}
+}
+
+// NewTransaction relays a signed transaction in its binary format
+func NewTransaction(raw []byte) *TMTransaction {
+	return &TMTransaction{
+		RawTransaction:   raw,
+		Status:           TransactionStatus_tsNEW.Enum(),
+		ReceiveTimestamp: proto.Uint64(uint64(data.Now().Uint32())),
+	}
+}
+
 func NewGetLedger(sequence uint32) *TMGetLedger {
 	return &TMGetLedger{
 		Itype:     TMLedgerInfoType_liBASE.Enum(),
@@ -46,6 +64,53 @@ func NewGetLedgerTransactions(sequence uint32, nodeids [][]byte) *TMGetLedger {
 	}
 }
 
+func NewGetTransactionSet(hash data.Hash256, nodes []data.NodeId) *TMGetLedger {
+	var nodeids [][]byte
+	for _, node := range nodes {
+		nodeids = append(nodeids, node.Bytes())
+	}
+	return &TMGetLedger{
+		Itype:      TMLedgerInfoType_liTS_CANDIDATE.Enum(),
+		LedgerHash: hash.Bytes(),
+		NodeIDs:    nodeids,
+	}
+}
+
+func NewGetLedgerNodes(request *data.NodeRequest) *TMGetLedger {
+	var nodeids [][]byte
+	for _, id := range request.Ids {
+		nodeids = append(nodeids, id.Bytes())
+	}
+	itype := TMLedgerInfoType_liAS_NODE
+	if request.Type == data.NT_TRANSACTION_NODE {
+		itype = TMLedgerInfoType_liTX_NODE
+	}
+	return &TMGetLedger{
+		Itype:      itype.Enum(),
+		LedgerHash: request.LedgerHash.Bytes(),
+		LedgerSeq:  proto.Uint32(request.LedgerSequence),
+		NodeIDs:    nodeids,
+	}
+}
+
+func NewGetObjectsByHash(request *data.NodeRequest) *TMGetObjectByHash {
+	var objects []*TMIndexedObject
+	for _, hash := range request.Hashes {
+		objects = append(objects, &TMIndexedObject{Hash: hash.Bytes()})
+	}
+	typ := TMGetObjectByHash_otSTATE_NODE
+	if request.Type == data.NT_TRANSACTION_NODE {
+		typ = TMGetObjectByHash_otTRANSACTION_NODE
+	}
+	return &TMGetObjectByHash{
+		Type:       typ.Enum(),
+		Query:      proto.Bool(true),
+		Seq:        proto.Uint32(request.LedgerSequence),
+		LedgerHash: request.LedgerHash.Bytes(),
+		Objects:    objects,
+	}
+}
+
 func NewGetObjects(sequence uint32, nodes []*data.InnerNode) *TMGetObjectByHash {
 	var objects []*TMIndexedObject
 	for _, node := range nodes {
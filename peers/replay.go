@@ -0,0 +1,64 @@
+package peers
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/donovanhide/ripple/ledger"
+	"github.com/donovanhide/ripple/peers/protocol"
+	"io"
+)
+
+// Replay feeds the inbound messages of a capture which pass filter to a peer
+// which is connected to sync but not to the network. Outbound messages are
+// skipped because the peer makes its own requests, whose stats would
+// otherwise be counted twice, and anything the peer sends is discarded.
+// Hellos are skipped because they are bound to the original TLS session and
+// frames which could not be decoded are skipped. Replay returns the number
+// of messages handled.
+func Replay(sync ledger.Sync, player *protocol.Player, filter func(*protocol.Record) bool) (int, error) {
+	m := &Manager{
+		Config: &Config{Sync: sync},
+		Router: NewHashRouter(routerHold),
+		peers:  make(chan *PeerConnection, 10),
+	}
+	go func() {
+		for range m.peers {
+		}
+	}()
+	c := &PeerConnection{Host: "replay", Port: "0"}
+	peer := newPeer(c, sync)
+	peer.Conn = &Conn{Host: c.Host, Port: c.Port}
+	incoming := make(chan protocol.ExtendedMessage, 10)
+	outgoing := make(chan proto.Message, 10)
+	done := make(chan struct{})
+	go func() {
+		for range outgoing {
+		}
+		close(m.peers)
+		close(done)
+	}()
+	go peer.serve(m, incoming, outgoing)
+	var (
+		count int
+		err   error
+	)
+	for {
+		var record *protocol.Record
+		if record, err = player.Next(); err != nil {
+			break
+		}
+		if record.Err != nil || (filter != nil && !filter(record)) {
+			continue
+		}
+		if _, ok := record.Message.(*protocol.Hello); ok || record.Direction == protocol.Outbound {
+			continue
+		}
+		incoming <- record.Message
+		count++
+	}
+	close(incoming)
+	<-done
+	if err == io.EOF {
+		err = nil
+	}
+	return count, err
+}
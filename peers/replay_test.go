@@ -0,0 +1,45 @@
+package peers
+
+import (
+	"bytes"
+	"github.com/donovanhide/ripple/ledger"
+	"github.com/donovanhide/ripple/peers/protocol"
+	"github.com/donovanhide/ripple/storage"
+	"testing"
+)
+
+func TestReplay(t *testing.T) {
+	var capture, wire bytes.Buffer
+	recorder, err := protocol.NewRecorder(&capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc := recorder.Encoder(&wire, func() string { return "peer:51235" })
+	for _, msg := range []protocol.Message{protocol.NewPing(), protocol.NewStatusChange(10, 20), &protocol.TMHello{}} {
+		if err := enc.Encode(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dec := recorder.Decoder(&wire, func() string { return "peer:51235" })
+	for i := 0; i < 3; i++ {
+		if _, err := dec.Decode(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	player, err := protocol.NewPlayer(&capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sync, err := ledger.NewManager(storage.NewEmptyMemoryDB())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go sync.Start()
+	count, err := Replay(sync, player, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatalf("Wrong number of messages replayed: %d", count)
+	}
+}
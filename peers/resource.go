@@ -0,0 +1,191 @@
+package peers
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Fee is the cost charged to a peer for the load caused by a message
+type Fee struct {
+	Name string
+	Cost float64
+}
+
+var (
+	feeNewConnection    = Fee{"NewConnection", 200}
+	feeInvalidSignature = Fee{"InvalidSignature", 2000}
+	feeInvalidData      = Fee{"InvalidData", 400}
+	feeUndecodable      = Fee{"Undecodable", 20}
+	feeUnwantedData     = Fee{"UnwantedData", 150}
+	feeQuery            = Fee{"Query", 10}
+	feeQueryItem        = Fee{"QueryItem", 1}
+)
+
+type Disposition int
+
+const (
+	Ok Disposition = iota
+	Warn
+	Drop
+)
+
+const (
+	resourceHalfLife = 32 * time.Second
+	resourceWarning  = 5000
+	resourceDrop     = 15000
+	resourceBan      = 5 * time.Minute
+	resourceSweep    = time.Minute
+	resourceGossip   = 1000
+	resourceImport   = 30 * time.Second
+)
+
+type consumer struct {
+	balance float64
+	updated time.Time
+	charges map[string]uint64
+}
+
+// imported is the balances reported by another member of the cluster
+type imported struct {
+	balances map[string]float64
+	received time.Time
+}
+
+// ResourceManager charges each host for the load its peers cause. Balances
+// decay over time, so only a sustained or severe load reaches the limits.
+// Hosts past the drop limit are banned for a while. Recent balances imported
+// from the cluster count towards the limits too.
+type ResourceManager struct {
+	consumers map[string]*consumer
+	bans      map[string]time.Time
+	imports   map[string]*imported
+	swept     time.Time
+	mu        sync.Mutex
+}
+
+func NewResourceManager() *ResourceManager {
+	return &ResourceManager{
+		consumers: make(map[string]*consumer),
+		bans:      make(map[string]time.Time),
+		imports:   make(map[string]*imported),
+		swept:     time.Now(),
+	}
+}
+
+func (c *consumer) decay(now time.Time) float64 {
+	elapsed := now.Sub(c.updated).Seconds() / resourceHalfLife.Seconds()
+	c.balance *= math.Pow(0.5, elapsed)
+	c.updated = now
+	return c.balance
+}
+
+// Charge adds the cost of fee times count to the balance of host and bans
+// the host if the drop limit is passed
+func (r *ResourceManager) Charge(host string, fee Fee, count int) Disposition {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if now.Sub(r.swept) > resourceSweep {
+		r.sweep(now)
+	}
+	c, ok := r.consumers[host]
+	if !ok {
+		c = &consumer{
+			updated: now,
+			charges: make(map[string]uint64),
+		}
+		r.consumers[host] = c
+	}
+	c.charges[fee.Name] += uint64(count)
+	c.balance = c.decay(now) + fee.Cost*float64(count)
+	balance := c.balance + r.imported(host, now)
+	switch {
+	case balance >= resourceDrop:
+		r.bans[host] = now.Add(resourceBan)
+		return Drop
+	case balance >= resourceWarning:
+		return Warn
+	default:
+		return Ok
+	}
+}
+
+func (r *ResourceManager) Banned(host string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	until, ok := r.bans[host]
+	return ok && time.Now().Before(until)
+}
+
+// Balance returns the current balance of host and the number of each fee
+// it has been charged
+func (r *ResourceManager) Balance(host string) (float64, map[string]uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, ok := r.consumers[host]
+	if !ok {
+		return 0, nil
+	}
+	charges := make(map[string]uint64)
+	for name, count := range c.charges {
+		charges[name] = count
+	}
+	return c.decay(time.Now()), charges
+}
+
+// Export returns the hosts with a local balance worth sharing with the
+// cluster
+func (r *ResourceManager) Export() map[string]float64 {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	balances := make(map[string]float64)
+	for host, c := range r.consumers {
+		if balance := c.decay(now); balance >= resourceGossip {
+			balances[host] = balance
+		}
+	}
+	return balances
+}
+
+// Import replaces the balances previously reported by origin
+func (r *ResourceManager) Import(origin string, balances map[string]float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.imports[origin] = &imported{
+		balances: balances,
+		received: time.Now(),
+	}
+}
+
+// imported sums the recent balances reported for host. The lock must be
+// held.
+func (r *ResourceManager) imported(host string, now time.Time) float64 {
+	var total float64
+	for _, i := range r.imports {
+		if now.Sub(i.received) < resourceImport {
+			total += i.balances[host]
+		}
+	}
+	return total
+}
+
+func (r *ResourceManager) sweep(now time.Time) {
+	for host, c := range r.consumers {
+		if c.decay(now) < 1 {
+			delete(r.consumers, host)
+		}
+	}
+	for host, until := range r.bans {
+		if now.After(until) {
+			delete(r.bans, host)
+		}
+	}
+	for origin, i := range r.imports {
+		if now.Sub(i.received) >= resourceImport {
+			delete(r.imports, origin)
+		}
+	}
+	r.swept = now
+}
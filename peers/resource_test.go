@@ -0,0 +1,55 @@
+package peers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestResourceManager(t *testing.T) {
+	r := NewResourceManager()
+	if d := r.Charge("a", feeQuery, 1); d != Ok {
+		t.Fatalf("Wrong disposition for a query: %d", d)
+	}
+	if d := r.Charge("a", feeInvalidSignature, 3); d != Warn {
+		t.Fatalf("Wrong disposition past warning: %d", d)
+	}
+	if r.Banned("a") {
+		t.Fatal("Banned after warning")
+	}
+	if d := r.Charge("a", feeInvalidSignature, 5); d != Drop || !r.Banned("a") {
+		t.Fatalf("Not banned past drop limit: %d", d)
+	}
+	if r.Banned("b") {
+		t.Fatal("Wrong host banned")
+	}
+	balance, charges := r.Balance("a")
+	if balance < resourceDrop || charges[feeInvalidSignature.Name] != 8 || charges[feeQuery.Name] != 1 {
+		t.Fatalf("Wrong balance: %f %v", balance, charges)
+	}
+	c := r.consumers["a"]
+	c.updated = c.updated.Add(-20 * resourceHalfLife)
+	if balance, _ := r.Balance("a"); balance >= 1 {
+		t.Fatalf("Balance not decayed: %f", balance)
+	}
+	r.bans["a"] = time.Now().Add(-time.Second)
+	r.sweep(time.Now())
+	if r.Banned("a") || len(r.consumers) != 0 {
+		t.Fatal("Ban and balance not swept")
+	}
+}
+
+func TestChargeDropsPeer(t *testing.T) {
+	r := NewResourceManager()
+	peer := newTestPeer(&PeerConnection{Host: "a", Port: "1"})
+	peer.resources = r
+	peer.charge(feeInvalidSignature, 10)
+	if peer.Status != Banned || !r.Banned("a") {
+		t.Fatalf("Peer not banned: %d", peer.Status)
+	}
+	trusted := newTestPeer(&PeerConnection{Host: "b", Port: "1", Trusted: true})
+	trusted.resources = r
+	trusted.charge(feeInvalidSignature, 10)
+	if trusted.Status == Banned {
+		t.Fatal("Trusted peer banned")
+	}
+}
@@ -0,0 +1,157 @@
+package peers
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"encoding/binary"
+	"fmt"
+	"github.com/donovanhide/ripple/crypto"
+	"github.com/donovanhide/ripple/data"
+	"github.com/donovanhide/ripple/peers/protocol"
+	"sync"
+	"time"
+)
+
+const routerHold = 5 * time.Minute
+
+type routerEntry struct {
+	peers   map[*Peer]struct{}
+	first   time.Time
+	relayed bool
+}
+
+type RouterStats struct {
+	Items      int
+	Unique     uint64
+	Duplicates uint64
+	Relayed    uint64
+}
+
+// HashRouter is shared by all peers and remembers which peers have sent
+// each validation, proposal and transaction. Items are only added once their
+// signatures have been verified, so that a forged copy cannot suppress the
+// genuine one. Only the first copy of an item is processed and an item is
+// only relayed to peers which have not sent it. Items are forgotten after
+// being held for a while.
+type HashRouter struct {
+	entries map[data.Hash256]*routerEntry
+	hold    time.Duration
+	swept   time.Time
+	stats   RouterStats
+	mu      sync.Mutex
+}
+
+func NewHashRouter(hold time.Duration) *HashRouter {
+	return &HashRouter{
+		entries: make(map[data.Hash256]*routerEntry),
+		hold:    hold,
+		swept:   time.Now(),
+	}
+}
+
+// routerHash identifies the item carried by a message independently of the
+// fields which change as it is relayed. Every signed field is included.
+func routerHash(msg proto.Message) (data.Hash256, bool) {
+	var b []byte
+	switch v := msg.(type) {
+	case *protocol.TMValidation:
+		b = append([]byte("VAL"), v.GetValidation()...)
+	case *protocol.TMProposeSet:
+		var fields [8]byte
+		binary.BigEndian.PutUint32(fields[:4], v.GetProposeSeq())
+		binary.BigEndian.PutUint32(fields[4:], v.GetCloseTime())
+		b = append([]byte("PRP"), fields[:]...)
+		b = append(b, v.GetCurrentTxHash()...)
+		b = append(b, v.GetPreviousledger()...)
+		b = append(b, v.GetNodePubKey()...)
+		b = append(b, v.GetSignature()...)
+	case *protocol.TMTransaction:
+		b = append([]byte("TXN"), v.GetRawTransaction()...)
+	default:
+		return data.Hash256{}, false
+	}
+	var hash data.Hash256
+	half, err := crypto.Sha512Half(b)
+	if err != nil {
+		return hash, false
+	}
+	copy(hash[:], half)
+	return hash, true
+}
+
+// Duplicate records that peer sent the item and returns true if the item
+// has already been added, in which case it need not be verified again
+func (r *HashRouter) Duplicate(hash data.Hash256, peer *Peer) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry, ok := r.entries[hash]
+	if !ok {
+		return false
+	}
+	entry.peers[peer] = struct{}{}
+	r.stats.Duplicates++
+	return true
+}
+
+// Add records that peer sent a verified item and returns true if it is the
+// first time the item has been seen
+func (r *HashRouter) Add(hash data.Hash256, peer *Peer) bool {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if now.Sub(r.swept) > r.hold {
+		r.sweep(now)
+	}
+	entry, ok := r.entries[hash]
+	if ok {
+		entry.peers[peer] = struct{}{}
+		r.stats.Duplicates++
+		return false
+	}
+	r.entries[hash] = &routerEntry{
+		peers: map[*Peer]struct{}{peer: {}},
+		first: now,
+	}
+	r.stats.Unique++
+	return true
+}
+
+// Relay returns the candidates which have not sent the item. An item is
+// only relayed once and items which were not added are not relayed.
+func (r *HashRouter) Relay(hash data.Hash256, candidates []*Peer) []*Peer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry, ok := r.entries[hash]
+	if !ok || entry.relayed {
+		return nil
+	}
+	entry.relayed = true
+	var peers []*Peer
+	for _, peer := range candidates {
+		if _, sent := entry.peers[peer]; !sent {
+			peers = append(peers, peer)
+		}
+	}
+	r.stats.Relayed++
+	return peers
+}
+
+func (r *HashRouter) sweep(now time.Time) {
+	for hash, entry := range r.entries {
+		if now.Sub(entry.first) > r.hold {
+			delete(r.entries, hash)
+		}
+	}
+	r.swept = now
+}
+
+func (r *HashRouter) Stats() RouterStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stats := r.stats
+	stats.Items = len(r.entries)
+	return stats
+}
+
+func (s RouterStats) String() string {
+	return fmt.Sprintf("Items: %d Unique: %d Duplicates: %d Relayed: %d", s.Items, s.Unique, s.Duplicates, s.Relayed)
+}
@@ -0,0 +1,61 @@
+package peers
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/donovanhide/ripple/peers/protocol"
+	"testing"
+	"time"
+)
+
+func TestHashRouter(t *testing.T) {
+	r := NewHashRouter(time.Minute)
+	var peers []*Peer
+	for _, host := range []string{"a", "b", "c"} {
+		peers = append(peers, newTestPeer(&PeerConnection{Host: host, Port: "1"}))
+	}
+	msg := &protocol.TMValidation{Validation: []byte{1, 2, 3}}
+	hash, ok := routerHash(msg)
+	if !ok {
+		t.Fatal("No hash for validation")
+	}
+	other, _ := routerHash(&protocol.TMTransaction{RawTransaction: []byte{1, 2, 3}})
+	if hash == other {
+		t.Fatal("Different message types with the same hash")
+	}
+	if _, ok := routerHash(protocol.NewPing()); ok {
+		t.Fatal("Ping should not be routed")
+	}
+	if r.Duplicate(hash, peers[0]) {
+		t.Fatal("Item not added is a duplicate")
+	}
+	if !r.Add(hash, peers[0]) || r.Add(hash, peers[0]) || !r.Duplicate(hash, peers[1]) {
+		t.Fatal("Duplicate not suppressed")
+	}
+	relay := r.Relay(hash, peers)
+	if len(relay) != 1 || relay[0] != peers[2] {
+		t.Fatalf("Wrong peers to relay to: %v", relay)
+	}
+	if len(r.Relay(hash, peers)) != 0 || len(r.Relay(other, peers)) != 0 {
+		t.Fatal("Relayed twice or relayed unknown item")
+	}
+	if stats := r.Stats(); stats.Items != 1 || stats.Unique != 1 || stats.Duplicates != 2 || stats.Relayed != 1 {
+		t.Fatalf("Wrong stats: %s", stats)
+	}
+	proposal := &protocol.TMProposeSet{
+		ProposeSeq:     proto.Uint32(1),
+		CurrentTxHash:  make([]byte, 32),
+		NodePubKey:     []byte{2},
+		CloseTime:      proto.Uint32(10),
+		Signature:      []byte{3},
+		Previousledger: make([]byte, 32),
+	}
+	first, _ := routerHash(proposal)
+	proposal.CurrentTxHash[0] = 1
+	if second, _ := routerHash(proposal); first == second {
+		t.Fatal("Proposals with different transaction sets have the same hash")
+	}
+	r.sweep(time.Now().Add(2 * time.Minute))
+	if !r.Add(hash, peers[1]) {
+		t.Fatal("Expired item still held")
+	}
+}
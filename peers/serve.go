@@ -0,0 +1,201 @@
+package peers
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/donovanhide/ripple/data"
+	"github.com/donovanhide/ripple/peers/protocol"
+	"github.com/golang/glog"
+)
+
+const maxServedNodes = 256
+
+// handleGetLedger answers a request for a ledger header or the nodes of its
+// state or transaction tree from the local DB. Inner nodes are sent with
+// their immediate children to save round trips.
+func (p *Peer) handleGetLedger(req *protocol.TMGetLedger) {
+	p.charge(feeQuery, 1)
+	p.charge(feeQueryItem, len(req.GetNodeIDs()))
+	reply := &protocol.TMLedgerData{
+		LedgerHash: req.GetLedgerHash(),
+		LedgerSeq:  proto.Uint32(req.GetLedgerSeq()),
+		Type:       req.GetItype().Enum(),
+	}
+	if req.RequestCookie != nil {
+		reply.RequestCookie = proto.Uint32(uint32(req.GetRequestCookie()))
+	}
+	hash, ledger, ok := p.getLedger(req)
+	if !ok {
+		reply.Error = protocol.TMReplyError_reNO_LEDGER.Enum()
+		p.reply(reply)
+		return
+	}
+	reply.LedgerHash, reply.LedgerSeq = hash.Bytes(), proto.Uint32(ledger.LedgerSequence)
+	switch req.GetItype() {
+	case protocol.TMLedgerInfoType_liBASE:
+		reply.Nodes = p.ledgerBase(ledger)
+	case protocol.TMLedgerInfoType_liAS_NODE:
+		reply.Nodes = p.ledgerNodes(ledger.StateHash, req.GetNodeIDs())
+	case protocol.TMLedgerInfoType_liTX_NODE:
+		reply.Nodes = p.ledgerNodes(ledger.TransactionHash, req.GetNodeIDs())
+	default:
+		reply.Error = protocol.TMReplyError_reNO_LEDGER.Enum()
+	}
+	if reply.Error == nil && len(reply.Nodes) == 0 {
+		reply.Error = protocol.TMReplyError_reNO_NODE.Enum()
+	}
+	p.reply(reply)
+}
+
+// getLedger finds the requested ledger by hash or by sequence. Only
+// historical ledgers are served.
+func (p *Peer) getLedger(req *protocol.TMGetLedger) (data.Hash256, *data.Ledger, bool) {
+	var hash data.Hash256
+	switch {
+	case len(req.GetLedgerHash()) == len(hash):
+		copy(hash[:], req.GetLedgerHash())
+	case req.LedgerSeq != nil:
+		var ok bool
+		if hash, ok = p.sync.LedgerHash(req.GetLedgerSeq()); !ok {
+			return hash, nil, false
+		}
+	default:
+		return hash, nil, false
+	}
+	node, err := p.sync.Get(hash)
+	if err != nil {
+		return hash, nil, false
+	}
+	ledger, ok := node.(*data.Ledger)
+	return hash, ledger, ok
+}
+
+// ledgerBase returns the header followed by the roots of the state and
+// transaction trees
+func (p *Peer) ledgerBase(ledger *data.Ledger) []*protocol.TMLedgerNode {
+	header, err := data.NodeWire(ledger)
+	if err != nil {
+		glog.Errorf("%s:Ledger %d: %s", p.String(), ledger.LedgerSequence, err.Error())
+		return nil
+	}
+	nodes := []*protocol.TMLedgerNode{{Nodedata: header}}
+	for _, root := range []data.Hash256{ledger.StateHash, ledger.TransactionHash} {
+		if root.IsZero() {
+			break
+		}
+		node := p.wireNode(root, data.RootNodeId)
+		if node == nil {
+			break
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+func (p *Peer) ledgerNodes(root data.Hash256, nodeids [][]byte) []*protocol.TMLedgerNode {
+	var nodes []*protocol.TMLedgerNode
+	for _, b := range nodeids {
+		if len(nodes) >= maxServedNodes {
+			break
+		}
+		id, err := data.NewNodeId(b)
+		if err != nil {
+			glog.Errorf("%s:%s", p.String(), err.Error())
+			continue
+		}
+		node, ok := p.findNode(root, *id)
+		if !ok {
+			continue
+		}
+		if wire := p.wire(node, *id); wire != nil {
+			nodes = append(nodes, wire)
+		}
+		if inner, ok := node.(*data.InnerNode); ok {
+			inner.Each(func(pos int, child data.Hash256) error {
+				if wire := p.wireNode(child, id.Child(pos)); wire != nil {
+					nodes = append(nodes, wire)
+				}
+				return nil
+			})
+		}
+	}
+	return nodes
+}
+
+// findNode follows the path of id from the root and returns the node it
+// leads to
+func (p *Peer) findNode(root data.Hash256, id data.NodeId) (data.Hashable, bool) {
+	node, err := p.sync.Get(root)
+	for depth := uint8(0); err == nil && depth < id.Depth; depth++ {
+		inner, ok := node.(*data.InnerNode)
+		if !ok {
+			return nil, false
+		}
+		position := data.NodeId{Path: id.Path, Depth: depth}
+		child := inner.Children[position.Branch(id.Path)]
+		if child.IsZero() {
+			return nil, false
+		}
+		node, err = p.sync.Get(child)
+	}
+	return node, err == nil
+}
+
+func (p *Peer) wireNode(hash data.Hash256, id data.NodeId) *protocol.TMLedgerNode {
+	node, err := p.sync.Get(hash)
+	if err != nil {
+		return nil
+	}
+	return p.wire(node, id)
+}
+
+func (p *Peer) wire(node data.Hashable, id data.NodeId) *protocol.TMLedgerNode {
+	b, err := data.NodeWire(node)
+	if err != nil {
+		glog.Errorf("%s:Node %s: %s", p.String(), id.String(), err.Error())
+		return nil
+	}
+	return &protocol.TMLedgerNode{
+		Nodedata: b,
+		Nodeid:   id.Bytes(),
+	}
+}
+
+// handleGetObjectByHash answers a query for nodes by hash. Objects which are
+// not held are left out of the reply.
+func (p *Peer) handleGetObjectByHash(query *protocol.TMGetObjectByHash) {
+	p.charge(feeQuery, 1)
+	p.charge(feeQueryItem, len(query.GetObjects()))
+	reply := &protocol.TMGetObjectByHash{
+		Type:       query.Type,
+		Query:      proto.Bool(false),
+		Seq:        query.Seq,
+		LedgerHash: query.LedgerHash,
+	}
+	for _, obj := range query.GetObjects() {
+		if len(reply.Objects) >= maxServedNodes {
+			break
+		}
+		var hash data.Hash256
+		if len(obj.GetHash()) != len(hash) {
+			continue
+		}
+		copy(hash[:], obj.GetHash())
+		node, err := p.sync.Get(hash)
+		if err != nil {
+			continue
+		}
+		b, err := data.NodePrefix(node)
+		if err != nil {
+			glog.Errorf("%s:Object %s: %s", p.String(), hash.String(), err.Error())
+			continue
+		}
+		reply.Objects = append(reply.Objects, &protocol.TMIndexedObject{
+			Hash:      obj.GetHash(),
+			NodeID:    obj.GetNodeID(),
+			Index:     obj.GetIndex(),
+			Data:      b,
+			LedgerSeq: obj.LedgerSeq,
+		})
+	}
+	p.reply(reply)
+}
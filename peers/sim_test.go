@@ -0,0 +1,388 @@
+package peers
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/donovanhide/ripple/crypto"
+	"github.com/donovanhide/ripple/data"
+	"github.com/donovanhide/ripple/ledger"
+	"github.com/donovanhide/ripple/peers/protocol"
+	"github.com/donovanhide/ripple/storage"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// simSync is a ledger.Sync which serves the ledgers added to its DB and
+// ignores everything else
+type simSync struct {
+	db          storage.DB
+	hashes      map[uint32]data.Hash256
+	first, last uint32
+}
+
+func newSimSync() *simSync {
+	return &simSync{
+		db:     storage.NewEmptyMemoryDB(),
+		hashes: make(map[uint32]data.Hash256),
+	}
+}
+
+// add stores a ledger and its nodes. Ledgers must be added before the peer
+// is started.
+func (s *simSync) add(t *testing.T, ledger *data.Ledger, nodes ...data.Hashable) {
+	for _, node := range append(nodes, ledger) {
+		if err := s.db.Insert(node); err != nil {
+			t.Fatal(err)
+		}
+	}
+	seq := ledger.LedgerSequence
+	s.hashes[seq] = ledger.Hash()
+	if s.first == 0 || seq < s.first {
+		s.first = seq
+	}
+	if seq > s.last {
+		s.last = seq
+	}
+}
+
+func (s *simSync) Current(uint32) {}
+
+func (s *simSync) Missing(r *data.LedgerRange) *data.Work {
+	return &data.Work{LedgerRange: r}
+}
+
+func (s *simSync) Submit([]data.Hashable) {}
+
+func (s *simSync) AcquireTxSet(data.Hash256, []data.Hashable) []data.NodeId {
+	return nil
+}
+
+func (s *simSync) Get(hash data.Hash256) (data.Hashable, error) {
+	return s.db.Get(hash)
+}
+
+func (s *simSync) LedgerHash(seq uint32) (data.Hash256, bool) {
+	hash, ok := s.hashes[seq]
+	return hash, ok
+}
+
+func (s *simSync) Range() (uint32, uint32) {
+	return s.first, s.last
+}
+
+func (s *simSync) Track(data.Transaction) (*ledger.Submission, error) {
+	return nil, fmt.Errorf("Not tracked")
+}
+
+func (s *simSync) Submission(data.Hash256) (*ledger.Submission, bool) {
+	return nil, false
+}
+
+func (s *simSync) Copy() *ledger.RadixMap {
+	return nil
+}
+
+// simBehaviour scripts how a simulated peer deviates from an honest one
+type simBehaviour struct {
+	drop    func(protocol.ExtendedMessage) bool // requests which are never answered
+	delay   time.Duration                       // before answering each request
+	corrupt bool                                // node data in replies is mangled
+}
+
+// simPeer is a fake peer listening on loopback which speaks the real
+// protocol. It announces the ledgers held by its sync, answers ledger and
+// object queries from them through the handlers in serve.go and records
+// every message it receives.
+type simPeer struct {
+	*Peer
+	t         *testing.T
+	sync      *simSync
+	behaviour simBehaviour
+	manager   *Manager
+	listener  net.Listener
+	ready     chan struct{}
+	endpoints []string
+	received  []protocol.ExtendedMessage
+	mu        sync.Mutex
+}
+
+func newSimPeer(t *testing.T, sync *simSync, behaviour simBehaviour) *simPeer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &simPeer{
+		t:         t,
+		sync:      sync,
+		behaviour: behaviour,
+		manager:   newTestManager(t, "sim", newTestKey(t)),
+		listener:  l,
+		ready:     make(chan struct{}),
+	}
+	go s.accept()
+	return s
+}
+
+func (s *simPeer) Address() string {
+	return s.listener.Addr().String()
+}
+
+// accept takes the single connection made by the manager under test
+func (s *simPeer) accept() {
+	conn, err := s.listener.Accept()
+	s.listener.Close()
+	if err != nil {
+		return
+	}
+	host, port, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	c, err := NewConn(&PeerConnection{Host: host, Port: port, Inbound: true, Conn: conn})
+	if err != nil {
+		s.t.Error(err)
+		conn.Close()
+		return
+	}
+	if _, err := s.manager.acceptUpgrade(c, c.reader); err != nil {
+		s.t.Error(err)
+		conn.Close()
+		return
+	}
+	s.Peer = newPeer(&PeerConnection{Host: host, Port: port, Inbound: true}, s.sync)
+	s.Conn = c
+	close(s.ready)
+	s.run()
+}
+
+func (s *simPeer) run() {
+	incoming := make(chan protocol.ExtendedMessage, 10)
+	outgoing := make(chan proto.Message, 10)
+	go s.Conn.run(incoming, outgoing)
+	if first, last := s.sync.Range(); last > 0 {
+		outgoing <- protocol.NewStatusChange(first, last)
+	}
+	for {
+		select {
+		case out := <-s.Outgoing:
+			if s.behaviour.corrupt {
+				corrupt(out)
+			}
+			outgoing <- out
+		case in, ok := <-incoming:
+			if !ok {
+				close(s.closed)
+				close(outgoing)
+				return
+			}
+			s.mu.Lock()
+			s.received = append(s.received, in)
+			s.mu.Unlock()
+			if s.behaviour.drop != nil && s.behaviour.drop(in) {
+				continue
+			}
+			go s.respond(in)
+		}
+	}
+}
+
+func (s *simPeer) respond(in protocol.ExtendedMessage) {
+	time.Sleep(s.behaviour.delay)
+	switch msg := in.(type) {
+	case *protocol.TMGetLedger:
+		s.handleGetLedger(msg)
+	case *protocol.TMGetObjectByHash:
+		if msg.GetQuery() {
+			s.handleGetObjectByHash(msg)
+		}
+	case *protocol.TMGetPeers:
+		s.Outgoing <- s.endpointsMessage()
+	case *protocol.Ping:
+		if msg.IsPing {
+			s.Outgoing <- protocol.NewPong()
+		}
+	}
+}
+
+// advertise sets the addresses sent as neighbours in reply to TMGetPeers. It
+// must be called before the peer is connected to.
+func (s *simPeer) advertise(addresses ...string) {
+	s.endpoints = addresses
+}
+
+func (s *simPeer) endpointsMessage() *protocol.TMEndpoints {
+	msg := &protocol.TMEndpoints{Version: proto.Uint32(1)}
+	for _, address := range s.endpoints {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			s.t.Error(err)
+			continue
+		}
+		p, _ := strconv.ParseUint(port, 10, 16)
+		msg.Endpoints = append(msg.Endpoints, &protocol.TMEndpoint{
+			Ipv4: &protocol.TMIPv4Endpoint{
+				Ipv4:     proto.Uint32(binary.LittleEndian.Uint32(net.ParseIP(host).To4())),
+				Ipv4Port: proto.Uint32(uint32(p)),
+			},
+			Hops: proto.Uint32(1),
+		})
+	}
+	return msg
+}
+
+// corrupt flips a byte in every node of a reply
+func corrupt(msg proto.Message) {
+	switch v := msg.(type) {
+	case *protocol.TMLedgerData:
+		for _, node := range v.Nodes {
+			if len(node.Nodedata) > 0 {
+				node.Nodedata[len(node.Nodedata)-1] ^= 0xFF
+			}
+		}
+	case *protocol.TMGetObjectByHash:
+		for _, obj := range v.Objects {
+			if len(obj.Data) > 0 {
+				obj.Data[len(obj.Data)-1] ^= 0xFF
+			}
+		}
+	}
+}
+
+// send queues a message for the manager under test once it has connected
+func (s *simPeer) send(msg proto.Message) {
+	select {
+	case <-s.ready:
+		s.Outgoing <- msg
+	case <-time.After(10 * time.Second):
+		s.t.Fatalf("%s: Not connected", s.Address())
+	}
+}
+
+// received returns the messages received so far which match
+func (s *simPeer) receivedMatching(match func(protocol.ExtendedMessage) bool) []protocol.ExtendedMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var matched []protocol.ExtendedMessage
+	for _, msg := range s.received {
+		if match(msg) {
+			matched = append(matched, msg)
+		}
+	}
+	return matched
+}
+
+// waitFor polls until f returns true or the timeout passes
+func waitFor(t *testing.T, timeout time.Duration, what string, f func() bool) {
+	for start := time.Now(); !f(); time.Sleep(50 * time.Millisecond) {
+		if time.Since(start) > timeout {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+	}
+}
+
+// simNetwork is a manager under test connected to simulated peers
+type simNetwork struct {
+	*Manager
+	ledgers   *ledger.Manager
+	peers     []*simPeer
+	validator crypto.Key
+}
+
+// newSimNetwork starts a manager which dials each of the simulated peers.
+// Trusted peers are never charged or evicted. The manager trusts a single
+// validator.
+func newSimNetwork(t *testing.T, trusted bool, peers ...*simPeer) *simNetwork {
+	ledgers, err := ledger.NewManager(storage.NewEmptyMemoryDB())
+	if err != nil {
+		t.Fatal(err)
+	}
+	validator := newTestKey(t)
+	var key data.PublicKey
+	copy(key[:], validator.PublicCompressed())
+	ledgers.Validators().Trust([]data.PublicKey{key}, 1)
+	go ledgers.Start()
+	var addresses []string
+	for _, peer := range peers {
+		addresses = append(addresses, peer.Address())
+	}
+	config := &Config{
+		Key:             newTestKey(t),
+		Name:            "manager",
+		Port:            "0",
+		Sync:            ledgers,
+		MaxPeers:        len(peers),
+		LegacyHandshake: false,
+	}
+	if trusted {
+		config.Trusted = strings.Join(addresses, ",")
+	}
+	m, err := NewManager(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !trusted {
+		for _, address := range addresses {
+			host, port, _ := net.SplitHostPort(address)
+			m.AddPeer(host, port, false, nil)
+		}
+	}
+	return &simNetwork{
+		Manager:   m,
+		ledgers:   ledgers,
+		peers:     peers,
+		validator: validator,
+	}
+}
+
+// verified returns the number of peers which have completed the handshake
+// with the manager
+func (n *simNetwork) verified(t *testing.T) int {
+	c := make(chan []byte)
+	n.Status <- c
+	var dump []struct {
+		State struct {
+			Status string
+		}
+	}
+	if err := json.Unmarshal(<-c, &dump); err != nil {
+		t.Fatal(err)
+	}
+	var verified int
+	for _, d := range dump {
+		if d.State.Status == "Verified" {
+			verified++
+		}
+	}
+	return verified
+}
+
+func (n *simNetwork) Close() {
+	n.Quit <- true
+}
+
+// simValidation returns a validation of hash signed by key
+func simValidation(t *testing.T, key crypto.Key, seq uint32, hash data.Hash256) *protocol.TMValidation {
+	v := &data.Validation{
+		Flags:          0x80000001,
+		LedgerHash:     hash,
+		LedgerSequence: seq,
+		SigningTime:    data.Now().Uint32(),
+	}
+	copy(v.SigningPubKey[:], key.PublicCompressed())
+	enc := data.NewEncoder()
+	if err := enc.Validation(v, true); err != nil {
+		t.Fatal(err)
+	}
+	sig, err := key.Sign(v.Hash().Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.Signature = data.VariableLength(sig)
+	if err := enc.Validation(v, false); err != nil {
+		t.Fatal(err)
+	}
+	return &protocol.TMValidation{Validation: v.Raw()}
+}
@@ -16,18 +16,31 @@ const (
 	Verified
 	HelloFailed
 	Disconnected
+	Evicted
+	Banned
 )
 
+const maxStateChanges = 32
+
 var verificationStatusMap = map[VerificationStatus]string{
 	Unverified:   "Unverified",
 	Verified:     "Verified",
 	HelloFailed:  "HelloFailed",
 	Disconnected: "Disconnected",
+	Evicted:      "Evicted",
+	Banned:       "Banned",
+}
+
+type StateChange struct {
+	Status VerificationStatus
+	Time   time.Time
 }
 
 type State struct {
 	Trusted       bool
+	Cluster       bool
 	Name          string
+	Protocol      string
 	MajorVersion  uint32
 	MinorVersion  uint32
 	PublicKey     crypto.Hash
@@ -38,6 +51,7 @@ type State struct {
 	NodeStatus    string
 	Status        VerificationStatus
 	Discovered    time.Time
+	Changes       []StateChange
 }
 
 type PeerState struct {
@@ -46,21 +60,36 @@ type PeerState struct {
 }
 
 func NewPeerState(c *PeerConnection) *PeerState {
+	now := time.Now()
 	return &PeerState{
 		State: &State{
 			Trusted:    c.Trusted,
 			Status:     Unverified,
-			Discovered: time.Now(),
+			Discovered: now,
+			Changes:    []StateChange{{Unverified, now}},
 		},
 	}
 }
 
 func (s *PeerState) UpdateStatus(status VerificationStatus) {
 	s.mu.Lock()
-	s.Status = status
+	s.setStatus(status)
 	s.mu.Unlock()
 }
 
+// setStatus records the change of status, keeping only the most recent
+// changes. The lock must be held.
+func (s *PeerState) setStatus(status VerificationStatus) {
+	if status == s.Status {
+		return
+	}
+	s.Status = status
+	s.Changes = append(s.Changes, StateChange{status, time.Now()})
+	if len(s.Changes) > maxStateChanges {
+		s.Changes = s.Changes[len(s.Changes)-maxStateChanges:]
+	}
+}
+
 func (s *PeerState) UpdateState(state *protocol.TMStatusChange) {
 	s.mu.Lock()
 	s.CurrentLedger = state.GetLedgerSeq()
@@ -81,13 +110,43 @@ func (s *PeerState) ProcessHello(hello *protocol.Hello) error {
 	var err error
 	s.PublicKey, err = crypto.NewRippleHash(string(hello.NodePublic))
 	if err != nil {
-		s.Status = HelloFailed
+		s.setStatus(HelloFailed)
 		return fmt.Errorf("Bad node public key: %s", hello.NodePublic)
 	}
-	s.Status = Verified
+	s.setStatus(Verified)
 	return nil
 }
 
+func (s *PeerState) ProcessHandshake(handshake *Handshake) {
+	s.mu.Lock()
+	s.Name = handshake.Name
+	s.Protocol = handshake.Protocol
+	s.PublicKey = handshake.PublicKey
+	s.setStatus(Verified)
+	s.mu.Unlock()
+}
+
+// JoinCluster marks the peer as a member of the cluster if its verified
+// public key is one of the members
+func (s *PeerState) JoinCluster(c *Cluster) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Cluster = s.Status == Verified && c != nil && c.Member(s.PublicKey)
+	return s.Cluster
+}
+
+func (s *PeerState) InCluster() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Cluster
+}
+
+func (s *PeerState) Key() crypto.Hash {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.PublicKey
+}
+
 func (s *PeerState) GetLedgerRange() (uint32, uint32) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -3,7 +3,6 @@ package peers
 import (
 	"code.google.com/p/goprotobuf/proto"
 	"encoding/json"
-	"fmt"
 	"github.com/donovanhide/ripple/peers/protocol"
 	metrics "github.com/rcrowley/go-metrics"
 	"reflect"
@@ -34,16 +33,23 @@ type LatencyDump struct {
 }
 
 type Stats struct {
-	Sent       map[string]uint64
-	Received   map[string]uint64
-	Latencies  map[string]*Latency
-	Unexpected uint64
-	InFlight   string
+	Sent         map[string]uint64
+	Received     map[string]uint64
+	Latencies    map[string]*Latency
+	Unexpected   uint64
+	InFlight     map[string]int
+	Connected    time.Time
+	LastReceived time.Time
 }
 
+// statsRequestTimeout is how long a request is remembered while waiting
+// for its reply
+const statsRequestTimeout = 5 * time.Minute
+
 type PeerStats struct {
 	*Stats
-	mu sync.RWMutex
+	sent map[string]time.Time
+	mu   sync.RWMutex
 }
 
 func NewPeerStats() *PeerStats {
@@ -52,7 +58,10 @@ func NewPeerStats() *PeerStats {
 			Sent:      make(map[string]uint64),
 			Received:  make(map[string]uint64),
 			Latencies: make(map[string]*Latency),
+			InFlight:  make(map[string]int),
+			Connected: time.Now(),
 		},
+		sent: make(map[string]time.Time),
 	}
 }
 
@@ -72,7 +81,7 @@ func latencyName(msg proto.Message, inbound bool) (string, string) {
 		}
 	case *protocol.TMGetObjectByHash:
 		if (inbound && !v.GetQuery()) || (!inbound && v.GetQuery()) {
-			return "GetObjectByHash", fmt.Sprintf("%d:%d", v.GetSeq(), len(v.GetObjects()))
+			return "GetObjectByHash", strconv.FormatUint(uint64(v.GetSeq()), 10)
 		}
 	}
 	return "", ""
@@ -81,54 +90,102 @@ func latencyName(msg proto.Message, inbound bool) (string, string) {
 func (s *PeerStats) Send(msg proto.Message) {
 	name := shortName(msg)
 	latencyName, latencyId := latencyName(msg, false)
+	now := time.Now()
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.Sent[name]++
 	if latencyName != "" {
-		s.InFlight = latencyName + ":" + latencyId
+		s.expire(now)
+		id := latencyName + ":" + latencyId
+		s.InFlight[id]++
+		s.sent[id] = now
 		if l, ok := s.Latencies[latencyName]; !ok {
 			s.Latencies[latencyName] = &Latency{
-				Last: time.Now(),
+				Last: now,
 				Min:  time.Hour * 24,
 			}
 		} else {
-			l.Last = time.Now()
+			l.Last = now
+		}
+	}
+}
+
+// expire forgets requests which have waited too long for a reply
+func (s *PeerStats) expire(now time.Time) {
+	for id, sent := range s.sent {
+		if now.Sub(sent) > statsRequestTimeout {
+			delete(s.sent, id)
+			delete(s.InFlight, id)
 		}
 	}
 }
 
+// Receive records an inbound message. Replies are Expected while a request
+// with the same id is in flight, even if later requests have been sent
+// since, and Unexpected only when no such request was ever made.
 func (s *PeerStats) Receive(msg proto.Message) MessageStatus {
-	status := PassThrough
 	name := shortName(msg)
 	latencyName, latencyId := latencyName(msg, true)
+	now := time.Now()
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.Received[name]++
-	if latencyName != "" {
-		status = Expected
-		if s.InFlight != latencyName+":"+latencyId {
-			s.Unexpected++
-			status = Unexpected
+	s.LastReceived = now
+	if latencyName == "" {
+		return PassThrough
+	}
+	id := latencyName + ":" + latencyId
+	if s.InFlight[id] == 0 {
+		s.Unexpected++
+		return Unexpected
+	}
+	sent := s.sent[id]
+	if s.InFlight[id]--; s.InFlight[id] == 0 {
+		delete(s.InFlight, id)
+		delete(s.sent, id)
+	}
+	if l, ok := s.Latencies[latencyName]; ok {
+		metrics.GetOrRegisterTimer(latencyName, nil).UpdateSince(sent)
+		diff := now.Sub(sent)
+		l.Total += diff
+		if diff < l.Min {
+			l.Min = diff
 		}
-		s.InFlight = ""
-		// metrics.GetOrRegisterCounter(latencyName, nil).Inc(1)
-		if l, ok := s.Latencies[latencyName]; ok {
-			metrics.GetOrRegisterTimer(latencyName, nil).UpdateSince(l.Last)
-			diff := time.Now().Sub(l.Last)
-			l.Total += diff
-			if diff < l.Min {
-				l.Min = diff
-			}
-			if diff > l.Max {
-				l.Max = diff
-			}
-			l.Count++
-
-		} else {
-			panic(name)
+		if diff > l.Max {
+			l.Max = diff
 		}
+		l.Count++
+	}
+	return Expected
+}
+
+// Idle returns how long it is since anything was received from the peer
+func (s *PeerStats) Idle(now time.Time) time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.LastReceived.IsZero() {
+		return now.Sub(s.Connected)
+	}
+	return now.Sub(s.LastReceived)
+}
+
+// AverageLatency returns the average latency of all requests answered by
+// the peer
+func (s *PeerStats) AverageLatency() time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var (
+		total time.Duration
+		count uint64
+	)
+	for _, l := range s.Latencies {
+		total += l.Total
+		count += l.Count
+	}
+	if count == 0 {
+		return 0
 	}
-	return status
+	return total / time.Duration(count)
 }
 
 func (s *PeerStats) MarshalJSON() ([]byte, error) {
@@ -0,0 +1,39 @@
+package peers
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/donovanhide/ripple/peers/protocol"
+	"testing"
+)
+
+func TestStatsInFlight(t *testing.T) {
+	s := NewPeerStats()
+	s.Send(&protocol.TMGetLedger{LedgerSeq: proto.Uint32(1)})
+	s.Send(&protocol.TMGetObjectByHash{
+		Query:   proto.Bool(true),
+		Seq:     proto.Uint32(2),
+		Objects: make([]*protocol.TMIndexedObject, 3),
+	})
+	s.Send(&protocol.TMGetLedger{LedgerSeq: proto.Uint32(4)})
+	for i, test := range []struct {
+		msg    proto.Message
+		status MessageStatus
+	}{
+		{&protocol.TMLedgerData{LedgerSeq: proto.Uint32(1)}, Expected},
+		{&protocol.TMLedgerData{LedgerSeq: proto.Uint32(1)}, Unexpected},
+		{&protocol.TMGetObjectByHash{Query: proto.Bool(false), Seq: proto.Uint32(2)}, Expected},
+		{&protocol.TMGetObjectByHash{Query: proto.Bool(true), Seq: proto.Uint32(5)}, PassThrough},
+		{&protocol.TMLedgerData{LedgerSeq: proto.Uint32(3)}, Unexpected},
+		{&protocol.TMLedgerData{LedgerSeq: proto.Uint32(4)}, Expected},
+	} {
+		if status := s.Receive(test.msg); status != test.status {
+			t.Errorf("%d: Expected status %d got %d", i, test.status, status)
+		}
+	}
+	if len(s.InFlight) != 0 {
+		t.Errorf("Requests still in flight: %v", s.InFlight)
+	}
+	if s.Unexpected != 2 {
+		t.Errorf("Expected 2 unexpected replies got %d", s.Unexpected)
+	}
+}
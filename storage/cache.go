@@ -0,0 +1,175 @@
+package storage
+
+import (
+	"fmt"
+	"github.com/donovanhide/ripple/data"
+	"github.com/golang/groupcache/lru"
+	metrics "github.com/rcrowley/go-metrics"
+	"sync"
+)
+
+// cacheLoad is a Get of the wrapped DB which concurrent misses wait for. It
+// is stale, and so not cached, if the hash is inserted or deleted meanwhile.
+type cacheLoad struct {
+	wg    sync.WaitGroup
+	node  data.Hashable
+	err   error
+	stale bool
+}
+
+// CachedDB keeps the most recently used nodes of any DB in memory. Hashes
+// which were not found are cached too, until they are inserted. Concurrent
+// misses for the same hash share a single Get of the wrapped DB. Hits,
+// misses and hashes not found are metered in the default go-metrics registry
+// under the name given.
+type CachedDB struct {
+	db       DB
+	cache    *lru.Cache
+	notFound *lru.Cache
+	loading  map[data.Hash256]*cacheLoad
+	hits     metrics.Meter
+	misses   metrics.Meter
+	absent   metrics.Meter
+	mu       sync.Mutex
+}
+
+// NewCachedDB wraps db with caches of size nodes and size hashes not found.
+// A size of 0 means no limit. The result has the methods of a Deleter,
+// Iterable and LedgerIndex, but AsDeleter, AsIterable and AsLedgerIndex
+// only return it as one if db is one.
+func NewCachedDB(name string, db DB, size int) *CachedDB {
+	return &CachedDB{
+		db:       db,
+		cache:    lru.New(size),
+		notFound: lru.New(size),
+		loading:  make(map[data.Hash256]*cacheLoad),
+		hits:     metrics.GetOrRegisterMeter(name+".Hits", nil),
+		misses:   metrics.GetOrRegisterMeter(name+".Misses", nil),
+		absent:   metrics.GetOrRegisterMeter(name+".NotFound", nil),
+	}
+}
+
+func (c *CachedDB) wrapped() DB {
+	return c.db
+}
+
+func (c *CachedDB) Get(hash data.Hash256) (data.Hashable, error) {
+	c.mu.Lock()
+	if cached, ok := c.cache.Get(hash); ok {
+		c.mu.Unlock()
+		c.hits.Mark(1)
+		return cached.(data.Hashable), nil
+	}
+	if _, ok := c.notFound.Get(hash); ok {
+		c.mu.Unlock()
+		c.hits.Mark(1)
+		return nil, ErrNotFound
+	}
+	if load, ok := c.loading[hash]; ok {
+		c.mu.Unlock()
+		load.wg.Wait()
+		c.hits.Mark(1)
+		return load.node, load.err
+	}
+	load := &cacheLoad{}
+	load.wg.Add(1)
+	c.loading[hash] = load
+	c.mu.Unlock()
+
+	c.misses.Mark(1)
+	load.node, load.err = c.db.Get(hash)
+	c.mu.Lock()
+	delete(c.loading, hash)
+	switch {
+	case load.err == ErrNotFound:
+		c.absent.Mark(1)
+		if !load.stale {
+			c.notFound.Add(hash, struct{}{})
+		}
+	case load.err == nil && !load.stale:
+		c.cache.Add(hash, load.node)
+	}
+	c.mu.Unlock()
+	load.wg.Done()
+	return load.node, load.err
+}
+
+func (c *CachedDB) Insert(item data.Hashable) error {
+	if err := c.db.Insert(item); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.invalidate(item.Hash())
+	c.cache.Add(item.Hash(), item)
+	c.mu.Unlock()
+	return nil
+}
+
+// Delete removes a node from the wrapped DB and the cache. It returns
+// ErrNotSupported if the wrapped DB is not a Deleter.
+func (c *CachedDB) Delete(hash data.Hash256) error {
+	deleter, ok := AsDeleter(c.db)
+	if !ok {
+		return ErrNotSupported
+	}
+	if err := deleter.Delete(hash); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.invalidate(hash)
+	c.mu.Unlock()
+	return nil
+}
+
+// Each visits every node of the wrapped DB, bypassing the cache. It returns
+// ErrNotSupported if the wrapped DB is not Iterable.
+func (c *CachedDB) Each(f func(data.Hashable) error) error {
+	iterable, ok := AsIterable(c.db)
+	if !ok {
+		return ErrNotSupported
+	}
+	return iterable.Each(f)
+}
+
+// LedgerHash looks up a ledger in the wrapped DB if it is a LedgerIndex
+func (c *CachedDB) LedgerHash(seq uint32) (data.Hash256, bool) {
+	index, ok := AsLedgerIndex(c.db)
+	if !ok {
+		return data.Hash256{}, false
+	}
+	return index.LedgerHash(seq)
+}
+
+// invalidate forgets a hash. The lock must be held.
+func (c *CachedDB) invalidate(hash data.Hash256) {
+	c.cache.Remove(hash)
+	c.notFound.Remove(hash)
+	if load, ok := c.loading[hash]; ok {
+		load.stale = true
+	}
+}
+
+func (c *CachedDB) Ledger() (*data.LedgerSet, error) {
+	return c.db.Ledger()
+}
+
+func (c *CachedDB) Stats() string {
+	c.mu.Lock()
+	entries, size := c.cache.Len(), c.cache.MaxEntries
+	c.mu.Unlock()
+	hits, misses, absent := c.hits.Snapshot(), c.misses.Snapshot(), c.absent.Snapshot()
+	var hitsPercent, missesPercent float64
+	if total := float64(hits.Count() + misses.Count()); total > 0 {
+		hitsPercent, missesPercent = float64(hits.Count())/total*100, float64(misses.Count())/total*100
+	}
+	occupancy := "unbounded"
+	if size > 0 {
+		occupancy = fmt.Sprintf("%0.02f%% full", float64(entries)/float64(size)*100)
+	}
+	format := "Cache: %d %s Hits: %0.02f%% %d(%.0f/sec) Misses: %0.02f%%  %d(%.0f/sec) Not Found: %d %s"
+	return fmt.Sprintf(format, entries, occupancy, hitsPercent, hits.Count(), hits.RateMean(), missesPercent, misses.Count(), misses.RateMean(), absent.Count(), c.db.Stats())
+}
+
+func (c *CachedDB) Close() {
+	c.db.Close()
+}
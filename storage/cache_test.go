@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"fmt"
+	"github.com/donovanhide/ripple/data"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// slowDB counts the Gets which reach it and makes them slow enough to
+// overlap
+type slowDB struct {
+	*MemoryDB
+	gets int32
+}
+
+func (db *slowDB) Get(hash data.Hash256) (data.Hashable, error) {
+	atomic.AddInt32(&db.gets, 1)
+	time.Sleep(10 * time.Millisecond)
+	return db.MemoryDB.Get(hash)
+}
+
+func TestCachedDB(t *testing.T) {
+	backend := &slowDB{MemoryDB: NewEmptyMemoryDB()}
+	nodes := testNodes(t)
+	for _, node := range nodes[1:] {
+		checkErr(t, backend.Insert(node))
+	}
+	db := NewCachedDB(fmt.Sprintf("Test.%p", backend), backend, 10)
+	checkNodes(t, db, nodes[1:2])
+	checkNodes(t, db, nodes[1:2])
+	if gets := atomic.LoadInt32(&backend.gets); gets != 1 {
+		t.Fatalf("Cached node read again: %d", gets)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := db.Get(nodes[2].Hash()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if gets := atomic.LoadInt32(&backend.gets); gets != 2 {
+		t.Fatalf("Concurrent misses not loaded once: %d", gets)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := db.Get(nodes[0].Hash()); err != ErrNotFound {
+			t.Fatalf("Expected not found: %v", err)
+		}
+	}
+	if gets := atomic.LoadInt32(&backend.gets); gets != 3 {
+		t.Fatalf("Not found not cached: %d", gets)
+	}
+	checkErr(t, db.Insert(nodes[0]))
+	checkNodes(t, db, nodes[:1])
+	deleter, ok := AsDeleter(db)
+	if !ok {
+		t.Fatal("Not a Deleter")
+	}
+	checkErr(t, deleter.Delete(nodes[0].Hash()))
+	if _, err := db.Get(nodes[0].Hash()); err != ErrNotFound {
+		t.Fatalf("Deleted node found: %v", err)
+	}
+	if stats := db.Stats(); !strings.Contains(stats, "Misses: 25.00%") || !strings.Contains(stats, "Not Found: 2") || !strings.HasSuffix(stats, backend.Stats()) {
+		t.Fatalf("Wrong stats: %s", stats)
+	}
+	if _, ok := AsIterable(db); !ok {
+		t.Fatal("Not Iterable")
+	}
+	if _, ok := AsLedgerIndex(db); ok {
+		t.Fatal("Ledger index without one")
+	}
+}
+
+func TestCachedDBCapabilities(t *testing.T) {
+	backend := struct{ DB }{NewEmptyMemoryDB()}
+	db := NewCachedDB(fmt.Sprintf("Test.%p", &backend), backend, 10)
+	if _, ok := AsDeleter(db); ok {
+		t.Error("Deleter without one")
+	}
+	if _, ok := AsIterable(db); ok {
+		t.Error("Iterable without one")
+	}
+	if _, ok := AsLedgerIndex(db); ok {
+		t.Error("Ledger index without one")
+	}
+	if err := db.Delete(data.Hash256{}); err != ErrNotSupported {
+		t.Errorf("Deleted without a Deleter: %v", err)
+	}
+	if err := db.Each(func(data.Hashable) error { return nil }); err != ErrNotSupported {
+		t.Errorf("Iterated without an Iterable: %v", err)
+	}
+	if !strings.Contains(NewCachedDB(fmt.Sprintf("Test.%p", db), backend, 0).Stats(), "unbounded") {
+		t.Error("Unbounded cache has an occupancy")
+	}
+}
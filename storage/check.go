@@ -0,0 +1,230 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/donovanhide/ripple/crypto"
+	"github.com/donovanhide/ripple/data"
+	"io"
+	"sort"
+)
+
+// CheckReport lists the problems found by Check. Affected maps the sequence
+// of each ledger with a corrupt or missing node to the number of them.
+type CheckReport struct {
+	Ledgers   int
+	Nodes     int
+	Corrupt   map[data.Hash256]string
+	Missing   map[data.Hash256]bool
+	Unchained []uint32
+	Affected  map[uint32]int
+}
+
+func (r *CheckReport) OK() bool {
+	return len(r.Corrupt) == 0 && len(r.Missing) == 0 && len(r.Unchained) == 0
+}
+
+func (r *CheckReport) String() string {
+	return fmt.Sprintf("Ledgers: %d Nodes: %d Corrupt: %d Missing: %d Unchained: %d Affected: %d", r.Ledgers, r.Nodes, len(r.Corrupt), len(r.Missing), len(r.Unchained), len(r.Affected))
+}
+
+// WriteTo writes the summary followed by every problem
+func (r *CheckReport) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	fmt.Fprintln(&buf, r.String())
+	for _, hash := range sortedHashes(r.Corrupt) {
+		fmt.Fprintf(&buf, "Corrupt: %s %s\n", hash.String(), r.Corrupt[hash])
+	}
+	missing := make(map[data.Hash256]string, len(r.Missing))
+	for hash := range r.Missing {
+		missing[hash] = ""
+	}
+	for _, hash := range sortedHashes(missing) {
+		fmt.Fprintf(&buf, "Missing: %s\n", hash.String())
+	}
+	for _, seq := range r.Unchained {
+		fmt.Fprintf(&buf, "Unchained: %d\n", seq)
+	}
+	var affected data.LedgerSlice
+	for seq := range r.Affected {
+		affected = append(affected, seq)
+	}
+	for _, seq := range affected.Sorted() {
+		fmt.Fprintf(&buf, "Affected: %d %d\n", seq, r.Affected[seq])
+	}
+	return buf.WriteTo(w)
+}
+
+func sortedHashes(m map[data.Hash256]string) []data.Hash256 {
+	hashes := make([]data.Hash256, 0, len(m))
+	for hash := range m {
+		hashes = append(hashes, hash)
+	}
+	sort.Sort(hashSlice(hashes))
+	return hashes
+}
+
+type hashSlice []data.Hash256
+
+func (s hashSlice) Len() int           { return len(s) }
+func (s hashSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s hashSlice) Less(i, j int) bool { return s[i].Compare(s[j]) < 0 }
+
+// checker remembers the bad nodes below each node walked, so that subtrees
+// shared between ledgers are only checked once
+type checker struct {
+	db     DB
+	report *CheckReport
+	below  map[data.Hash256][]data.Hash256
+}
+
+// Check walks the state and transaction trees of every stored ledger. Each
+// node is hashed again with its hash prefix and compared to its key, the
+// children of inner nodes must be present and of the right type and each
+// header must name the header of the previous ledger, when stored, as its
+// parent. Ledger headers are found by iterating the DB or else through its
+// ledger index.
+func Check(db DB) (*CheckReport, error) {
+	headers, err := ledgerHeaders(db)
+	if err != nil {
+		return nil, err
+	}
+	c := &checker{
+		db: db,
+		report: &CheckReport{
+			Corrupt:  make(map[data.Hash256]string),
+			Missing:  make(map[data.Hash256]bool),
+			Affected: make(map[uint32]int),
+		},
+		below: make(map[data.Hash256][]data.Hash256),
+	}
+	var sequences data.LedgerSlice
+	for seq := range headers {
+		sequences = append(sequences, seq)
+	}
+	for _, seq := range sequences.Sorted() {
+		hash := headers[seq]
+		c.report.Ledgers++
+		bad := c.walk(hash, data.NT_LEDGER)
+		if len(bad) > 0 {
+			c.report.Affected[seq] = len(bad)
+		}
+		if _, ok := c.report.Corrupt[hash]; ok {
+			continue
+		}
+		ledger, err := db.Get(hash)
+		if err != nil {
+			continue
+		}
+		if previous, ok := headers[seq-1]; ok && ledger.(*data.Ledger).PreviousLedger != previous {
+			c.report.Unchained = append(c.report.Unchained, seq)
+		}
+	}
+	return c.report, nil
+}
+
+// ledgerHeaders maps the sequence of every stored ledger to the hash of
+// its header
+func ledgerHeaders(db DB) (map[uint32]data.Hash256, error) {
+	headers := make(map[uint32]data.Hash256)
+	if iterable, ok := AsIterable(db); ok {
+		err := iterable.Each(func(node data.Hashable) error {
+			if ledger, ok := node.(*data.Ledger); ok {
+				headers[ledger.LedgerSequence] = ledger.Hash()
+			}
+			return nil
+		})
+		return headers, err
+	}
+	index, ok := AsLedgerIndex(db)
+	if !ok {
+		return nil, fmt.Errorf("Cannot find ledgers in: %T", db)
+	}
+	ledgers, err := db.Ledger()
+	if err != nil {
+		return nil, err
+	}
+	for seq := uint32(0); seq < ledgers.Max(); seq++ {
+		if hash, ok := index.LedgerHash(seq); ok {
+			headers[seq] = hash
+		}
+	}
+	return headers, nil
+}
+
+// walk returns the corrupt and missing nodes at and below hash
+func (c *checker) walk(hash data.Hash256, typ data.NodeType) []data.Hash256 {
+	if bad, ok := c.below[hash]; ok {
+		return bad
+	}
+	c.report.Nodes++
+	node, err := c.db.Get(hash)
+	switch {
+	case err == ErrNotFound:
+		c.report.Missing[hash] = true
+		c.below[hash] = []data.Hash256{hash}
+		return c.below[hash]
+	case err != nil:
+		return c.corrupt(hash, err.Error())
+	}
+	if err := verifyNode(hash, node, typ); err != nil {
+		return c.corrupt(hash, err.Error())
+	}
+	var bad []data.Hash256
+	switch v := node.(type) {
+	case *data.Ledger:
+		for typ, root := range map[data.NodeType]data.Hash256{
+			data.NT_ACCOUNT_NODE:     v.StateHash,
+			data.NT_TRANSACTION_NODE: v.TransactionHash,
+		} {
+			if !root.IsZero() {
+				bad = append(bad, c.walk(root, typ)...)
+			}
+		}
+	case *data.InnerNode:
+		v.Each(func(_ int, child data.Hash256) error {
+			bad = append(bad, c.walk(child, typ)...)
+			return nil
+		})
+	}
+	c.below[hash] = bad
+	return bad
+}
+
+func (c *checker) corrupt(hash data.Hash256, reason string) []data.Hash256 {
+	c.report.Corrupt[hash] = reason
+	c.below[hash] = []data.Hash256{hash}
+	return c.below[hash]
+}
+
+// verifyNode hashes a node with its hash prefix and checks that it belongs
+// in a tree of the given type
+func verifyNode(hash data.Hash256, node data.Hashable, typ data.NodeType) error {
+	prefix, err := data.NodePrefix(node)
+	if err != nil {
+		return err
+	}
+	h, err := crypto.Sha512Half(prefix)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(h, hash[:]) {
+		return fmt.Errorf("Hash mismatch: %X", h)
+	}
+	var ok bool
+	switch v := node.(type) {
+	case *data.Ledger:
+		ok = typ == data.NT_LEDGER
+	case *data.InnerNode:
+		// rippled stores inner nodes without their tree type
+		ok = v.Type == typ || v.Type == data.NT_UNKNOWN
+	case *data.TransactionWithMetaData:
+		ok = typ == data.NT_TRANSACTION_NODE
+	case data.LedgerEntry:
+		ok = typ == data.NT_ACCOUNT_NODE
+	}
+	if !ok {
+		return fmt.Errorf("Unexpected %s in %s tree", node.GetType(), typ)
+	}
+	return nil
+}
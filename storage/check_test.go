@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"bytes"
+	"github.com/donovanhide/ripple/data"
+	"strings"
+	"testing"
+)
+
+// completeTree returns the nodes of the only complete tree in the fixtures
+func completeTree(t *testing.T) []data.Hashable {
+	mem, err := NewMemoryDB("testdata/mem.gz")
+	checkErr(t, err)
+	root, err := data.NewHash256("76F1C3FF38A714698F08C5975381C6535C6E4FA301A23E64BCFBF1E67E314CFC")
+	checkErr(t, err)
+	var nodes []data.Hashable
+	var walk func(hash data.Hash256) error
+	walk = func(hash data.Hash256) error {
+		node, err := mem.Get(hash)
+		if err != nil {
+			return err
+		}
+		nodes = append(nodes, node)
+		if inner, ok := node.(*data.InnerNode); ok {
+			return inner.Each(func(_ int, child data.Hash256) error {
+				return walk(child)
+			})
+		}
+		return nil
+	}
+	checkErr(t, walk(*root))
+	return nodes
+}
+
+func checkLedger(t *testing.T, db DB, seq uint32, previous, state data.Hash256) *data.Ledger {
+	ledger := data.NewEmptyLedger(seq)
+	ledger.PreviousLedger = previous
+	ledger.StateHash = state
+	checkErr(t, data.NewEncoder().Node(ledger))
+	checkErr(t, db.Insert(ledger))
+	return ledger
+}
+
+func TestCheck(t *testing.T) {
+	db := NewEmptyMemoryDB()
+	tree := completeTree(t)
+	for _, node := range tree {
+		checkErr(t, db.Insert(node))
+	}
+	root := tree[0].Hash()
+	first := checkLedger(t, db, 32600, data.Hash256{}, root)
+	second := checkLedger(t, db, 32601, first.Hash(), root)
+	report, err := Check(db)
+	checkErr(t, err)
+	if !report.OK() || report.Ledgers != 2 || report.Nodes != len(tree)+2 {
+		t.Fatalf("Wrong report: %s", report.String())
+	}
+
+	checkLedger(t, db, 32602, data.Hash256{1}, second.StateHash)
+	leaves := tree[len(tree)-2:]
+	checkErr(t, db.Delete(leaves[0].Hash()))
+	corrupt, err := decodeNode(leaves[1].Hash(), tree[1].Raw())
+	checkErr(t, err)
+	checkErr(t, db.Insert(corrupt))
+	report, err = Check(db)
+	checkErr(t, err)
+	if report.OK() || len(report.Missing) != 1 || !report.Missing[leaves[0].Hash()] {
+		t.Fatalf("Wrong missing: %s", report.String())
+	}
+	if _, ok := report.Corrupt[leaves[1].Hash()]; !ok || len(report.Corrupt) != 1 {
+		t.Fatalf("Wrong corrupt: %s", report.String())
+	}
+	if len(report.Unchained) != 1 || report.Unchained[0] != 32602 {
+		t.Fatalf("Wrong unchained: %v", report.Unchained)
+	}
+	if len(report.Affected) != 3 || report.Affected[32601] != 2 {
+		t.Fatalf("Wrong affected: %v", report.Affected)
+	}
+	var buf bytes.Buffer
+	_, err = report.WriteTo(&buf)
+	checkErr(t, err)
+	if !strings.Contains(buf.String(), "Missing: "+leaves[0].Hash().String()) {
+		t.Fatalf("Wrong report output: %s", buf.String())
+	}
+}
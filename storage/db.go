@@ -5,7 +5,13 @@ import (
 	"github.com/donovanhide/ripple/data"
 )
 
-var ErrNotFound = errors.New("Not found")
+var (
+	ErrNotFound     = errors.New("Not found")
+	ErrNotSupported = errors.New("Not supported")
+)
+
+// firstLedger is the earliest ledger in the network's history
+const firstLedger = 32570
 
 type DB interface {
 	Ledger() (*data.LedgerSet, error)
@@ -22,3 +28,87 @@ type IndexedDB interface {
 	GetLookups(string) ([]LookupItem, error)
 	GetAccount(uint32) *data.Account
 }
+
+// Iterable is a DB which can visit every node it holds
+type Iterable interface {
+	Each(func(data.Hashable) error) error
+}
+
+// LedgerIndex is a DB which can find the header of a ledger by sequence
+type LedgerIndex interface {
+	LedgerHash(seq uint32) (data.Hash256, bool)
+}
+
+// Deleter is a DB from which nodes can be removed
+type Deleter interface {
+	Delete(hash data.Hash256) error
+}
+
+// wrapper is a DB, such as a CachedDB, which has only the capabilities of
+// the DB it wraps
+type wrapper interface {
+	wrapped() DB
+}
+
+func unwrap(db DB) DB {
+	for {
+		w, ok := db.(wrapper)
+		if !ok {
+			return db
+		}
+		db = w.wrapped()
+	}
+}
+
+// AsIterable returns db as an Iterable if it can visit every node
+func AsIterable(db DB) (Iterable, bool) {
+	if _, ok := unwrap(db).(Iterable); !ok {
+		return nil, false
+	}
+	iterable, ok := db.(Iterable)
+	return iterable, ok
+}
+
+// AsLedgerIndex returns db as a LedgerIndex if it can find ledger headers
+func AsLedgerIndex(db DB) (LedgerIndex, bool) {
+	if _, ok := unwrap(db).(LedgerIndex); !ok {
+		return nil, false
+	}
+	index, ok := db.(LedgerIndex)
+	return index, ok
+}
+
+// AsDeleter returns db as a Deleter if nodes can be removed from it
+func AsDeleter(db DB) (Deleter, bool) {
+	if _, ok := unwrap(db).(Deleter); !ok {
+		return nil, false
+	}
+	deleter, ok := db.(Deleter)
+	return deleter, ok
+}
+
+// newLedgerSet returns the set of the sequences from the first ledger onwards
+func newLedgerSet(sequences []uint32) *data.LedgerSet {
+	last := uint32(firstLedger)
+	for _, seq := range sequences {
+		if seq > last {
+			last = seq
+		}
+	}
+	ledgers := data.NewLedgerSet(firstLedger, last+1)
+	for _, seq := range sequences {
+		if seq >= firstLedger {
+			ledgers.Set(seq)
+		}
+	}
+	return ledgers
+}
+
+// ledgerSequences returns the sequences of an index of ledger headers
+func ledgerSequences(ledgers map[uint32]data.Hash256) []uint32 {
+	sequences := make([]uint32, 0, len(ledgers))
+	for seq := range ledgers {
+		sequences = append(sequences, seq)
+	}
+	return sequences
+}
@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/hex"
+	"fmt"
+	"github.com/donovanhide/ripple/data"
+	"io"
+	"strings"
+)
+
+// DumpWriter streams nodes in the gzipped format read by NewMemoryDB, which
+// is one node per line as the hex of its hash and of its prefix format
+// separated by a colon
+type DumpWriter struct {
+	gz    *gzip.Writer
+	w     *bufio.Writer
+	Count int
+}
+
+func NewDumpWriter(w io.Writer) *DumpWriter {
+	gz := gzip.NewWriter(w)
+	return &DumpWriter{
+		gz: gz,
+		w:  bufio.NewWriter(gz),
+	}
+}
+
+func (d *DumpWriter) Write(node data.Hashable) error {
+	value, err := encodeNode(node)
+	if err != nil {
+		return err
+	}
+	hash := node.Hash()
+	if _, err := fmt.Fprintf(d.w, "%X:%X\n", hash[:], value); err != nil {
+		return err
+	}
+	d.Count++
+	return nil
+}
+
+// Close flushes the dump without closing the underlying writer
+func (d *DumpWriter) Close() error {
+	if err := d.w.Flush(); err != nil {
+		return err
+	}
+	return d.gz.Close()
+}
+
+// ExportAll writes every node of a DB which can be iterated
+func ExportAll(db DB, w io.Writer) (int, error) {
+	iterable, ok := AsIterable(db)
+	if !ok {
+		return 0, fmt.Errorf("Cannot iterate: %T", db)
+	}
+	d := NewDumpWriter(w)
+	if err := iterable.Each(d.Write); err != nil {
+		return d.Count, err
+	}
+	return d.Count, d.Close()
+}
+
+// ExportLedgers writes the headers of the given ledgers and every node of
+// their state and transaction trees. Nodes shared between ledgers are only
+// written once.
+func ExportLedgers(db DB, w io.Writer, ledgers []data.Hash256) (int, error) {
+	d := NewDumpWriter(w)
+	seen := make(map[data.Hash256]bool)
+	for _, hash := range ledgers {
+		if err := exportTree(db, d, hash, seen); err != nil {
+			return d.Count, err
+		}
+	}
+	return d.Count, d.Close()
+}
+
+func exportTree(db DB, d *DumpWriter, hash data.Hash256, seen map[data.Hash256]bool) error {
+	if hash.IsZero() || seen[hash] {
+		return nil
+	}
+	seen[hash] = true
+	node, err := db.Get(hash)
+	if err != nil {
+		return fmt.Errorf("Missing node: %s: %s", hash.String(), err.Error())
+	}
+	if err := d.Write(node); err != nil {
+		return err
+	}
+	switch v := node.(type) {
+	case *data.Ledger:
+		if err := exportTree(db, d, v.StateHash, seen); err != nil {
+			return err
+		}
+		return exportTree(db, d, v.TransactionHash, seen)
+	case *data.InnerNode:
+		return v.Each(func(_ int, child data.Hash256) error {
+			return exportTree(db, d, child, seen)
+		})
+	}
+	return nil
+}
+
+// Import inserts every node of a dump into a DB
+func Import(db DB, r io.Reader) (int, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, err
+	}
+	defer gz.Close()
+	br := bufio.NewReader(gz)
+	var count int
+	for line := 1; ; line++ {
+		s, err := br.ReadString('\n')
+		if err == io.EOF && s == "" {
+			return count, nil
+		}
+		if err != nil && err != io.EOF {
+			return count, err
+		}
+		node, err := parseDumpLine(strings.TrimSpace(s))
+		if err != nil {
+			return count, fmt.Errorf("Line %d: %s", line, err.Error())
+		}
+		if err := db.Insert(node); err != nil {
+			return count, err
+		}
+		count++
+	}
+}
+
+func parseDumpLine(s string) (data.Hashable, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Bad dump line")
+	}
+	var hash data.Hash256
+	if len(parts[0]) != hex.EncodedLen(len(hash)) {
+		return nil, fmt.Errorf("Bad hash: %s", parts[0])
+	}
+	if _, err := hex.Decode(hash[:], []byte(parts[0])); err != nil {
+		return nil, err
+	}
+	value, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	return decodeNode(hash, value)
+}
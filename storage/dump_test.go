@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"bytes"
+	"github.com/donovanhide/ripple/data"
+	"os"
+	"testing"
+)
+
+func TestDumpRoundTrip(t *testing.T) {
+	mem, err := NewMemoryDB("testdata/mem.gz")
+	checkErr(t, err)
+	nodes := testNodes(t)
+	var buf bytes.Buffer
+	count, err := ExportAll(mem, &buf)
+	checkErr(t, err)
+	if count != len(nodes) {
+		t.Fatalf("Wrong export count: %d expected: %d", count, len(nodes))
+	}
+	db, dir := newTestLogDB(t)
+	defer os.RemoveAll(dir)
+	defer db.Close()
+	count, err = Import(db, &buf)
+	checkErr(t, err)
+	if count != len(nodes) {
+		t.Fatalf("Wrong import count: %d expected: %d", count, len(nodes))
+	}
+	checkNodes(t, db, nodes)
+	buf.Reset()
+	count, err = ExportAll(db, &buf)
+	checkErr(t, err)
+	if count != len(nodes) {
+		t.Fatalf("Wrong LogDB export count: %d", count)
+	}
+	if _, err := ExportAll(struct{ DB }{db}, &buf); err == nil {
+		t.Fatal("Exported a DB which cannot be iterated")
+	}
+}
+
+func TestDumpLedgers(t *testing.T) {
+	mem := NewEmptyMemoryDB()
+	nodes := testNodes(t)
+	for _, node := range nodes {
+		checkErr(t, mem.Insert(node))
+	}
+	// The only complete tree in the fixtures
+	state, err := data.NewHash256("76F1C3FF38A714698F08C5975381C6535C6E4FA301A23E64BCFBF1E67E314CFC")
+	checkErr(t, err)
+	ledger := data.NewEmptyLedger(32600)
+	ledger.StateHash = *state
+	checkErr(t, data.NewEncoder().Node(ledger))
+	checkErr(t, mem.Insert(ledger))
+	var buf bytes.Buffer
+	count, err := ExportLedgers(mem, &buf, []data.Hash256{ledger.Hash(), ledger.Hash()})
+	checkErr(t, err)
+	imported := NewEmptyMemoryDB()
+	_, err = Import(imported, &buf)
+	checkErr(t, err)
+	var exported []data.Hashable
+	checkErr(t, imported.Each(func(node data.Hashable) error {
+		exported = append(exported, node)
+		return nil
+	}))
+	if len(exported) != count || count < 3 {
+		t.Fatalf("Wrong export count: %d imported: %d", count, len(exported))
+	}
+	checkNodes(t, mem, exported)
+	checkNodes(t, imported, []data.Hashable{ledger})
+	for _, node := range exported {
+		if inner, ok := node.(*data.InnerNode); ok {
+			checkErr(t, inner.Each(func(_ int, child data.Hash256) error {
+				_, err := imported.Get(child)
+				return err
+			}))
+		}
+	}
+	broken := data.NewEmptyLedger(32601)
+	broken.StateHash = data.Hash256{1}
+	checkErr(t, data.NewEncoder().Node(broken))
+	checkErr(t, mem.Insert(broken))
+	if _, err := ExportLedgers(mem, &buf, []data.Hash256{broken.Hash()}); err == nil {
+		t.Fatal("Exported a ledger with a missing state tree")
+	}
+}
@@ -0,0 +1,350 @@
+package storage
+
+import (
+	"compress/gzip"
+	"encoding/gob"
+	"fmt"
+	"github.com/donovanhide/ripple/data"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// lookupTables maps the names used by the lookups to insert an item to the
+// names used to get them all
+var lookupTables = map[string]string{
+	"InsertAccount":    "GetAccounts",
+	"InsertRegularKey": "GetRegularKeys",
+	"InsertPublicKey":  "GetPublicKeys",
+	"InsertCurrency":   "GetCurrencies",
+}
+
+// MemoryIndexedDB is a MemoryDB which also indexes transactions by the
+// accounts they affect, their ledger sequence and their type
+type MemoryIndexedDB struct {
+	*MemoryDB
+	accounts  *AccountLookup
+	lookups   map[string][]LookupItem
+	byAccount map[uint32][]*data.TransactionWithMetaData
+	byLedger  map[uint32][]*data.TransactionWithMetaData
+	byType    map[data.TransactionType][]*data.TransactionWithMetaData
+	mu        sync.RWMutex
+}
+
+func NewMemoryIndexedDB() (*MemoryIndexedDB, error) {
+	return newMemoryIndexedDB(make(map[string][]LookupItem))
+}
+
+func newMemoryIndexedDB(lookups map[string][]LookupItem) (*MemoryIndexedDB, error) {
+	db := &MemoryIndexedDB{
+		MemoryDB:  NewEmptyMemoryDB(),
+		lookups:   lookups,
+		byAccount: make(map[uint32][]*data.TransactionWithMetaData),
+		byLedger:  make(map[uint32][]*data.TransactionWithMetaData),
+		byType:    make(map[data.TransactionType][]*data.TransactionWithMetaData),
+	}
+	var err error
+	if db.accounts, err = NewAddressLookup(db); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Insert stores a node and indexes it if it is a transaction
+func (db *MemoryIndexedDB) Insert(item data.Hashable) error {
+	if _, err := db.MemoryDB.Get(item.Hash()); err == nil {
+		return nil
+	}
+	if err := db.MemoryDB.Insert(item); err != nil {
+		return err
+	}
+	tx, ok := item.(*data.TransactionWithMetaData)
+	if !ok {
+		return nil
+	}
+	var ids []uint32
+	for _, account := range affectedAccounts(tx) {
+		id, err := db.accounts.Lookup(&account)
+		if err != nil {
+			return err
+		}
+		ids = append(ids, id)
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, id := range ids {
+		db.byAccount[id] = append(db.byAccount[id], tx)
+	}
+	db.byLedger[tx.LedgerSequence] = append(db.byLedger[tx.LedgerSequence], tx)
+	db.byType[tx.GetTransactionType()] = append(db.byType[tx.GetTransactionType()], tx)
+	return nil
+}
+
+// affectedAccounts returns the sender of a transaction and every account
+// whose root was created, modified or deleted by it
+func affectedAccounts(tx *data.TransactionWithMetaData) []data.Account {
+	seen := map[data.Account]bool{tx.GetBase().Account: true}
+	accounts := []data.Account{tx.GetBase().Account}
+	for _, effect := range tx.MetaData.AffectedNodes {
+		for _, node := range []*data.AffectedNode{effect.CreatedNode, effect.ModifiedNode, effect.DeletedNode} {
+			if node == nil || node.LedgerEntryType != data.ACCOUNT_ROOT {
+				continue
+			}
+			for _, fields := range []interface{}{node.FinalFields, node.NewFields} {
+				if root, ok := fields.(*data.AccountRootFields); ok && root.Account != nil && !seen[*root.Account] {
+					seen[*root.Account] = true
+					accounts = append(accounts, *root.Account)
+				}
+			}
+		}
+	}
+	return accounts
+}
+
+// Query returns the transactions matching the ledger range, account and,
+// if Instance is a transaction, its type. Order takes field names, which may
+// be followed by ASC or DESC, and defaults to ledger sequence and then
+// transaction index.
+func (db *MemoryIndexedDB) Query(q *data.Query) ([]data.Hashable, error) {
+	var typ *data.TransactionType
+	if q.Instance != nil {
+		tx, ok := q.Instance.(data.Transaction)
+		if !ok {
+			return nil, fmt.Errorf("Unsupported query instance: %T", q.Instance)
+		}
+		t := tx.GetTransactionType()
+		typ = &t
+	}
+	less, err := queryOrder(q.Order)
+	if err != nil {
+		return nil, err
+	}
+	min, max := uint64(0), uint64(^uint32(0))
+	if q.MinLedger != nil {
+		min = *q.MinLedger
+	}
+	if q.MaxLedger != nil {
+		max = *q.MaxLedger
+	}
+	var account *uint32
+	if q.Account != nil {
+		id, ok := db.accounts.find(*q.Account)
+		if !ok {
+			return nil, nil
+		}
+		account = &id
+	}
+	db.mu.RLock()
+	var candidates []*data.TransactionWithMetaData
+	switch {
+	case account != nil:
+		candidates = db.byAccount[*account]
+	case typ != nil:
+		candidates = db.byType[*typ]
+	default:
+		for seq, txs := range db.byLedger {
+			if uint64(seq) >= min && uint64(seq) <= max {
+				candidates = append(candidates, txs...)
+			}
+		}
+	}
+	var matched []*data.TransactionWithMetaData
+	for _, tx := range candidates {
+		seq := uint64(tx.LedgerSequence)
+		if seq < min || seq > max || (typ != nil && tx.GetTransactionType() != *typ) {
+			continue
+		}
+		matched = append(matched, tx)
+	}
+	db.mu.RUnlock()
+	sort.Sort(transactionSorter{matched, less})
+	if q.Limit != nil && uint64(len(matched)) > *q.Limit {
+		matched = matched[:*q.Limit]
+	}
+	results := make([]data.Hashable, len(matched))
+	for i, tx := range matched {
+		results[i] = tx
+	}
+	return results, nil
+}
+
+type transactionCompare func(a, b *data.TransactionWithMetaData) int
+
+var transactionFields = map[string]transactionCompare{
+	"LedgerSequence": func(a, b *data.TransactionWithMetaData) int {
+		return compareUint32(a.LedgerSequence, b.LedgerSequence)
+	},
+	"TransactionIndex": func(a, b *data.TransactionWithMetaData) int {
+		return compareUint32(a.MetaData.TransactionIndex, b.MetaData.TransactionIndex)
+	},
+}
+
+func compareUint32(a, b uint32) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// queryOrder returns a comparison of transactions in the order given
+func queryOrder(order []string) (func(a, b *data.TransactionWithMetaData) bool, error) {
+	if len(order) == 0 {
+		order = []string{"LedgerSequence", "TransactionIndex"}
+	}
+	var fields []transactionCompare
+	for _, o := range order {
+		parts := strings.Fields(o)
+		if len(parts) == 0 || len(parts) > 2 {
+			return nil, fmt.Errorf("Bad order: %s", o)
+		}
+		compare, ok := transactionFields[parts[0]]
+		if !ok {
+			return nil, fmt.Errorf("Unknown order field: %s", parts[0])
+		}
+		if len(parts) == 2 {
+			switch strings.ToUpper(parts[1]) {
+			case "ASC":
+			case "DESC":
+				ascending := compare
+				compare = func(a, b *data.TransactionWithMetaData) int { return -ascending(a, b) }
+			default:
+				return nil, fmt.Errorf("Bad order direction: %s", o)
+			}
+		}
+		fields = append(fields, compare)
+	}
+	return func(a, b *data.TransactionWithMetaData) bool {
+		for _, compare := range fields {
+			if c := compare(a, b); c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	}, nil
+}
+
+type transactionSorter struct {
+	txs  []*data.TransactionWithMetaData
+	less func(a, b *data.TransactionWithMetaData) bool
+}
+
+func (s transactionSorter) Len() int           { return len(s.txs) }
+func (s transactionSorter) Swap(i, j int)      { s.txs[i], s.txs[j] = s.txs[j], s.txs[i] }
+func (s transactionSorter) Less(i, j int) bool { return s.less(s.txs[i], s.txs[j]) }
+
+func (db *MemoryIndexedDB) InsertLookup(name string, item *LookupItem) error {
+	table, ok := lookupTables[name]
+	if !ok {
+		return fmt.Errorf("Unknown lookup: %s", name)
+	}
+	db.mu.Lock()
+	db.lookups[table] = append(db.lookups[table], *item)
+	db.mu.Unlock()
+	return nil
+}
+
+func (db *MemoryIndexedDB) GetLookups(name string) ([]LookupItem, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return append([]LookupItem(nil), db.lookups[name]...), nil
+}
+
+func (db *MemoryIndexedDB) GetAccount(id uint32) *data.Account {
+	return db.accounts.Get(id)
+}
+
+func (db *MemoryIndexedDB) Stats() string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return fmt.Sprintf("%s Accounts:%d Ledgers:%d", db.MemoryDB.Stats(), len(db.byAccount), len(db.byLedger))
+}
+
+// indexedSnapshot is the gob encoded content of a snapshot. Nodes are in the
+// prefix format and the indexes are rebuilt on restore.
+type indexedSnapshot struct {
+	Nodes   map[data.Hash256][]byte
+	Lookups map[string][]LookupItem
+}
+
+// Snapshot writes the nodes and lookups to a gzipped file at path
+func (db *MemoryIndexedDB) Snapshot(path string) error {
+	snapshot := indexedSnapshot{
+		Nodes: make(map[data.Hash256][]byte),
+	}
+	db.MemoryDB.mu.RLock()
+	for hash, node := range db.nodes {
+		value, err := encodeNode(node)
+		if err != nil {
+			db.MemoryDB.mu.RUnlock()
+			return fmt.Errorf("Snapshot: %s: %s", hash.String(), err.Error())
+		}
+		snapshot.Nodes[hash] = value
+	}
+	db.MemoryDB.mu.RUnlock()
+	db.mu.RLock()
+	snapshot.Lookups = db.lookups
+	err := writeSnapshot(path, &snapshot)
+	db.mu.RUnlock()
+	return err
+}
+
+func writeSnapshot(path string, snapshot *indexedSnapshot) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := gzip.NewWriter(f)
+	if err := gob.NewEncoder(w).Encode(snapshot); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// RestoreMemoryIndexedDB reads a snapshot and rebuilds the indexes
+func RestoreMemoryIndexedDB(path string) (*MemoryIndexedDB, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	var snapshot indexedSnapshot
+	if err := gob.NewDecoder(r).Decode(&snapshot); err != nil {
+		return nil, err
+	}
+	if snapshot.Lookups == nil {
+		snapshot.Lookups = make(map[string][]LookupItem)
+	}
+	db, err := newMemoryIndexedDB(snapshot.Lookups)
+	if err != nil {
+		return nil, err
+	}
+	for hash, value := range snapshot.Nodes {
+		node, err := decodeNode(hash, value)
+		if err != nil {
+			return nil, err
+		}
+		if err := db.Insert(node); err != nil {
+			return nil, err
+		}
+	}
+	return db, nil
+}
@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"encoding/binary"
+	"github.com/donovanhide/ripple/data"
+	internal "github.com/donovanhide/ripple/testing"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testTransactions(t *testing.T) []*data.TransactionWithMetaData {
+	var txs []*data.TransactionWithMetaData
+	for _, test := range internal.MatchingNodes {
+		b := test.Bytes()
+		node, err := data.NewNodeFromPrefix(b[9:], data.NT_TRANSACTION_NODE, binary.BigEndian.Uint32(b[:4]))
+		checkErr(t, err)
+		txs = append(txs, node.(*data.TransactionWithMetaData))
+	}
+	return txs
+}
+
+func checkQuery(t *testing.T, db IndexedDB, q *data.Query, match func(*data.TransactionWithMetaData) bool, txs []*data.TransactionWithMetaData) []data.Hashable {
+	results, err := db.Query(q)
+	checkErr(t, err)
+	var expected int
+	for _, tx := range txs {
+		if match(tx) {
+			expected++
+		}
+	}
+	if q.Limit != nil && uint64(expected) > *q.Limit {
+		expected = int(*q.Limit)
+	}
+	if len(results) != expected {
+		t.Fatalf("Wrong results: %d expected: %d", len(results), expected)
+	}
+	for i, result := range results {
+		tx := result.(*data.TransactionWithMetaData)
+		if !match(tx) {
+			t.Fatalf("Unexpected result: %s", tx.Hash().String())
+		}
+		if i > 0 && results[i-1].(*data.TransactionWithMetaData).LedgerSequence > tx.LedgerSequence {
+			t.Fatal("Results not ordered")
+		}
+	}
+	return results
+}
+
+func TestMemoryIndexedDB(t *testing.T) {
+	db, err := NewMemoryIndexedDB()
+	checkErr(t, err)
+	txs := testTransactions(t)
+	for _, tx := range txs {
+		checkErr(t, db.Insert(tx))
+	}
+	checkErr(t, db.Insert(txs[0]))
+	account := txs[0].GetBase().Account
+	affects := func(tx *data.TransactionWithMetaData) bool {
+		for _, a := range affectedAccounts(tx) {
+			if a == account {
+				return true
+			}
+		}
+		return false
+	}
+	results := checkQuery(t, db, &data.Query{Account: &account}, affects, txs)
+	min, max, limit := uint64(0x3393BE), uint64(0x3393C0), uint64(2)
+	inRange := func(tx *data.TransactionWithMetaData) bool {
+		return uint64(tx.LedgerSequence) >= min && uint64(tx.LedgerSequence) <= max
+	}
+	checkQuery(t, db, &data.Query{MinLedger: &min, MaxLedger: &max}, inRange, txs)
+	checkQuery(t, db, &data.Query{MinLedger: &min, MaxLedger: &max, Limit: &limit}, inRange, txs)
+	typ := txs[0].GetTransactionType()
+	checkQuery(t, db, &data.Query{Instance: txs[0].Transaction}, func(tx *data.TransactionWithMetaData) bool {
+		return tx.GetTransactionType() == typ
+	}, txs)
+	descending, err := db.Query(&data.Query{Order: []string{"LedgerSequence DESC", "TransactionIndex"}})
+	checkErr(t, err)
+	if len(descending) != len(txs) || descending[0].(*data.TransactionWithMetaData).LedgerSequence != 0x3CBB64 {
+		t.Fatalf("Wrong descending order: %d", len(descending))
+	}
+	if _, err := db.Query(&data.Query{Order: []string{"Fee"}}); err == nil {
+		t.Fatal("Unknown order accepted")
+	}
+	id, ok := db.accounts.find(account)
+	if !ok || *db.GetAccount(id) != account {
+		t.Fatal("Account not looked up")
+	}
+	currencies, err := NewCurrencyLookup(db)
+	checkErr(t, err)
+	usd, err := data.NewCurrency("USD")
+	checkErr(t, err)
+	usdId, err := currencies.Lookup(&usd)
+	checkErr(t, err)
+
+	dir, err := ioutil.TempDir("", "indexed")
+	checkErr(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "snapshot.gz")
+	checkErr(t, db.Snapshot(path))
+	restored, err := RestoreMemoryIndexedDB(path)
+	checkErr(t, err)
+	restoredResults := checkQuery(t, restored, &data.Query{Account: &account}, affects, txs)
+	for i := range results {
+		if results[i].Hash() != restoredResults[i].Hash() {
+			t.Fatalf("Wrong restored result: %s", restoredResults[i].Hash().String())
+		}
+	}
+	if restoredId, _ := restored.accounts.find(account); restoredId != id {
+		t.Fatalf("Account id changed: %d %d", id, restoredId)
+	}
+	restoredCurrencies, err := NewCurrencyLookup(restored)
+	checkErr(t, err)
+	if c := restoredCurrencies.Get(usdId); c == nil || *c != usd {
+		t.Fatal("Currency lookup not restored")
+	}
+}
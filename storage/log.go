@@ -0,0 +1,557 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/donovanhide/ripple/data"
+	"github.com/golang/glog"
+	"github.com/golang/groupcache/lru"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	logFile          = "nodes.log"
+	logIndexFile     = "nodes.idx"
+	logIndexMagic    = "RLIX"
+	logIndexVersion  = 1
+	logHeaderSize    = 4 + 4 + 32 // crc, value length, hash
+	logEntrySize     = 32 + 8 + 4 + 1 + 4
+	logBufferSize    = 1 << 20
+	logFlushInterval = time.Second
+	logCacheSize     = 100000
+	logMaxValue      = 1 << 24
+)
+
+// logEntry is the position of a value in the log along with enough of its
+// header to rebuild the set of stored ledgers
+type logEntry struct {
+	offset   int64
+	length   uint32
+	typ      data.NodeType
+	sequence uint32
+}
+
+// LogDB is an append-only log of nodes keyed by hash. Each record is
+// checksummed, so a record torn by a crash is found and truncated when the
+// log is next opened. The index of the log is held in memory and written to
+// disk on Close, after which only records appended since need to be read on
+// opening. Inserts are buffered and flushed every second, on Sync or when a
+// buffered node is read. Deletes append a tombstone and the space is
+// reclaimed by Compact.
+type LogDB struct {
+	path    string
+	file    *os.File
+	writer  *bufio.Writer
+	size    int64 // including buffered records
+	flushed int64
+	garbage int64
+	index   map[data.Hash256]logEntry
+	ledgers map[uint32]data.Hash256
+	cache   *lru.Cache
+	quit    chan struct{}
+	mu      sync.Mutex
+}
+
+// NewLogDB opens or creates a log in the directory at path
+func NewLogDB(path string) (*LogDB, error) {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, err
+	}
+	db := &LogDB{
+		path:  path,
+		cache: lru.New(logCacheSize),
+		quit:  make(chan struct{}),
+	}
+	if err := db.open(); err != nil {
+		return nil, err
+	}
+	go db.flusher()
+	return db, nil
+}
+
+func (db *LogDB) open() error {
+	file, err := os.OpenFile(filepath.Join(db.path, logFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	db.file = file
+	db.reset()
+	if err := db.readIndex(); err != nil {
+		glog.Warningf("LogDB: Rebuilding index: %s", err.Error())
+		db.reset()
+	}
+	// The index is removed so that a crash before the next Close replays
+	// the log instead of trusting an index which is missing later deletes
+	os.Remove(filepath.Join(db.path, logIndexFile))
+	if err := db.recover(); err != nil {
+		file.Close()
+		return err
+	}
+	if _, err := file.Seek(db.size, 0); err != nil {
+		file.Close()
+		return err
+	}
+	db.flushed = db.size
+	db.writer = bufio.NewWriterSize(file, logBufferSize)
+	return nil
+}
+
+// reset empties the index so that the whole log is replayed
+func (db *LogDB) reset() {
+	db.index = make(map[data.Hash256]logEntry)
+	db.ledgers = make(map[uint32]data.Hash256)
+	db.size, db.garbage = 0, 0
+}
+
+// recover reads the records after the end of the index and truncates the log
+// at the first incomplete or corrupt record
+func (db *LogDB) recover() error {
+	info, err := db.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < db.size {
+		glog.Warningf("LogDB: Rebuilding index: Log shorter than index: %d < %d", info.Size(), db.size)
+		db.reset()
+	}
+	r := bufio.NewReaderSize(io.NewSectionReader(db.file, db.size, info.Size()-db.size), logBufferSize)
+	var records int
+	for db.size < info.Size() {
+		hash, value, err := readRecord(r)
+		if err != nil {
+			glog.Warningf("LogDB: Truncating log at %d of %d: %s", db.size, info.Size(), err.Error())
+			return db.file.Truncate(db.size)
+		}
+		db.apply(hash, value, db.size)
+		db.size += int64(logHeaderSize + len(value))
+		records++
+	}
+	if records > 0 {
+		glog.Infof("LogDB: Recovered %d records", records)
+	}
+	return nil
+}
+
+// apply updates the index with a record at offset. The lock must be held.
+func (db *LogDB) apply(hash data.Hash256, value []byte, offset int64) {
+	if existing, ok := db.index[hash]; ok {
+		db.garbage += int64(logHeaderSize) + int64(existing.length)
+		db.remove(hash, existing)
+	}
+	if len(value) == 0 {
+		db.garbage += logHeaderSize
+		return
+	}
+	entry := logEntry{offset: offset, length: uint32(len(value))}
+	if len(value) > 9 {
+		entry.sequence = binary.BigEndian.Uint32(value[:4])
+		entry.typ = data.NodeType(value[8])
+	}
+	db.index[hash] = entry
+	if entry.typ == data.NT_LEDGER {
+		db.ledgers[entry.sequence] = hash
+	}
+}
+
+func (db *LogDB) remove(hash data.Hash256, entry logEntry) {
+	delete(db.index, hash)
+	if entry.typ == data.NT_LEDGER && db.ledgers[entry.sequence] == hash {
+		delete(db.ledgers, entry.sequence)
+	}
+}
+
+func readRecord(r io.Reader) (data.Hash256, []byte, error) {
+	var (
+		header [logHeaderSize]byte
+		hash   data.Hash256
+	)
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return hash, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[4:8])
+	if length > logMaxValue {
+		return hash, nil, fmt.Errorf("Bad record length: %d", length)
+	}
+	value := make([]byte, length)
+	if _, err := io.ReadFull(r, value); err != nil {
+		return hash, nil, err
+	}
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(value)
+	if crc.Sum32() != binary.BigEndian.Uint32(header[:4]) {
+		return hash, nil, fmt.Errorf("Bad record checksum")
+	}
+	copy(hash[:], header[8:])
+	return hash, value, nil
+}
+
+// append writes a record to the buffer. The lock must be held.
+func (db *LogDB) append(hash data.Hash256, value []byte) error {
+	var header [logHeaderSize]byte
+	binary.BigEndian.PutUint32(header[4:8], uint32(len(value)))
+	copy(header[8:], hash[:])
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(value)
+	binary.BigEndian.PutUint32(header[:4], crc.Sum32())
+	if _, err := db.writer.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := db.writer.Write(value); err != nil {
+		return err
+	}
+	db.apply(hash, value, db.size)
+	db.size += int64(logHeaderSize + len(value))
+	return nil
+}
+
+func (db *LogDB) Get(hash data.Hash256) (data.Hashable, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if cached, ok := db.cache.Get(hash); ok {
+		return cached.(data.Hashable), nil
+	}
+	entry, ok := db.index[hash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if entry.offset >= db.flushed {
+		if err := db.flush(); err != nil {
+			return nil, err
+		}
+	}
+	value := make([]byte, entry.length)
+	if _, err := db.file.ReadAt(value, entry.offset+logHeaderSize); err != nil {
+		return nil, err
+	}
+	node, err := decodeNode(hash, value)
+	if err != nil {
+		return nil, err
+	}
+	db.cache.Add(hash, node)
+	return node, nil
+}
+
+// decodeNode reads a value in the prefix format
+func decodeNode(hash data.Hash256, value []byte) (data.Hashable, error) {
+	node, err := data.NewDecoder(bytes.NewReader(value)).Prefix()
+	if err != nil {
+		return nil, fmt.Errorf("Bad node: %s: %s", hash.String(), err.Error())
+	}
+	if tx, ok := node.(*data.TransactionWithMetaData); ok {
+		tx.LedgerSequence = binary.BigEndian.Uint32(value[:4])
+	}
+	node.SetHash(hash[:])
+	node.SetRaw(value)
+	return node, nil
+}
+
+// encodeNode returns the prefix format of a node
+func encodeNode(item data.Hashable) ([]byte, error) {
+	if raw := item.Raw(); len(raw) > 9 {
+		return raw, nil
+	}
+	if err := data.NewEncoder().Node(item); err != nil {
+		return nil, err
+	}
+	return item.Raw(), nil
+}
+
+// Insert buffers a node, which is ignored if already stored
+func (db *LogDB) Insert(item data.Hashable) error {
+	return db.InsertBatch([]data.Hashable{item})
+}
+
+// InsertBatch buffers several nodes with a single acquisition of the lock
+func (db *LogDB) InsertBatch(items []data.Hashable) error {
+	values := make([][]byte, len(items))
+	for i, item := range items {
+		if item.Hash().IsZero() {
+			return fmt.Errorf("Cannot insert unhashed item")
+		}
+		var err error
+		if values[i], err = encodeNode(item); err != nil {
+			return err
+		}
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for i, item := range items {
+		if _, ok := db.index[item.Hash()]; ok {
+			continue
+		}
+		if err := db.append(item.Hash(), values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete appends a tombstone for a node
+func (db *LogDB) Delete(hash data.Hash256) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.index[hash]; !ok {
+		return nil
+	}
+	db.cache.Remove(hash)
+	return db.append(hash, nil)
+}
+
+// Ledger returns the set of ledgers whose headers are stored. Headers are
+// only inserted once the whole ledger has been.
+func (db *LogDB) Ledger() (*data.LedgerSet, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return newLedgerSet(ledgerSequences(db.ledgers)), nil
+}
+
+// LedgerHash returns the hash of a stored ledger header
+func (db *LogDB) LedgerHash(seq uint32) (data.Hash256, bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	hash, ok := db.ledgers[seq]
+	return hash, ok
+}
+
+// flush writes the buffer to the log. The lock must be held.
+func (db *LogDB) flush() error {
+	if err := db.writer.Flush(); err != nil {
+		return err
+	}
+	db.flushed = db.size
+	return nil
+}
+
+// Sync flushes the buffer and waits for the log to reach the disk
+func (db *LogDB) Sync() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.flush(); err != nil {
+		return err
+	}
+	return db.file.Sync()
+}
+
+func (db *LogDB) flusher() {
+	tick := time.NewTicker(logFlushInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			if err := db.Sync(); err != nil {
+				glog.Errorf("LogDB: Sync: %s", err.Error())
+			}
+		case <-db.quit:
+			return
+		}
+	}
+}
+
+// writeIndex saves the index covering the whole log. The lock must be held
+// and the buffer flushed.
+func (db *LogDB) writeIndex() error {
+	tmp := filepath.Join(db.path, logIndexFile+".tmp")
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	crc := crc32.NewIEEE()
+	w := bufio.NewWriter(io.MultiWriter(file, crc))
+	header := []interface{}{[]byte(logIndexMagic), uint32(logIndexVersion), db.size, db.garbage, uint64(len(db.index))}
+	for _, v := range header {
+		binary.Write(w, binary.BigEndian, v)
+	}
+	var entry [logEntrySize]byte
+	for hash, e := range db.index {
+		copy(entry[:32], hash[:])
+		binary.BigEndian.PutUint64(entry[32:40], uint64(e.offset))
+		binary.BigEndian.PutUint32(entry[40:44], e.length)
+		entry[44] = byte(e.typ)
+		binary.BigEndian.PutUint32(entry[45:49], e.sequence)
+		w.Write(entry[:])
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := binary.Write(file, binary.BigEndian, crc.Sum32()); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(db.path, logIndexFile))
+}
+
+// readIndex loads the index, which covers the log up to the size it records
+func (db *LogDB) readIndex() error {
+	b, err := ioutil.ReadFile(filepath.Join(db.path, logIndexFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	const headerSize = 4 + 4 + 8 + 8 + 8
+	if len(b) < headerSize+4 {
+		return fmt.Errorf("Short index: %d bytes", len(b))
+	}
+	body := b[:len(b)-4]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(b[len(b)-4:]) {
+		return fmt.Errorf("Bad index checksum")
+	}
+	if string(body[:4]) != logIndexMagic || binary.BigEndian.Uint32(body[4:8]) != logIndexVersion {
+		return fmt.Errorf("Unknown index format")
+	}
+	size, garbage := int64(binary.BigEndian.Uint64(body[8:16])), int64(binary.BigEndian.Uint64(body[16:24]))
+	count := binary.BigEndian.Uint64(body[24:32])
+	entries := body[headerSize:]
+	if uint64(len(entries)) != count*logEntrySize {
+		return fmt.Errorf("Bad index length: %d entries: %d", len(entries), count)
+	}
+	for ; len(entries) > 0; entries = entries[logEntrySize:] {
+		var hash data.Hash256
+		copy(hash[:], entries[:32])
+		entry := logEntry{
+			offset:   int64(binary.BigEndian.Uint64(entries[32:40])),
+			length:   binary.BigEndian.Uint32(entries[40:44]),
+			typ:      data.NodeType(entries[44]),
+			sequence: binary.BigEndian.Uint32(entries[45:49]),
+		}
+		db.index[hash] = entry
+		if entry.typ == data.NT_LEDGER {
+			db.ledgers[entry.sequence] = hash
+		}
+	}
+	db.size, db.garbage = size, garbage
+	return nil
+}
+
+// Compact rewrites the log without deleted and replaced records
+func (db *LogDB) Compact() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.flush(); err != nil {
+		return err
+	}
+	start, before := time.Now(), db.size
+	tmp := filepath.Join(db.path, logFile+".compact")
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriterSize(file, logBufferSize)
+	var offset int64
+	for _, e := range db.sorted() {
+		record := make([]byte, logHeaderSize+int(e.length))
+		if _, err := db.file.ReadAt(record, e.offset); err != nil {
+			file.Close()
+			os.Remove(tmp)
+			return err
+		}
+		if _, err := w.Write(record); err != nil {
+			file.Close()
+			os.Remove(tmp)
+			return err
+		}
+		offset += int64(len(record))
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	file.Close()
+	db.file.Close()
+	if err := os.Rename(tmp, filepath.Join(db.path, logFile)); err != nil {
+		return err
+	}
+	if err := db.open(); err != nil {
+		return err
+	}
+	glog.Infof("LogDB: Compacted from %d to %d bytes in %0.4f secs", before, db.size, time.Since(start).Seconds())
+	return nil
+}
+
+// Each visits every live node. Nodes inserted during the visit may be missed.
+func (db *LogDB) Each(f func(data.Hashable) error) error {
+	db.mu.Lock()
+	hashes := make([]data.Hash256, 0, len(db.index))
+	for hash := range db.index {
+		hashes = append(hashes, hash)
+	}
+	db.mu.Unlock()
+	for _, hash := range hashes {
+		node, err := db.Get(hash)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := f(node); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sorted returns the live entries in log order. The lock must be held.
+func (db *LogDB) sorted() []logEntry {
+	entries := make([]logEntry, 0, len(db.index))
+	for _, e := range db.index {
+		entries = append(entries, e)
+	}
+	sort.Sort(logEntrySlice(entries))
+	return entries
+}
+
+func (db *LogDB) Stats() string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return fmt.Sprintf("Nodes: %d Ledgers: %d Size: %d Garbage: %d", len(db.index), len(db.ledgers), db.size, db.garbage)
+}
+
+// Close flushes the log and saves the index
+func (db *LogDB) Close() {
+	close(db.quit)
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.flush(); err != nil {
+		glog.Errorf("LogDB: Flush: %s", err.Error())
+	}
+	if err := db.file.Sync(); err != nil {
+		glog.Errorf("LogDB: Sync: %s", err.Error())
+	}
+	if err := db.writeIndex(); err != nil {
+		glog.Errorf("LogDB: Index: %s", err.Error())
+	}
+	db.file.Close()
+}
+
+type logEntrySlice []logEntry
+
+func (s logEntrySlice) Len() int           { return len(s) }
+func (s logEntrySlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s logEntrySlice) Less(i, j int) bool { return s[i].offset < s[j].offset }
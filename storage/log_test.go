@@ -0,0 +1,171 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"github.com/donovanhide/ripple/data"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testNodes reads the distinct nodes of the MemoryDB dump with their hashes
+// and raw values set
+func testNodes(t *testing.T) []data.Hashable {
+	f, err := os.Open("testdata/mem.gz")
+	checkErr(t, err)
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	checkErr(t, err)
+	var nodes []data.Hashable
+	seen := make(map[data.Hash256]bool)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		parts := strings.Split(scanner.Text(), ":")
+		var hash data.Hash256
+		_, err := hex.Decode(hash[:], []byte(parts[0]))
+		checkErr(t, err)
+		value, err := hex.DecodeString(parts[1])
+		checkErr(t, err)
+		node, err := decodeNode(hash, value)
+		checkErr(t, err)
+		if !seen[hash] {
+			seen[hash] = true
+			nodes = append(nodes, node)
+		}
+	}
+	checkErr(t, scanner.Err())
+	return nodes
+}
+
+func newTestLogDB(t *testing.T) (*LogDB, string) {
+	dir, err := ioutil.TempDir("", "logdb")
+	checkErr(t, err)
+	db, err := NewLogDB(dir)
+	checkErr(t, err)
+	return db, dir
+}
+
+func checkNodes(t *testing.T, db DB, nodes []data.Hashable) {
+	for _, node := range nodes {
+		got, err := db.Get(node.Hash())
+		if err != nil {
+			t.Fatalf("%s: %s", node.Hash().String(), err.Error())
+		}
+		if !bytes.Equal(got.Raw(), node.Raw()) || got.Hash() != node.Hash() {
+			t.Fatalf("Wrong node: %s", node.Hash().String())
+		}
+	}
+}
+
+func TestLogDB(t *testing.T) {
+	db, dir := newTestLogDB(t)
+	defer os.RemoveAll(dir)
+	nodes := testNodes(t)
+	var headers uint32
+	for _, node := range nodes {
+		if _, ok := node.(*data.Ledger); ok {
+			headers++
+		}
+	}
+	ledger := data.NewEmptyLedger(32600)
+	checkErr(t, data.NewEncoder().Node(ledger))
+	checkErr(t, db.InsertBatch(nodes))
+	checkErr(t, db.Insert(ledger))
+	checkNodes(t, db, nodes)
+	if _, err := db.Get(data.Hash256{1}); err != ErrNotFound {
+		t.Fatalf("Expected not found: %v", err)
+	}
+	db.Close()
+	db, err := NewLogDB(dir)
+	checkErr(t, err)
+	defer db.Close()
+	checkNodes(t, db, append(nodes, ledger))
+	ledgers, err := db.Ledger()
+	checkErr(t, err)
+	if ledgers.Count() != headers+1 {
+		t.Fatalf("Wrong ledgers: %s", ledgers.String())
+	}
+	if hash, ok := db.LedgerHash(32600); !ok || hash != ledger.Hash() {
+		t.Fatal("Wrong ledger hash")
+	}
+}
+
+func TestLogDBRecovery(t *testing.T) {
+	db, dir := newTestLogDB(t)
+	defer os.RemoveAll(dir)
+	nodes := testNodes(t)
+	checkErr(t, db.InsertBatch(nodes))
+	checkErr(t, db.Sync())
+	// A crash leaves no index and a torn last record
+	path := filepath.Join(dir, logFile)
+	info, err := os.Stat(path)
+	checkErr(t, err)
+	checkErr(t, os.Truncate(path, info.Size()-10))
+	recovered, err := NewLogDB(dir)
+	checkErr(t, err)
+	defer recovered.Close()
+	last := nodes[len(nodes)-1]
+	checkNodes(t, recovered, nodes[:len(nodes)-1])
+	if _, err := recovered.Get(last.Hash()); err != ErrNotFound {
+		t.Fatalf("Torn record recovered: %v", err)
+	}
+	checkErr(t, recovered.Insert(last))
+	checkNodes(t, recovered, nodes)
+}
+
+func TestLogDBShortLog(t *testing.T) {
+	db, dir := newTestLogDB(t)
+	defer os.RemoveAll(dir)
+	nodes := testNodes(t)
+	checkErr(t, db.InsertBatch(nodes))
+	db.Close()
+	// The index covers more of the log than survived
+	path := filepath.Join(dir, logFile)
+	info, err := os.Stat(path)
+	checkErr(t, err)
+	checkErr(t, os.Truncate(path, info.Size()-10))
+	rebuilt, err := NewLogDB(dir)
+	checkErr(t, err)
+	last := nodes[len(nodes)-1]
+	checkNodes(t, rebuilt, nodes[:len(nodes)-1])
+	if _, err := rebuilt.Get(last.Hash()); err != ErrNotFound {
+		t.Fatalf("Truncated record found: %v", err)
+	}
+	checkErr(t, rebuilt.Insert(last))
+	rebuilt.Close()
+	reopened, err := NewLogDB(dir)
+	checkErr(t, err)
+	defer reopened.Close()
+	checkNodes(t, reopened, nodes)
+}
+
+func TestLogDBCompact(t *testing.T) {
+	db, dir := newTestLogDB(t)
+	defer os.RemoveAll(dir)
+	nodes := testNodes(t)
+	checkErr(t, db.InsertBatch(nodes))
+	for _, node := range nodes[:20] {
+		checkErr(t, db.Delete(node.Hash()))
+	}
+	before := db.size
+	checkErr(t, db.Compact())
+	if db.size >= before || db.garbage != 0 {
+		t.Fatalf("Not compacted: %s", db.Stats())
+	}
+	for _, node := range nodes[:20] {
+		if _, err := db.Get(node.Hash()); err != ErrNotFound {
+			t.Fatalf("Deleted node found: %s", node.Hash().String())
+		}
+	}
+	checkNodes(t, db, nodes[20:])
+	db.Close()
+	db, err := NewLogDB(dir)
+	checkErr(t, err)
+	defer db.Close()
+	checkNodes(t, db, nodes[20:])
+}
@@ -61,6 +61,14 @@ func (l *lookup) add(v interface{}) (uint32, bool) {
 	return id, false
 }
 
+// find returns the id of a value without adding it
+func (l *lookup) find(v interface{}) (uint32, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	id, ok := l.m[v]
+	return id, ok
+}
+
 func (l *lookup) get(n uint32) interface{} {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
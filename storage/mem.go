@@ -1,14 +1,9 @@
 package storage
 
 import (
-	"bufio"
-	"bytes"
-	"compress/gzip"
-	"encoding/hex"
 	"fmt"
 	"github.com/donovanhide/ripple/data"
 	"os"
-	"strings"
 	"sync"
 )
 
@@ -30,31 +25,9 @@ func NewMemoryDB(path string) (*MemoryDB, error) {
 		return nil, err
 	}
 	defer f.Close()
-	r, err := gzip.NewReader(f)
-	if err != nil {
+	if _, err := Import(mem, f); err != nil {
 		return nil, err
 	}
-	defer r.Close()
-	scanner := bufio.NewScanner(r)
-	for scanner.Scan() {
-		parts := strings.Split(scanner.Text(), ":")
-		var key data.Hash256
-		if _, err := hex.Decode(key[:], []byte(parts[0])); err != nil {
-			return nil, err
-		}
-		value, err := hex.DecodeString(parts[1])
-		if err != nil {
-			return nil, err
-		}
-		node, err := data.NewDecoder(bytes.NewReader(value)).Prefix()
-		if err != nil {
-			return nil, err
-		}
-		mem.nodes[key] = node
-	}
-	if scanner.Err() != nil {
-		return nil, scanner.Err()
-	}
 	return mem, nil
 }
 
@@ -78,8 +51,31 @@ func (mem *MemoryDB) Insert(item data.Hashable) error {
 	return nil
 }
 
+func (mem *MemoryDB) Delete(hash data.Hash256) error {
+	mem.mu.Lock()
+	delete(mem.nodes, hash)
+	mem.mu.Unlock()
+	return nil
+}
+
+// Each visits the nodes held when it is called
+func (mem *MemoryDB) Each(f func(data.Hashable) error) error {
+	mem.mu.RLock()
+	nodes := make([]data.Hashable, 0, len(mem.nodes))
+	for _, node := range mem.nodes {
+		nodes = append(nodes, node)
+	}
+	mem.mu.RUnlock()
+	for _, node := range nodes {
+		if err := f(node); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (mem *MemoryDB) Ledger() (*data.LedgerSet, error) {
-	return data.NewLedgerSet(32570, 32570), nil
+	return data.NewLedgerSet(firstLedger, firstLedger), nil
 }
 
 func (mem *MemoryDB) Stats() string {
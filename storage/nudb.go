@@ -0,0 +1,564 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/donovanhide/ripple/data"
+	"github.com/golang/glog"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	nudbDatFile          = "nudb.dat"
+	nudbKeyFile          = "nudb.key"
+	nudbLogFile          = "nudb.log"
+	nudbDatHeaderSize    = 8 + 2 + 8 + 8 + 2 + 64                 // type, version, uid, appnum, key size, reserved
+	nudbKeyHeaderSize    = 8 + 2 + 8 + 8 + 2 + 8 + 8 + 2 + 2 + 56 // ...salt, pepper, block size, load factor, reserved
+	nudbLogHeaderSize    = 8 + 2 + 8 + 8 + 2 + 8 + 8 + 2 + 8 + 8  // ...salt, pepper, block size, key and data file sizes
+	nudbBucketHeaderSize = 2 + 6                                  // count, spill
+	nudbBucketEntrySize  = 6 + 6 + 6                              // offset, size, hash
+	nudbKeySize          = 32
+	nudbInnerNodeSize    = 4 + 4 + 1 + 4 + 16*32
+	nudbLedgerSize       = 4 + 4 + 1 + 4 + 4 + 8 + 32 + 32 + 32 + 4 + 4 + 1 + 1
+	nudbMaxValue         = 1 << 24
+	nudbHashMask         = 1<<48 - 1
+)
+
+// NuDB reads a rippled node store in the NuDB format from the directory
+// holding its data, key and log files. Keys are found through the buckets
+// of the key file, which hold the 48 bit XXH64 hashes of the keys and the
+// offsets of their records in the data file, and the spilled buckets which
+// overflowed into the data file. A log file left by an interrupted commit
+// holds the buckets as they were before the commit and the sizes of the
+// files, so they are used in place of the key file and later records are
+// ignored. The ledger headers are indexed by scanning the data file the
+// first time they are needed. Stored values are decompressed into the
+// prefix format, in which inner nodes have an unknown node type.
+type NuDB struct {
+	file     *os.File
+	keys     *os.File
+	salt     uint64
+	block    int64
+	buckets  uint64
+	modulus  uint64
+	rollback map[uint64][]byte
+	size     int64
+	ledgers  map[uint32]data.Hash256
+	indexed  sync.Once
+}
+
+func NewNuDB(path string) (*NuDB, error) {
+	file, err := os.Open(filepath.Join(path, nudbDatFile))
+	if err != nil {
+		return nil, err
+	}
+	var header [nudbDatHeaderSize]byte
+	if _, err := io.ReadFull(file, header[:]); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("NuDB: Bad data file header: %s", err.Error())
+	}
+	if err := checkNuDBHeader(header[:], nudbDatFile); err != nil {
+		file.Close()
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	db := &NuDB{
+		file: file,
+		size: info.Size(),
+	}
+	if err := db.openKeyFile(path, header[:]); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := db.checkLogFile(path, header[:]); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// checkNuDBHeader checks the type and key size of a header
+func checkNuDBHeader(header []byte, typ string) error {
+	if string(header[:8]) != typ {
+		return fmt.Errorf("NuDB: Bad file type: %q expected: %s", header[:8], typ)
+	}
+	if keySize := binary.BigEndian.Uint16(header[26:28]); keySize != nudbKeySize {
+		return fmt.Errorf("NuDB: Unsupported key size: %d", keySize)
+	}
+	return nil
+}
+
+// sameNuDB checks that two headers share the uid and appnum of a database
+func sameNuDB(a, b []byte) bool {
+	return bytes.Equal(a[10:26], b[10:26])
+}
+
+// openKeyFile checks that the key file belongs to the data file and uses
+// the same hash function and reads the layout of its buckets
+func (db *NuDB) openKeyFile(path string, dat []byte) error {
+	keys, err := os.Open(filepath.Join(path, nudbKeyFile))
+	if err != nil {
+		return fmt.Errorf("NuDB: Bad key file: %s", err.Error())
+	}
+	header := make([]byte, nudbKeyHeaderSize)
+	if _, err := io.ReadFull(keys, header); err != nil {
+		keys.Close()
+		return fmt.Errorf("NuDB: Bad key file: %s", err.Error())
+	}
+	if err := db.checkKeyHeader(header, dat); err != nil {
+		keys.Close()
+		return err
+	}
+	info, err := keys.Stat()
+	if err != nil {
+		keys.Close()
+		return err
+	}
+	db.keys = keys
+	db.setBuckets(info.Size())
+	return nil
+}
+
+func (db *NuDB) checkKeyHeader(key, dat []byte) error {
+	if err := checkNuDBHeader(key, nudbKeyFile); err != nil {
+		return err
+	}
+	if !sameNuDB(dat, key) {
+		return fmt.Errorf("NuDB: Key file belongs to another database")
+	}
+	db.salt = binary.BigEndian.Uint64(key[28:36])
+	if pepper := binary.BigEndian.Uint64(key[36:44]); pepper != nudbPepper(db.salt) {
+		return fmt.Errorf("NuDB: Unsupported hash function")
+	}
+	db.block = int64(binary.BigEndian.Uint16(key[44:46]))
+	if db.block < nudbKeyHeaderSize || db.block < nudbBucketHeaderSize+nudbBucketEntrySize {
+		return fmt.Errorf("NuDB: Bad block size: %d", db.block)
+	}
+	return nil
+}
+
+// nudbPepper is the hash of the salt, which shows the hash function used
+func nudbPepper(salt uint64) uint64 {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], salt)
+	return xxhash64(b[:], salt)
+}
+
+// setBuckets sets the number of buckets for a key file of the given size.
+// Buckets follow the header in the first block.
+func (db *NuDB) setBuckets(size int64) {
+	db.buckets = uint64((size - db.block) / db.block)
+	for db.modulus = 1; db.modulus < db.buckets; db.modulus <<= 1 {
+	}
+}
+
+// checkLogFile rolls back an interrupted commit by limiting the data and
+// key files to their sizes before it and using the buckets it saved. A
+// missing or incomplete log means there was nothing to roll back.
+func (db *NuDB) checkLogFile(path string, dat []byte) error {
+	log, err := ioutil.ReadFile(filepath.Join(path, nudbLogFile))
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return err
+	case len(log) < nudbLogHeaderSize:
+		return nil
+	}
+	if err := checkNuDBHeader(log, nudbLogFile); err != nil {
+		return err
+	}
+	if !sameNuDB(dat, log) {
+		return fmt.Errorf("NuDB: Log file belongs to another database")
+	}
+	if size := int64(binary.BigEndian.Uint64(log[nudbLogHeaderSize-8:])); size < db.size {
+		glog.Warningf("NuDB: Ignoring %d bytes of uncommitted data", db.size-size)
+		db.size = size
+	}
+	db.setBuckets(int64(binary.BigEndian.Uint64(log[nudbLogHeaderSize-16:])))
+	db.rollback = make(map[uint64][]byte)
+	for rest := log[nudbLogHeaderSize:]; len(rest) >= 8+nudbBucketHeaderSize; {
+		n := binary.BigEndian.Uint64(rest[:8])
+		size := 8 + nudbBucketHeaderSize + int(binary.BigEndian.Uint16(rest[8:10]))*nudbBucketEntrySize
+		if size > len(rest) {
+			break
+		}
+		db.rollback[n] = rest[8:size]
+		rest = rest[size:]
+	}
+	return nil
+}
+
+func uint48(b []byte) int64 {
+	return int64(b[0])<<40 | int64(b[1])<<32 | int64(b[2])<<24 | int64(b[3])<<16 | int64(b[4])<<8 | int64(b[5])
+}
+
+// scan visits the data records of the data file, skipping the spill
+// records. A torn last record is ignored.
+func (db *NuDB) scan(f func(hash data.Hash256, value []byte) error) error {
+	r := bufio.NewReaderSize(io.NewSectionReader(db.file, 0, db.size), 1<<20)
+	if _, err := r.Discard(nudbDatHeaderSize); err != nil {
+		return err
+	}
+	var header [6 + nudbKeySize]byte
+	for offset := int64(nudbDatHeaderSize); offset+6 <= db.size; {
+		if _, err := io.ReadFull(r, header[:6]); err != nil {
+			return err
+		}
+		size := uint48(header[:6])
+		if size == 0 {
+			if _, err := io.ReadFull(r, header[6:8]); err != nil {
+				return nil
+			}
+			spill := int(binary.BigEndian.Uint16(header[6:8]))
+			if _, err := r.Discard(spill); err != nil {
+				return nil
+			}
+			offset += 6 + 2 + int64(spill)
+			continue
+		}
+		if size > nudbMaxValue || offset+6+nudbKeySize+size > db.size {
+			glog.Warningf("NuDB: Ignoring torn record at: %d", offset)
+			return nil
+		}
+		if _, err := io.ReadFull(r, header[6:]); err != nil {
+			return err
+		}
+		var hash data.Hash256
+		copy(hash[:], header[6:])
+		value := make([]byte, size)
+		if _, err := io.ReadFull(r, value); err != nil {
+			return err
+		}
+		if err := f(hash, value); err != nil {
+			return err
+		}
+		offset += 6 + nudbKeySize + size
+	}
+	return nil
+}
+
+// indexLedgers scans the data file once for ledger headers, whose size is
+// known once decompressed, so that only their values are decompressed
+func (db *NuDB) indexLedgers() map[uint32]data.Hash256 {
+	db.indexed.Do(func() {
+		start := time.Now()
+		db.ledgers = make(map[uint32]data.Hash256)
+		err := db.scan(func(hash data.Hash256, value []byte) error {
+			typ, n, err := nudbVarint(value)
+			if err != nil || (typ != 0 && typ != 1) {
+				return nil
+			}
+			if typ == 1 {
+				if size, _, err := nudbVarint(value[n:]); err != nil || size != nudbLedgerSize {
+					return nil
+				}
+			} else if len(value)-n != nudbLedgerSize {
+				return nil
+			}
+			blob, err := nudbDecompress(value)
+			if err != nil || data.NodeType(blob[8]) != data.NT_LEDGER {
+				return nil
+			}
+			db.ledgers[binary.BigEndian.Uint32(blob[13:17])] = hash
+			return nil
+		})
+		if err != nil {
+			glog.Errorf("NuDB: Indexing ledgers: %s", err.Error())
+		}
+		glog.Infof("NuDB: Indexed %d ledgers in %0.4f secs", len(db.ledgers), time.Since(start).Seconds())
+	})
+	return db.ledgers
+}
+
+// nudbVarint reads the base 127 variable length integers of rippled's
+// node store codec
+func nudbVarint(b []byte) (uint64, int, error) {
+	n := 0
+	for n < len(b) && b[n]&0x80 != 0 {
+		n++
+	}
+	if n >= len(b) || n > 9 {
+		return 0, 0, fmt.Errorf("NuDB: Bad varint")
+	}
+	n++
+	var v uint64
+	for i := n - 1; i >= 0; i-- {
+		v = v*127 + uint64(b[i]&0x7f)
+	}
+	return v, n, nil
+}
+
+// nudbDecompress returns the prefix format of a stored value, which starts
+// with its compression type. Inner nodes are stored without their header
+// and only the non-empty children of compressed inner nodes are stored.
+func nudbDecompress(value []byte) ([]byte, error) {
+	typ, n, err := nudbVarint(value)
+	if err != nil {
+		return nil, err
+	}
+	body := value[n:]
+	switch typ {
+	case 0:
+		return body, nil
+	case 1:
+		size, n, err := nudbVarint(body)
+		if err != nil {
+			return nil, err
+		}
+		if size > nudbMaxValue {
+			return nil, fmt.Errorf("NuDB: Value too large: %d", size)
+		}
+		return lz4Decompress(body[n:], int(size))
+	case 2:
+		if len(body) < 2 {
+			return nil, fmt.Errorf("NuDB: Short compressed inner node")
+		}
+		mask := binary.BigEndian.Uint16(body[:2])
+		body = body[2:]
+		inner := nudbInnerNode()
+		children := inner[nudbInnerNodeSize-16*32:]
+		for i := uint(0); i < 16; i++ {
+			if mask&(1<<(15-i)) == 0 {
+				continue
+			}
+			if len(body) < 32 {
+				return nil, fmt.Errorf("NuDB: Short compressed inner node")
+			}
+			copy(children[i*32:], body[:32])
+			body = body[32:]
+		}
+		if mask == 0 || len(body) > 0 {
+			return nil, fmt.Errorf("NuDB: Bad compressed inner node")
+		}
+		return inner, nil
+	case 3:
+		if len(body) != 16*32 {
+			return nil, fmt.Errorf("NuDB: Bad inner node length: %d", len(body))
+		}
+		inner := nudbInnerNode()
+		copy(inner[nudbInnerNodeSize-16*32:], body)
+		return inner, nil
+	default:
+		return nil, fmt.Errorf("NuDB: Unknown compression: %d", typ)
+	}
+}
+
+// nudbInnerNode returns the header of an inner node followed by empty
+// children
+func nudbInnerNode() []byte {
+	inner := make([]byte, nudbInnerNodeSize)
+	inner[8] = byte(data.NT_UNKNOWN)
+	binary.BigEndian.PutUint32(inner[9:13], uint32(data.HP_INNER_NODE))
+	return inner
+}
+
+// lz4Decompress decodes an LZ4 block of a known decompressed size
+func lz4Decompress(src []byte, size int) ([]byte, error) {
+	dst := make([]byte, 0, size)
+	length := func(i int, n int) (int, int, error) {
+		if n != 15 {
+			return i, n, nil
+		}
+		for {
+			if i >= len(src) {
+				return i, 0, fmt.Errorf("LZ4: Short length")
+			}
+			b := src[i]
+			i++
+			n += int(b)
+			if b != 255 {
+				return i, n, nil
+			}
+		}
+	}
+	var (
+		literals, match, offset int
+		err                     error
+	)
+	for i := 0; i < len(src); {
+		token := src[i]
+		if i, literals, err = length(i+1, int(token>>4)); err != nil {
+			return nil, err
+		}
+		if i+literals > len(src) || len(dst)+literals > size {
+			return nil, fmt.Errorf("LZ4: Bad literal length: %d", literals)
+		}
+		dst = append(dst, src[i:i+literals]...)
+		i += literals
+		// The last sequence has only literals
+		if i == len(src) {
+			break
+		}
+		if i+2 > len(src) {
+			return nil, fmt.Errorf("LZ4: Short offset")
+		}
+		offset = int(src[i]) | int(src[i+1])<<8
+		if i, match, err = length(i+2, int(token&0x0F)); err != nil {
+			return nil, err
+		}
+		match += 4
+		if offset == 0 || offset > len(dst) || len(dst)+match > size {
+			return nil, fmt.Errorf("LZ4: Bad match offset: %d length: %d", offset, match)
+		}
+		// Matches may overlap the bytes they produce
+		for j := 0; j < match; j++ {
+			dst = append(dst, dst[len(dst)-offset])
+		}
+	}
+	if len(dst) != size {
+		return nil, fmt.Errorf("LZ4: Wrong size: %d expected: %d", len(dst), size)
+	}
+	return dst, nil
+}
+
+// bucket returns the bucket for a hash of a key, as it was before any
+// interrupted commit
+func (db *NuDB) bucket(h uint64) ([]byte, error) {
+	n := h % db.modulus
+	if n >= db.buckets {
+		n -= db.modulus / 2
+	}
+	if bucket, ok := db.rollback[n]; ok {
+		return bucket, nil
+	}
+	bucket := make([]byte, db.block)
+	if _, err := db.keys.ReadAt(bucket, int64(n+1)*db.block); err != nil {
+		return nil, err
+	}
+	return bucket, nil
+}
+
+// spill reads a bucket which overflowed into the data file
+func (db *NuDB) spill(offset int64) ([]byte, error) {
+	var header [6 + 2]byte
+	if offset+int64(len(header)) > db.size {
+		return nil, fmt.Errorf("NuDB: Spill beyond end: %d", offset)
+	}
+	if _, err := db.file.ReadAt(header[:], offset); err != nil {
+		return nil, err
+	}
+	if uint48(header[:6]) != 0 {
+		return nil, fmt.Errorf("NuDB: Bad spill record: %d", offset)
+	}
+	bucket := make([]byte, binary.BigEndian.Uint16(header[6:]))
+	if _, err := db.file.ReadAt(bucket, offset+int64(len(header))); err != nil {
+		return nil, err
+	}
+	return bucket, nil
+}
+
+// find returns the value stored for a key by searching its bucket and the
+// buckets spilled from it for entries with the hash of the key
+func (db *NuDB) find(hash data.Hash256) ([]byte, error) {
+	if db.buckets == 0 {
+		return nil, ErrNotFound
+	}
+	h := xxhash64(hash[:], db.salt)
+	bucket, err := db.bucket(h)
+	for err == nil {
+		if len(bucket) < nudbBucketHeaderSize {
+			return nil, fmt.Errorf("NuDB: Short bucket")
+		}
+		count := int(binary.BigEndian.Uint16(bucket[:2]))
+		if nudbBucketHeaderSize+count*nudbBucketEntrySize > len(bucket) {
+			return nil, fmt.Errorf("NuDB: Bad bucket count: %d", count)
+		}
+		for i := 0; i < count; i++ {
+			entry := bucket[nudbBucketHeaderSize+i*nudbBucketEntrySize:]
+			if uint64(uint48(entry[12:18])) != h&nudbHashMask {
+				continue
+			}
+			if value, err := db.record(hash, uint48(entry[:6]), uint48(entry[6:12])); value != nil || err != nil {
+				return value, err
+			}
+		}
+		spill := uint48(bucket[2:8])
+		if spill == 0 {
+			return nil, ErrNotFound
+		}
+		bucket, err = db.spill(spill)
+	}
+	return nil, err
+}
+
+// record returns the value of the data record at offset if it has the key
+// and was committed
+func (db *NuDB) record(hash data.Hash256, offset, size int64) ([]byte, error) {
+	if size > nudbMaxValue || offset+6+nudbKeySize+size > db.size {
+		return nil, nil
+	}
+	record := make([]byte, nudbKeySize+size)
+	if _, err := db.file.ReadAt(record, offset+6); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(record[:nudbKeySize], hash[:]) {
+		return nil, nil
+	}
+	return record[nudbKeySize:], nil
+}
+
+func (db *NuDB) Get(hash data.Hash256) (data.Hashable, error) {
+	value, err := db.find(hash)
+	if err != nil {
+		return nil, err
+	}
+	return nudbNode(hash, value)
+}
+
+func nudbNode(hash data.Hash256, value []byte) (data.Hashable, error) {
+	blob, err := nudbDecompress(value)
+	if err != nil {
+		return nil, fmt.Errorf("Bad node: %s: %s", hash.String(), err.Error())
+	}
+	if len(blob) <= 13 {
+		return nil, fmt.Errorf("Bad node: %s: Too short", hash.String())
+	}
+	return decodeNode(hash, blob)
+}
+
+func (db *NuDB) Insert(item data.Hashable) error {
+	return fmt.Errorf("NuDB opened read-only")
+}
+
+// Each visits every node in the order of the data file
+func (db *NuDB) Each(f func(data.Hashable) error) error {
+	return db.scan(func(hash data.Hash256, value []byte) error {
+		node, err := nudbNode(hash, value)
+		if err != nil {
+			return err
+		}
+		return f(node)
+	})
+}
+
+func (db *NuDB) LedgerHash(seq uint32) (data.Hash256, bool) {
+	hash, ok := db.indexLedgers()[seq]
+	return hash, ok
+}
+
+// Ledger returns the set of ledgers whose headers are stored, which unlike
+// the other DBs does not mean that the whole ledger is
+func (db *NuDB) Ledger() (*data.LedgerSet, error) {
+	return newLedgerSet(ledgerSequences(db.indexLedgers())), nil
+}
+
+func (db *NuDB) Stats() string {
+	return fmt.Sprintf("Buckets: %d Size: %d", db.buckets, db.size)
+}
+
+func (db *NuDB) Close() {
+	db.file.Close()
+	db.keys.Close()
+}
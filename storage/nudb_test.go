@@ -0,0 +1,301 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/hex"
+	"github.com/donovanhide/ripple/data"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func nudbHeader(typ string, size int, uid uint64) []byte {
+	header := make([]byte, size)
+	copy(header, typ)
+	binary.BigEndian.PutUint16(header[8:], 2)
+	binary.BigEndian.PutUint64(header[10:], uid)
+	binary.BigEndian.PutUint64(header[18:], 1)
+	binary.BigEndian.PutUint16(header[26:], nudbKeySize)
+	return header
+}
+
+func nudbRecord(hash data.Hash256, value []byte) []byte {
+	record := make([]byte, 6, 6+len(hash)+len(value))
+	size := uint64(len(value))
+	for i := 5; i >= 0; i-- {
+		record[i] = byte(size)
+		size >>= 8
+	}
+	return append(append(record, hash[:]...), value...)
+}
+
+// lz4Blocks reads LZ4 blocks of the node values of the MemoryDB dump made
+// by the lz4 command line tool
+func lz4Blocks(t *testing.T) map[data.Hash256][]byte {
+	f, err := os.Open("testdata/lz4.gz")
+	checkErr(t, err)
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	checkErr(t, err)
+	blocks := make(map[data.Hash256][]byte)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		parts := strings.Split(scanner.Text(), ":")
+		var hash data.Hash256
+		_, err := hex.Decode(hash[:], []byte(parts[0]))
+		checkErr(t, err)
+		blocks[hash], err = hex.DecodeString(parts[1])
+		checkErr(t, err)
+	}
+	checkErr(t, scanner.Err())
+	return blocks
+}
+
+// nudbValue stores leaves as LZ4 blocks where there is one and inner nodes
+// in either of rippled's inner node formats
+func nudbValue(node data.Hashable, full bool, blocks map[data.Hash256][]byte) []byte {
+	raw := node.Raw()
+	inner, ok := node.(*data.InnerNode)
+	switch {
+	case ok && full:
+		return append([]byte{3}, raw[13:]...)
+	case ok:
+		var mask uint16
+		var children []byte
+		for i, child := range inner.Children {
+			if !child.IsZero() {
+				mask |= 1 << uint(15-i)
+				children = append(children, child[:]...)
+			}
+		}
+		value := []byte{2, byte(mask >> 8), byte(mask)}
+		return append(value, children...)
+	}
+	block, ok := blocks[node.Hash()]
+	if !ok {
+		return append([]byte{0}, raw...)
+	}
+	value := []byte{1, byte(len(raw)%127) | 0x80, byte(len(raw) / 127)}
+	return append(value, block...)
+}
+
+const (
+	nudbTestSalt    = 7
+	nudbTestBlock   = 128
+	nudbTestBuckets = 3
+)
+
+func nudbKeyHeader(uid uint64) []byte {
+	header := nudbHeader(nudbKeyFile, nudbTestBlock, uid)
+	binary.BigEndian.PutUint64(header[28:], nudbTestSalt)
+	binary.BigEndian.PutUint64(header[36:], nudbPepper(nudbTestSalt))
+	binary.BigEndian.PutUint16(header[44:], nudbTestBlock)
+	binary.BigEndian.PutUint16(header[46:], 32768)
+	return header
+}
+
+func putUint48(b []byte, v int64) {
+	for i := 5; i >= 0; i-- {
+		b[i] = byte(v)
+		v >>= 8
+	}
+}
+
+// nudbBucket encodes a bucket of entries of offset, size and hash
+func nudbBucket(entries [][3]int64, spill int64) []byte {
+	bucket := make([]byte, nudbBucketHeaderSize+len(entries)*nudbBucketEntrySize)
+	binary.BigEndian.PutUint16(bucket, uint16(len(entries)))
+	putUint48(bucket[2:], spill)
+	for i, entry := range entries {
+		for j, v := range entry {
+			putUint48(bucket[nudbBucketHeaderSize+i*nudbBucketEntrySize+j*6:], v)
+		}
+	}
+	return bucket
+}
+
+// nudbIndex returns the bucket of a key in a key file of nudbTestBuckets
+func nudbIndex(hash data.Hash256) (int, int64) {
+	h := xxhash64(hash[:], nudbTestSalt)
+	n := h % 4
+	if n >= nudbTestBuckets {
+		n -= 2
+	}
+	return int(n), int64(h & nudbHashMask)
+}
+
+// writeNuDB writes the nodes and a key file whose buckets are full enough
+// to have spilled into the data file. The entries of extra are only in the
+// key file.
+func writeNuDB(t *testing.T, nodes []data.Hashable, extra map[data.Hash256][2]int64) (string, []byte, [][]byte) {
+	dir, err := ioutil.TempDir("", "nudb")
+	checkErr(t, err)
+	blocks := lz4Blocks(t)
+	var dat bytes.Buffer
+	dat.Write(nudbHeader(nudbDatFile, nudbDatHeaderSize, 42))
+	entries := make([][][3]int64, nudbTestBuckets)
+	add := func(hash data.Hash256, offset, size int64) {
+		n, h := nudbIndex(hash)
+		entries[n] = append(entries[n], [3]int64{offset, size, h})
+	}
+	for i, node := range nodes {
+		value := nudbValue(node, i%2 == 0, blocks)
+		add(node.Hash(), int64(dat.Len()), int64(len(value)))
+		dat.Write(nudbRecord(node.Hash(), value))
+	}
+	for hash, entry := range extra {
+		add(hash, entry[0], entry[1])
+	}
+	capacity := (nudbTestBlock - nudbBucketHeaderSize) / nudbBucketEntrySize
+	keys := nudbKeyHeader(42)
+	var buckets [][]byte
+	for _, bucket := range entries {
+		var spill int64
+		for len(bucket) > capacity {
+			spilled := nudbBucket(bucket[:capacity], spill)
+			spill = int64(dat.Len())
+			dat.Write([]byte{0, 0, 0, 0, 0, 0, byte(len(spilled) >> 8), byte(len(spilled))})
+			dat.Write(spilled)
+			bucket = bucket[capacity:]
+		}
+		block := make([]byte, nudbTestBlock)
+		copy(block, nudbBucket(bucket, spill))
+		keys = append(keys, block...)
+		buckets = append(buckets, block)
+	}
+	checkErr(t, ioutil.WriteFile(filepath.Join(dir, nudbDatFile), dat.Bytes(), 0644))
+	checkErr(t, ioutil.WriteFile(filepath.Join(dir, nudbKeyFile), keys, 0644))
+	return dir, dat.Bytes(), buckets
+}
+
+func TestNuDB(t *testing.T) {
+	nodes := testNodes(t)
+	var headers uint32
+	for _, node := range nodes {
+		if _, ok := node.(*data.Ledger); ok {
+			headers++
+		}
+	}
+	last := nodes[len(nodes)-1]
+	value := nudbValue(last, false, nil)
+	// The last node is appended after the spilled buckets, whose size does
+	// not depend on the offsets in them
+	extra := map[data.Hash256][2]int64{last.Hash(): {0, int64(len(value))}}
+	dir, dat, _ := writeNuDB(t, nodes[:len(nodes)-1], extra)
+	checkErr(t, os.RemoveAll(dir))
+	extra[last.Hash()] = [2]int64{int64(len(dat)), int64(len(value))}
+	dir, dat, buckets := writeNuDB(t, nodes[:len(nodes)-1], extra)
+	defer os.RemoveAll(dir)
+	for i, bucket := range buckets {
+		if uint48(bucket[2:8]) == 0 {
+			t.Fatalf("Bucket %d not spilled", i)
+		}
+	}
+	// An interrupted commit of the last node, whose bucket is lost from the
+	// key file but saved in the log, and a torn record
+	n, _ := nudbIndex(last.Hash())
+	log := nudbHeader(nudbLogFile, nudbLogHeaderSize, 42)
+	binary.BigEndian.PutUint64(log[nudbLogHeaderSize-16:], uint64(nudbTestBlock*(nudbTestBuckets+1)))
+	binary.BigEndian.PutUint64(log[nudbLogHeaderSize-8:], uint64(len(dat)))
+	var index [8]byte
+	binary.BigEndian.PutUint64(index[:], uint64(n))
+	log = append(append(log, index[:]...), buckets[n][:nudbBucketHeaderSize+int(binary.BigEndian.Uint16(buckets[n]))*nudbBucketEntrySize]...)
+	checkErr(t, ioutil.WriteFile(filepath.Join(dir, nudbLogFile), log, 0644))
+	keys, err := os.OpenFile(filepath.Join(dir, nudbKeyFile), os.O_WRONLY, 0644)
+	checkErr(t, err)
+	_, err = keys.WriteAt(make([]byte, nudbTestBlock), int64(n+1)*nudbTestBlock)
+	checkErr(t, err)
+	checkErr(t, keys.Close())
+	record := nudbRecord(last.Hash(), value)
+	f, err := os.OpenFile(filepath.Join(dir, nudbDatFile), os.O_APPEND|os.O_WRONLY, 0644)
+	checkErr(t, err)
+	_, err = f.Write(append(record, record[:10]...))
+	checkErr(t, err)
+	checkErr(t, f.Close())
+
+	db, err := NewNuDB(dir)
+	checkErr(t, err)
+	for _, node := range nodes[:len(nodes)-1] {
+		got, err := db.Get(node.Hash())
+		checkErr(t, err)
+		expected, err := data.NodePrefix(node)
+		checkErr(t, err)
+		prefix, err := data.NodePrefix(got)
+		checkErr(t, err)
+		if got.Hash() != node.Hash() || !bytes.Equal(prefix, expected) {
+			t.Fatalf("Wrong node: %s", node.Hash().String())
+		}
+	}
+	if _, err := db.Get(last.Hash()); err != ErrNotFound {
+		t.Fatalf("Uncommitted node found: %v", err)
+	}
+	if _, err := db.Get(data.Hash256{1}); err != ErrNotFound {
+		t.Fatalf("Expected not found: %v", err)
+	}
+	ledgers, err := db.Ledger()
+	checkErr(t, err)
+	if ledgers.Count() != headers {
+		t.Fatalf("Wrong ledgers: %s", ledgers.String())
+	}
+	var count int
+	checkErr(t, db.Each(func(data.Hashable) error {
+		count++
+		return nil
+	}))
+	if count != len(nodes)-1 {
+		t.Fatalf("Expected %d nodes got %d", len(nodes)-1, count)
+	}
+	if err := db.Insert(last); err == nil {
+		t.Fatal("Inserted into read-only NuDB")
+	}
+	db.Close()
+
+	checkErr(t, ioutil.WriteFile(filepath.Join(dir, nudbKeyFile), nudbKeyHeader(43), 0644))
+	if _, err := NewNuDB(dir); err == nil {
+		t.Fatal("Opened with the key file of another database")
+	}
+}
+
+func TestLZ4(t *testing.T) {
+	blocks := lz4Blocks(t)
+	for _, node := range testNodes(t) {
+		block, ok := blocks[node.Hash()]
+		if !ok {
+			continue
+		}
+		out, err := lz4Decompress(block, len(node.Raw()))
+		checkErr(t, err)
+		if !bytes.Equal(out, node.Raw()) {
+			t.Fatalf("Wrong decompression: %s", node.Hash().String())
+		}
+	}
+	out, err := lz4Decompress([]byte{0x35, 'a', 'b', 'c', 3, 0}, 12)
+	checkErr(t, err)
+	if string(out) != "abcabcabcabc" {
+		t.Fatalf("Wrong decompression: %q", out)
+	}
+	if _, err := lz4Decompress([]byte{0x35, 'a', 'b', 'c', 4, 0}, 12); err == nil {
+		t.Fatal("Match before start decompressed")
+	}
+	for _, value := range []uint64{0, 126, 127, 300, 1 << 20} {
+		var b []byte
+		for v := value; ; v /= 127 {
+			d := byte(v % 127)
+			if v/127 != 0 {
+				d |= 0x80
+			}
+			b = append(b, d)
+			if v/127 == 0 {
+				break
+			}
+		}
+		if v, n, err := nudbVarint(b); err != nil || v != value || n != len(b) {
+			t.Fatalf("Wrong varint: %d %d %d", value, v, n)
+		}
+	}
+}
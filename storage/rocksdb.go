@@ -2,51 +2,93 @@ package storage
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"github.com/donovanhide/ripple/data"
-	"github.com/golang/groupcache/lru"
-	metrics "github.com/rcrowley/go-metrics"
+	"github.com/golang/glog"
 	"github.com/tecbot/gorocksdb"
 	"sync"
 )
 
+const rocksBatchSize = 1000
+
+// rocksLedgerPrefix starts the keys which map a ledger sequence to the hash
+// of its header. Node keys are hashes, so are a different length and only
+// share the prefix by chance.
+var rocksLedgerPrefix = []byte("\x00LEDGER\x00")
+
+// RocksDB has no cache of its own beyond the pending batch, so should be
+// wrapped by a CachedDB
 type RocksDB struct {
-	db           *gorocksdb.DB
-	ro           *gorocksdb.ReadOptions
-	cache        *lru.Cache
-	hits, misses metrics.Meter
-	mu           sync.RWMutex
+	db      *gorocksdb.DB
+	ro      *gorocksdb.ReadOptions
+	wo      *gorocksdb.WriteOptions
+	batch   *gorocksdb.WriteBatch
+	pending map[data.Hash256]data.Hashable
+	mu      sync.RWMutex
 }
 
-func NewRocksDB(path string) (*RocksDB, error) {
+func rocksOptions() *gorocksdb.Options {
 	opts := gorocksdb.NewDefaultOptions()
 	filter := gorocksdb.NewBloomFilter(14)
 	opts.SetFilterPolicy(filter)
 	opts.SetMaxOpenFiles(10000)
-	db, err := gorocksdb.OpenDbForReadOnly(opts, path, false)
+	return opts
+}
+
+func newRocksDB(db *gorocksdb.DB) *RocksDB {
+	return &RocksDB{
+		db: db,
+		ro: gorocksdb.NewDefaultReadOptions(),
+	}
+}
+
+// NewRocksDB opens an existing database, such as a rippled node store,
+// read-only
+func NewRocksDB(path string) (*RocksDB, error) {
+	db, err := gorocksdb.OpenDbForReadOnly(rocksOptions(), path, false)
 	if err != nil {
 		return nil, err
 	}
-	return &RocksDB{
-		db:     db,
-		ro:     gorocksdb.NewDefaultReadOptions(),
-		hits:   metrics.NewMeter(),
-		misses: metrics.NewMeter(),
-		cache:  lru.New(1000000),
-	}, nil
+	return newRocksDB(db), nil
+}
+
+// NewWritableRocksDB opens or creates a database for ingestion. Inserts are
+// written in batches, which are also written whenever a ledger header is
+// inserted, as that marks the ledger as complete.
+func NewWritableRocksDB(path string) (*RocksDB, error) {
+	opts := rocksOptions()
+	opts.SetCreateIfMissing(true)
+	db, err := gorocksdb.OpenDb(opts, path)
+	if err != nil {
+		return nil, err
+	}
+	rocks := newRocksDB(db)
+	rocks.wo = gorocksdb.NewDefaultWriteOptions()
+	rocks.batch = gorocksdb.NewWriteBatch()
+	rocks.pending = make(map[data.Hash256]data.Hashable)
+	return rocks, nil
 }
 
 func (db *RocksDB) Close() {
+	if db.batch != nil {
+		db.mu.Lock()
+		if err := db.write(); err != nil {
+			glog.Errorf("RocksDB: Close: %s", err.Error())
+		}
+		db.batch.Destroy()
+		db.wo.Destroy()
+		db.mu.Unlock()
+	}
 	db.db.Close()
 }
 
 func (db *RocksDB) Get(hash data.Hash256) (data.Hashable, error) {
-	db.mu.Lock()
-	cached, ok := db.cache.Get(hash)
-	db.mu.Unlock()
+	db.mu.RLock()
+	pending, ok := db.pending[hash]
+	db.mu.RUnlock()
 	if ok {
-		db.hits.Mark(1)
-		return cached.(data.Hashable), nil
+		return pending, nil
 	}
 	value, err := db.db.Get(db.ro, hash[:])
 	if err != nil {
@@ -56,26 +98,172 @@ func (db *RocksDB) Get(hash data.Hash256) (data.Hashable, error) {
 	if value.Size() == 0 {
 		return nil, ErrNotFound
 	}
-	node, err := data.NewDecoder(bytes.NewReader(value.Data())).Prefix()
+	return decodeNode(hash, append([]byte(nil), value.Data()...))
+}
+
+// Insert adds a node in the prefix format to the current batch. A ledger
+// header is also indexed by its sequence.
+func (db *RocksDB) Insert(item data.Hashable) error {
+	if db.batch == nil {
+		return fmt.Errorf("RocksDB opened read-only")
+	}
+	hash := item.Hash()
+	if hash.IsZero() {
+		return fmt.Errorf("Cannot insert unhashed item")
+	}
+	value, err := encodeNode(item)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.batch.Put(hash[:], value)
+	db.pending[hash] = item
+	ledger, isLedger := item.(*data.Ledger)
+	if isLedger {
+		db.batch.Put(rocksLedgerKey(ledger.LedgerSequence), hash[:])
+	}
+	if isLedger || db.batch.Count() >= rocksBatchSize {
+		return db.write()
+	}
+	return nil
+}
+
+// Delete removes a node, and the ledger index entry if it is a ledger
+// header, in the current batch
+func (db *RocksDB) Delete(hash data.Hash256) error {
+	if db.batch == nil {
+		return fmt.Errorf("RocksDB opened read-only")
+	}
+	node, err := db.Get(hash)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.batch.Delete(hash[:])
+	if ledger, ok := node.(*data.Ledger); ok {
+		db.batch.Delete(rocksLedgerKey(ledger.LedgerSequence))
+	}
+	delete(db.pending, hash)
+	if db.batch.Count() >= rocksBatchSize {
+		return db.write()
+	}
+	return nil
+}
+
+// write applies the current batch. The lock must be held.
+func (db *RocksDB) write() error {
+	if len(db.pending) == 0 && db.batch.Count() == 0 {
+		return nil
+	}
+	if err := db.db.Write(db.wo, db.batch); err != nil {
+		return err
+	}
+	db.batch.Clear()
+	db.pending = make(map[data.Hash256]data.Hashable)
+	return nil
+}
+
+// Flush writes any batched inserts
+func (db *RocksDB) Flush() error {
+	if db.batch == nil {
+		return nil
 	}
-	db.misses.Mark(1)
 	db.mu.Lock()
-	db.cache.Add(hash, node)
-	db.mu.Unlock()
-	return node, nil
+	defer db.mu.Unlock()
+	return db.write()
+}
+
+func rocksLedgerKey(seq uint32) []byte {
+	key := make([]byte, len(rocksLedgerPrefix)+4)
+	copy(key, rocksLedgerPrefix)
+	binary.BigEndian.PutUint32(key[len(rocksLedgerPrefix):], seq)
+	return key
+}
+
+// LedgerHash returns the hash of the header of a complete ledger
+func (db *RocksDB) LedgerHash(seq uint32) (data.Hash256, bool) {
+	var hash data.Hash256
+	value, err := db.db.Get(db.ro, rocksLedgerKey(seq))
+	if err != nil {
+		return hash, false
+	}
+	defer value.Free()
+	if value.Size() != len(hash) {
+		return hash, false
+	}
+	copy(hash[:], value.Data())
+	return hash, true
+}
+
+// Ledger rebuilds the set of complete ledgers from the ledger index. A
+// database without the index, such as a rippled node store, has none.
+func (db *RocksDB) Ledger() (*data.LedgerSet, error) {
+	ro := gorocksdb.NewDefaultReadOptions()
+	ro.SetFillCache(false)
+	defer ro.Destroy()
+	it := db.db.NewIterator(ro)
+	defer it.Close()
+	var sequences []uint32
+	for it.Seek(rocksLedgerPrefix); it.Valid(); it.Next() {
+		key := it.Key()
+		k := key.Data()
+		if !bytes.HasPrefix(k, rocksLedgerPrefix) {
+			key.Free()
+			break
+		}
+		if len(k) != len(rocksLedgerPrefix)+4 {
+			key.Free()
+			continue
+		}
+		seq := binary.BigEndian.Uint32(k[len(rocksLedgerPrefix):])
+		key.Free()
+		sequences = append(sequences, seq)
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	return newLedgerSet(sequences), nil
+}
+
+// Each visits every node, skipping the ledger index
+func (db *RocksDB) Each(f func(data.Hashable) error) error {
+	if err := db.Flush(); err != nil {
+		return err
+	}
+	ro := gorocksdb.NewDefaultReadOptions()
+	ro.SetFillCache(false)
+	defer ro.Destroy()
+	it := db.db.NewIterator(ro)
+	defer it.Close()
+	var hash data.Hash256
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		key := it.Key()
+		if key.Size() != len(hash) {
+			key.Free()
+			continue
+		}
+		copy(hash[:], key.Data())
+		key.Free()
+		value := it.Value()
+		node, err := decodeNode(hash, append([]byte(nil), value.Data()...))
+		value.Free()
+		if err != nil {
+			return err
+		}
+		if err := f(node); err != nil {
+			return err
+		}
+	}
+	return it.Err()
 }
 
 func (db *RocksDB) Stats() string {
 	db.mu.RLock()
-	entries := db.cache.Len()
-	size := db.cache.MaxEntries
-	db.mu.RUnlock()
-	hits, misses := db.hits.Snapshot(), db.misses.Snapshot()
-	total := float64(hits.Count() + misses.Count())
-	hitsPercent, missesPercent := float64(hits.Count())/total*100, float64(misses.Count())/total*100
-	occupancy := float64(entries) / float64(size) * 100
-	format := "Cache: %0.02f%% full Hits: %0.02f%% %d(%.0f/sec) Misses: %0.02f%%  %d(%.0f/sec)"
-	return fmt.Sprintf(format, occupancy, hitsPercent, hits.Count(), hits.RateMean(), missesPercent, misses.Count(), misses.RateMean())
+	defer db.mu.RUnlock()
+	return fmt.Sprintf("Pending: %d", len(db.pending))
 }
@@ -0,0 +1,69 @@
+//go:build rocksdb
+// +build rocksdb
+
+package storage
+
+import (
+	"github.com/donovanhide/ripple/data"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// Run with: go test -tags rocksdb
+func TestRocksDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocksdb")
+	checkErr(t, err)
+	defer os.RemoveAll(dir)
+	db, err := NewWritableRocksDB(dir)
+	checkErr(t, err)
+	nodes := testNodes(t)
+	for _, node := range nodes {
+		checkErr(t, db.Insert(node))
+	}
+	checkNodes(t, db, nodes)
+	ledger, deleted := data.NewEmptyLedger(32600), data.NewEmptyLedger(32601)
+	checkErr(t, data.NewEncoder().Node(ledger))
+	checkErr(t, data.NewEncoder().Node(deleted))
+	checkErr(t, db.Insert(ledger))
+	checkErr(t, db.Insert(deleted))
+	checkErr(t, db.Delete(deleted.Hash()))
+	checkErr(t, db.Delete(nodes[0].Hash()))
+	db.Close()
+
+	db, err = NewRocksDB(dir)
+	checkErr(t, err)
+	defer db.Close()
+	checkNodes(t, db, append(nodes[1:], ledger))
+	if _, err := db.Get(nodes[0].Hash()); err != ErrNotFound {
+		t.Fatalf("Deleted node found: %v", err)
+	}
+	if err := db.Insert(ledger); err == nil {
+		t.Fatal("Insert into read-only database")
+	}
+	if hash, ok := db.LedgerHash(32600); !ok || hash != ledger.Hash() {
+		t.Fatal("Wrong ledger hash")
+	}
+	if _, ok := db.LedgerHash(32601); ok {
+		t.Fatal("Deleted ledger still indexed")
+	}
+	ledgers, err := db.Ledger()
+	checkErr(t, err)
+	var headers uint32
+	for _, node := range nodes[1:] {
+		if l, ok := node.(*data.Ledger); ok && l.LedgerSequence >= firstLedger {
+			headers++
+		}
+	}
+	if ledgers.Count() != headers+1 || !ledgers.Has(32600) || ledgers.Has(32601) {
+		t.Fatalf("Wrong ledgers: %s", ledgers.String())
+	}
+	var count int
+	checkErr(t, db.Each(func(data.Hashable) error {
+		count++
+		return nil
+	}))
+	if count != len(nodes) {
+		t.Fatalf("Expected %d nodes got %d", len(nodes), count)
+	}
+}
@@ -0,0 +1,24 @@
+package storage
+
+import (
+	"testing"
+)
+
+func TestXXHash64(t *testing.T) {
+	long := make([]byte, 100)
+	for i := range long {
+		long[i] = byte(i)
+	}
+	for _, test := range []struct {
+		input    []byte
+		expected uint64
+	}{
+		{nil, 0xEF46DB3751D8E999},
+		{[]byte("abc"), 0x44BC2CF5AD770999},
+		{long, 0x6AC1E58032166597},
+	} {
+		if h := xxhash64(test.input, 0); h != test.expected {
+			t.Errorf("Hash of %X: Expected %X got %X", test.input, test.expected, h)
+		}
+	}
+}
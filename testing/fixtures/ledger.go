@@ -0,0 +1,76 @@
+// Package fixtures builds small ledgers for tests. It lives apart from the
+// testing package because the data package's own tests import that.
+package fixtures
+
+import (
+	"github.com/donovanhide/ripple/data"
+	internal "github.com/donovanhide/ripple/testing"
+	"testing"
+)
+
+// Ledger is an encoded ledger whose transaction tree is a single root node
+type Ledger struct {
+	*data.Ledger
+	Root   *data.InnerNode
+	Leaves []data.Hashable
+}
+
+// Nodes returns the leaves followed by the root
+func (l *Ledger) Nodes() []data.Hashable {
+	return append(append([]data.Hashable(nil), l.Leaves...), l.Root)
+}
+
+// Leaves returns one transaction node from the matching nodes for each
+// branch of the root that they cover
+func Leaves(t testing.TB, sequence uint32) []data.Hashable {
+	var (
+		leaves []data.Hashable
+		used   [16]bool
+	)
+	for _, test := range internal.MatchingNodes {
+		b := test.Bytes()
+		node, err := data.NewNodeFromPrefix(b[9:], data.NT_TRANSACTION_NODE, sequence)
+		if err != nil {
+			t.Fatal(err)
+		}
+		branch := data.RootNodeId.Branch(node.Hash())
+		if used[branch] {
+			continue
+		}
+		used[branch] = true
+		leaves = append(leaves, node)
+	}
+	return leaves
+}
+
+// NewLedger returns a ledger at sequence with the leaves from Leaves
+func NewLedger(t testing.TB, sequence uint32) *Ledger {
+	return NewLedgerWith(t, sequence, Leaves(t, sequence))
+}
+
+// NewLedgerWith returns a ledger at sequence whose root holds the leaves and
+// the hashes of nodes which are missing
+func NewLedgerWith(t testing.TB, sequence uint32, leaves []data.Hashable, missing ...data.Hash256) *Ledger {
+	wire := make([]byte, 16*32+1)
+	wire[16*32] = byte(data.WT_INNER)
+	for _, leaf := range leaves {
+		copy(wire[data.RootNodeId.Branch(leaf.Hash())*32:], leaf.Hash().Bytes())
+	}
+	for _, hash := range missing {
+		copy(wire[data.RootNodeId.Branch(hash)*32:], hash.Bytes())
+	}
+	root, err := data.NewNodeFromWire(wire, data.NT_TRANSACTION_NODE, sequence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ledger := data.NewEmptyLedger(sequence)
+	ledger.TransactionHash = root.Hash()
+	if err := data.NewEncoder().Node(ledger); err != nil {
+		t.Fatal(err)
+	}
+	return &Ledger{
+		Ledger: ledger,
+		Root:   root.(*data.InnerNode),
+		Leaves: leaves,
+	}
+}
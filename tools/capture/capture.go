@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"github.com/codegangsta/cli"
+	"github.com/donovanhide/ripple/ledger"
+	"github.com/donovanhide/ripple/peers"
+	"github.com/donovanhide/ripple/peers/protocol"
+	"github.com/donovanhide/ripple/storage"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+func checkErr(err error) {
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+}
+
+func open(c *cli.Context) (*os.File, *protocol.Player) {
+	if len(c.Args()) != 1 {
+		cli.ShowAppHelp(c)
+		os.Exit(1)
+	}
+	f, err := os.Open(c.Args()[0])
+	checkErr(err)
+	player, err := protocol.NewPlayer(f)
+	checkErr(err)
+	return f, player
+}
+
+func messageType(record *protocol.Record) string {
+	if record.Message == nil {
+		return "Undecodable"
+	}
+	return strings.TrimPrefix(reflect.TypeOf(record.Message).String(), "*protocol.")
+}
+
+// filter matches records against the peer, type and direction flags
+func filter(c *cli.Context) func(*protocol.Record) bool {
+	peer, typ, direction := c.GlobalString("peer"), c.GlobalString("type"), c.GlobalString("direction")
+	return func(record *protocol.Record) bool {
+		switch {
+		case peer != "" && !strings.Contains(record.Peer, peer):
+			return false
+		case typ != "" && !strings.Contains(strings.ToLower(messageType(record)), strings.ToLower(typ)):
+			return false
+		case direction != "" && !strings.EqualFold(record.Direction.String(), direction):
+			return false
+		default:
+			return true
+		}
+	}
+}
+
+func each(c *cli.Context, f func(*protocol.Record)) {
+	file, player := open(c)
+	defer file.Close()
+	match := filter(c)
+	for {
+		record, err := player.Next()
+		if err == io.EOF {
+			return
+		}
+		checkErr(err)
+		if match(record) {
+			f(record)
+		}
+	}
+}
+
+func list(c *cli.Context) {
+	each(c, func(record *protocol.Record) {
+		fmt.Printf("%s %-3s %s %s\n", record.Time.Format("2006-01-02 15:04:05.000"), record.Direction, record.Peer, messageType(record))
+	})
+}
+
+func decode(c *cli.Context) {
+	each(c, func(record *protocol.Record) {
+		description := fmt.Sprintf("%s %X", record.Err, record.Raw)
+		if record.Message != nil {
+			description = record.Message.Log()
+		}
+		fmt.Printf("%s %-3s %s %s\n", record.Time.Format("2006-01-02 15:04:05.000"), record.Direction, record.Peer, description)
+	})
+}
+
+func summary(c *cli.Context) {
+	counts := make(map[string]int)
+	var total int
+	each(c, func(record *protocol.Record) {
+		counts[fmt.Sprintf("%-3s %s", record.Direction, messageType(record))]++
+		total++
+	})
+	for name, count := range counts {
+		fmt.Printf("%s: %d\n", name, count)
+	}
+	fmt.Printf("Total: %d\n", total)
+}
+
+func replay(c *cli.Context) {
+	file, player := open(c)
+	defer file.Close()
+	mgr, err := ledger.NewManager(storage.NewEmptyMemoryDB())
+	checkErr(err)
+	go mgr.Start()
+	count, err := peers.Replay(mgr, player, filter(c))
+	checkErr(err)
+	time.Sleep(time.Duration(c.Int("wait")) * time.Second)
+	fmt.Printf("Replayed: %d\n%s\n", count, mgr.String())
+}
+
+func main() {
+	app := cli.NewApp()
+	app.Name = "capture"
+	app.Usage = "inspect and replay captured peer protocol messages"
+	app.Version = "0.1"
+	app.Flags = []cli.Flag{
+		cli.StringFlag{"peer,p", "", "only messages to or from peers containing this address"},
+		cli.StringFlag{"type,t", "", "only messages with types containing this name"},
+		cli.StringFlag{"direction,d", "", "only messages in this direction (in or out)"},
+	}
+	app.Commands = []cli.Command{{
+		Name:      "list",
+		ShortName: "l",
+		Usage:     "list the messages in a capture",
+		Action:    list,
+	}, {
+		Name:      "decode",
+		ShortName: "d",
+		Usage:     "decode the messages in a capture",
+		Action:    decode,
+	}, {
+		Name:      "summary",
+		ShortName: "s",
+		Usage:     "count the messages in a capture by direction and type",
+		Action:    summary,
+	}, {
+		Name:      "replay",
+		ShortName: "r",
+		Usage:     "replay the messages in a capture into an in-memory ledger manager",
+		Action:    replay,
+		Flags: []cli.Flag{
+			cli.IntFlag{"wait,w", 1, "seconds to wait for handlers to finish"},
+		},
+	}}
+	app.Run(os.Args)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/donovanhide/ripple/storage"
+	"github.com/golang/glog"
+	"os"
+)
+
+var dbPath = flag.String("db", "", "LogDB directory to check")
+var rocksPath = flag.String("rocksdb", "", "RocksDB directory to check instead of -db")
+var nudbPath = flag.String("nudb", "", "rippled NuDB directory to check instead of -db")
+var memPath = flag.String("mem", "", "dump to check instead of -db")
+var verbose = flag.Bool("v", false, "list every corrupt and missing node and affected ledger")
+
+func checkErr(err error) {
+	if err != nil {
+		glog.Fatalln(err)
+	}
+}
+
+func open() storage.DB {
+	switch {
+	case *rocksPath != "":
+		db, err := storage.NewRocksDB(*rocksPath)
+		checkErr(err)
+		return db
+	case *dbPath != "":
+		db, err := storage.NewLogDB(*dbPath)
+		checkErr(err)
+		return db
+	case *nudbPath != "":
+		db, err := storage.NewNuDB(*nudbPath)
+		checkErr(err)
+		return db
+	case *memPath != "":
+		db, err := storage.NewMemoryDB(*memPath)
+		checkErr(err)
+		return db
+	}
+	flag.Usage()
+	os.Exit(1)
+	return nil
+}
+
+func main() {
+	flag.Parse()
+	db := open()
+	report, err := storage.Check(db)
+	db.Close()
+	checkErr(err)
+	if *verbose {
+		_, err = report.WriteTo(os.Stdout)
+		checkErr(err)
+	} else {
+		fmt.Println(report.String())
+	}
+	if !report.OK() {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/donovanhide/ripple/crypto"
+	"github.com/donovanhide/ripple/peers"
+	"github.com/golang/glog"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+var seeds = flag.String("seeds", "r.ripple.com:51235", "hosts to start crawling from separated by commas")
+var depth = flag.Int("depth", 3, "maximum number of hops from the seeds")
+var maxNodes = flag.Int("max", 1000, "maximum number of nodes to visit")
+var workers = flag.Int("workers", 20, "number of nodes to probe at once")
+var timeout = flag.Duration("timeout", 10*time.Second, "time to wait for each node's endpoints and status")
+var jsonOut = flag.String("json", "", "file to write the graph to as JSON")
+var dotOut = flag.String("dot", "", "file to write the graph to in the Graphviz DOT format")
+var name = flag.String("name", "RippleCrawler", "name to connect to the peer network as")
+
+func checkErr(err error) {
+	if err != nil {
+		glog.Fatalln(err)
+	}
+}
+
+func write(filename string, f func(*os.File) error) {
+	if filename == "" {
+		return
+	}
+	file, err := os.Create(filename)
+	checkErr(err)
+	defer file.Close()
+	checkErr(f(file))
+}
+
+func main() {
+	flag.Parse()
+	key, err := crypto.GenerateRootDeterministicKey(nil)
+	checkErr(err)
+	crawler, err := peers.NewCrawler(key, *name)
+	checkErr(err)
+	crawler.MaxDepth, crawler.MaxNodes, crawler.Workers, crawler.Timeout = *depth, *maxNodes, *workers, *timeout
+	graph := crawler.Crawl(strings.Split(*seeds, ","))
+	write(*jsonOut, func(f *os.File) error { return graph.WriteJSON(f) })
+	write(*dotOut, func(f *os.File) error { return graph.WriteDOT(f) })
+	fmt.Printf("Nodes: %d Reachable: %d Time: %s\n", len(graph.Nodes), graph.Reachable(), graph.Finished.Sub(graph.Started))
+	versions := graph.Versions()
+	var names []string
+	for name := range versions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("%-30s %d\n", name, versions[name])
+	}
+	full := graph.FullHistory()
+	fmt.Printf("Full history: %d\n", len(full))
+	for _, address := range full {
+		fmt.Println(address)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/donovanhide/ripple/data"
+	"github.com/donovanhide/ripple/storage"
+	"github.com/golang/glog"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var dbPath = flag.String("db", "", "LogDB directory to export from or import into")
+var rocksPath = flag.String("rocksdb", "", "RocksDB directory to export from or import into instead of -db")
+var nudbPath = flag.String("nudb", "", "rippled NuDB directory to export from instead of -db")
+var memPath = flag.String("mem", "", "dump to export from instead of -db")
+var in = flag.String("in", "", "dump to import")
+var out = flag.String("out", "", "file to export the dump to")
+var ledgers = flag.String("ledgers", "", "ledger sequences or hashes separated by commas to export the trees of, everything if empty")
+
+func checkErr(err error) {
+	if err != nil {
+		glog.Fatalln(err)
+	}
+}
+
+func open(writable bool) storage.DB {
+	switch {
+	case *rocksPath != "" && writable:
+		db, err := storage.NewWritableRocksDB(*rocksPath)
+		checkErr(err)
+		return db
+	case *rocksPath != "":
+		db, err := storage.NewRocksDB(*rocksPath)
+		checkErr(err)
+		return db
+	case *dbPath != "":
+		db, err := storage.NewLogDB(*dbPath)
+		checkErr(err)
+		return db
+	case *nudbPath != "" && !writable:
+		db, err := storage.NewNuDB(*nudbPath)
+		checkErr(err)
+		return db
+	case *memPath != "" && !writable:
+		db, err := storage.NewMemoryDB(*memPath)
+		checkErr(err)
+		return db
+	}
+	glog.Fatalln("No database given")
+	return nil
+}
+
+// roots resolves the ledgers flag to the hashes of ledger headers
+func roots(db storage.DB) []data.Hash256 {
+	var hashes []data.Hash256
+	for _, s := range strings.Split(*ledgers, ",") {
+		seq, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			hash, err := data.NewHash256(s)
+			checkErr(err)
+			hashes = append(hashes, *hash)
+			continue
+		}
+		index, ok := storage.AsLedgerIndex(db)
+		if !ok {
+			glog.Fatalf("Cannot find ledger %d by sequence in %T", seq, db)
+		}
+		hash, ok := index.LedgerHash(uint32(seq))
+		if !ok {
+			glog.Fatalf("Unknown ledger: %d", seq)
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes
+}
+
+func main() {
+	flag.Parse()
+	switch {
+	case *in != "":
+		db := open(true)
+		defer db.Close()
+		f, err := os.Open(*in)
+		checkErr(err)
+		defer f.Close()
+		count, err := storage.Import(db, f)
+		checkErr(err)
+		fmt.Printf("Imported: %d %s\n", count, db.Stats())
+	case *out != "":
+		db := open(false)
+		defer db.Close()
+		f, err := os.Create(*out)
+		checkErr(err)
+		defer f.Close()
+		var count int
+		if *ledgers == "" {
+			count, err = storage.ExportAll(db, f)
+		} else {
+			count, err = storage.ExportLedgers(db, f, roots(db))
+		}
+		checkErr(err)
+		fmt.Printf("Exported: %d\n", count)
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"github.com/donovanhide/ripple/crypto"
+	"github.com/donovanhide/ripple/data"
 	"github.com/donovanhide/ripple/ledger"
 	"github.com/donovanhide/ripple/peers"
 	"github.com/donovanhide/ripple/storage"
@@ -14,13 +16,28 @@ import (
 	"os"
 	"os/signal"
 	"runtime"
+	"strings"
 	"time"
 )
 
 var trusted = flag.String("trusted", "r.ripple.com:51235", "trusted hosts separated by commas")
+var cluster = flag.String("cluster", "", "node public keys of our own cluster separated by commas")
 var maxPeers = flag.Int("maxpeers", 1, "maximum number of peers to connect to")
+var bootcache = flag.String("bootcache", "bootcache.json", "file to remember discovered peers in")
+var dbPath = flag.String("db", "", "directory to persist ledgers in, kept in memory if empty")
+var rocksPath = flag.String("rocksdb", "", "RocksDB directory to persist ledgers in instead of -db")
+var keep = flag.Uint("keep", 0, "number of recent ledgers to keep in -db or -rocksdb, all if zero")
+var pruneInterval = flag.Duration("prune", time.Hour, "time between deletions of ledgers older than -keep")
+var capture = flag.String("capture", "", "file to capture all peer protocol messages to")
+var maxInbound = flag.Int("maxinbound", 10, "maximum number of peers to accept connections from")
 var name = flag.String("name", "RippleListener", "name to connect to the peer network as")
 var port = flag.String("port", "51235", "port to use to connect to the peer network")
+var challenge = flag.Bool("challenge", false, "send a proof of work challenge to inbound peers")
+var legacy = flag.Bool("legacy", false, "use the legacy TMHello handshake instead of the HTTP upgrade")
+var validators = flag.String("validators", "", "trusted validator public keys in hex separated by commas")
+var quorum = flag.Int("quorum", 0, "trusted validations needed to validate a ledger, eighty percent of -validators if zero")
+var watch = flag.String("watch", "", "validator public keys in hex to alert on separated by commas")
+var tolerance = flag.Float64("tolerance", 0.05, "agreement below the median at which a watched validator is behind")
 
 func checkErr(err error) {
 	if err != nil {
@@ -36,6 +53,104 @@ func servePeers(m *peers.Manager) http.HandlerFunc {
 	}
 }
 
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	out, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(out)
+}
+
+func serveConsensus(c *ledger.Consensus) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, c.Summaries())
+	}
+}
+
+// Compares every acquired transaction set in the latest round with the majority
+func serveTxSets(c *ledger.Consensus, sets *ledger.TxSets) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		diffs := []*ledger.TxSetDiff{}
+		summaries := c.Summaries()
+		if len(summaries) > 0 {
+			latest := summaries[len(summaries)-1]
+			for set := range latest.TxSets {
+				if set == latest.Majority {
+					continue
+				}
+				if diff, err := sets.Compare(latest.Majority, set); err == nil {
+					diffs = append(diffs, diff)
+				}
+			}
+		}
+		writeJSON(w, diffs)
+	}
+}
+
+func serveValidators(v *ledger.Validators) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, v.Report())
+	}
+}
+
+func serveBehind(v *ledger.Validators, keys []data.PublicKey) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		behind := v.Behind(keys, *tolerance)
+		if len(behind) > 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		writeJSON(w, behind)
+	}
+}
+
+func watchValidators(v *ledger.Validators, keys []data.PublicKey) {
+	for range time.Tick(time.Minute) {
+		for _, stats := range v.Behind(keys, *tolerance) {
+			glog.Warningf("Validator behind: %s Agreement: %0.4f Missed: %d", stats.PublicKey.String(), stats.Agreement, stats.RecentMisses)
+		}
+	}
+}
+
+func parseKeys(s string) ([]data.PublicKey, error) {
+	var keys []data.PublicKey
+	for _, k := range strings.Split(s, ",") {
+		if k = strings.TrimSpace(k); len(k) == 0 {
+			continue
+		}
+		var key data.PublicKey
+		if err := key.UnmarshalText([]byte(k)); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func streamConsensus(c *ledger.Consensus) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+			return
+		}
+		summaries := c.Subscribe()
+		defer c.Unsubscribe(summaries)
+		enc := json.NewEncoder(w)
+		for {
+			select {
+			case summary := <-summaries:
+				if err := enc.Encode(summary); err != nil {
+					return
+				}
+				flusher.Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+}
+
 func main() {
 	flag.Parse()
 	go influxdb.Influxdb(metrics.DefaultRegistry, time.Second*5, &influxdb.Config{
@@ -46,22 +161,59 @@ func main() {
 	signal.Notify(kill, os.Interrupt, os.Kill)
 	key, err := crypto.GenerateRootDeterministicKey(nil)
 	checkErr(err)
-	db := storage.NewEmptyMemoryDB()
+	var db storage.DB = storage.NewEmptyMemoryDB()
+	switch {
+	case *rocksPath != "":
+		rocks, err := storage.NewWritableRocksDB(*rocksPath)
+		checkErr(err)
+		db = storage.NewCachedDB("Storage.RocksDB", rocks, 1000000)
+	case *dbPath != "":
+		db, err = storage.NewLogDB(*dbPath)
+		checkErr(err)
+	}
 	mgr, err := ledger.NewManager(db)
 	checkErr(err)
+	trustedValidators, err := parseKeys(*validators)
+	checkErr(err)
+	if len(trustedValidators) == 0 {
+		glog.Warningln("No trusted validators so no ledgers will be validated")
+	}
+	mgr.Validators().Trust(trustedValidators, *quorum)
 	go mgr.Start()
+	if *keep > 0 {
+		pruner, err := ledger.NewPruner(mgr, uint32(*keep))
+		checkErr(err)
+		go pruner.Run(*pruneInterval)
+	}
 	config := &peers.Config{
-		Key:      key,
-		Name:     *name,
-		Port:     *port,
-		Sync:     mgr,
-		MaxPeers: *maxPeers,
-		Trusted:  *trusted,
+		Key:             key,
+		Name:            *name,
+		Port:            *port,
+		Sync:            mgr,
+		MaxPeers:        *maxPeers,
+		MaxInbound:      *maxInbound,
+		Trusted:         *trusted,
+		Cluster:         *cluster,
+		Bootcache:       *bootcache,
+		Capture:         *capture,
+		Challenge:       *challenge,
+		LegacyHandshake: *legacy,
 	}
 	peerManager, err := peers.NewManager(config)
 	checkErr(err)
+	watched, err := parseKeys(*watch)
+	checkErr(err)
+	if len(watched) > 0 {
+		go watchValidators(mgr.Validators(), watched)
+	}
 	http.Handle("/peers", servePeers(peerManager))
+	http.Handle("/consensus", serveConsensus(mgr.Consensus()))
+	http.Handle("/consensus/stream", streamConsensus(mgr.Consensus()))
+	http.Handle("/txsets", serveTxSets(mgr.Consensus(), mgr.TxSets()))
+	http.Handle("/validators", serveValidators(mgr.Validators()))
+	http.Handle("/validators/behind", serveBehind(mgr.Validators(), watched))
 	go http.ListenAndServe(":8000", nil)
 	<-kill
 	peerManager.Quit <- true
+	db.Close()
 }
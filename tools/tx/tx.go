@@ -6,8 +6,13 @@ import (
 	"github.com/codegangsta/cli"
 	"github.com/donovanhide/ripple/crypto"
 	"github.com/donovanhide/ripple/data"
+	"github.com/donovanhide/ripple/ledger"
+	"github.com/donovanhide/ripple/peers"
+	"github.com/donovanhide/ripple/storage"
 	"github.com/donovanhide/ripple/websockets"
 	"os"
+	"strings"
+	"time"
 )
 
 func checkErr(err error) {
@@ -76,6 +81,74 @@ func submitTx(tx data.Transaction) {
 	os.Exit(0)
 }
 
+func parseValidators(s string) []data.PublicKey {
+	var keys []data.PublicKey
+	for _, k := range strings.Split(s, ",") {
+		if k = strings.TrimSpace(k); len(k) == 0 {
+			continue
+		}
+		var key data.PublicKey
+		checkErr(key.UnmarshalText([]byte(k)))
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// submitViaPeers connects to the peer network, relays the transaction to
+// every peer and waits until it is validated or expires. Only the
+// transaction trees of ledgers are acquired to find it.
+func submitViaPeers(c *cli.Context, tx data.Transaction) {
+	validators := parseValidators(c.GlobalString("validators"))
+	if len(validators) == 0 {
+		checkErr(fmt.Errorf("Trusted validators are required to submit via peers"))
+	}
+	nodeKey, err := crypto.GenerateRootDeterministicKey(nil)
+	checkErr(err)
+	sync, err := ledger.NewManager(storage.NewEmptyMemoryDB())
+	checkErr(err)
+	sync.Validators().Trust(validators, c.GlobalInt("quorum"))
+	sync.AcquireTransactionsOnly()
+	go sync.Start()
+	mgr, err := peers.NewManager(&peers.Config{
+		Key:      nodeKey,
+		Name:     "tx",
+		Port:     "0",
+		Sync:     sync,
+		MaxPeers: c.GlobalInt("maxpeers"),
+		Trusted:  c.GlobalString("trusted"),
+	})
+	checkErr(err)
+	deadline := time.Now().Add(time.Duration(c.GlobalInt("wait")) * time.Second)
+	for {
+		sent, err := mgr.Broadcast(tx)
+		if err == nil {
+			fmt.Printf("Sent to %d peers: %s\n", sent, tx.Hash().String())
+			if sub, ok := sync.Submission(tx.Hash()); ok && sub.Expires != nil {
+				fmt.Printf("Expires around: %s\n", sub.Expires.String())
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			checkErr(err)
+		}
+		time.Sleep(time.Second)
+	}
+	for range time.Tick(5 * time.Second) {
+		sub, _ := sync.Submission(tx.Hash())
+		switch {
+		case sub.Status == ledger.Validated:
+			fmt.Printf("%s: Ledger: %d %s\n", sub.Status, sub.LedgerSequence, sub.LedgerHash.String())
+			os.Exit(0)
+		case sub.Status == ledger.Expired:
+			fmt.Printf("%s: LastLedgerSequence: %d\n", sub.Status, sub.LastLedgerSequence)
+			os.Exit(1)
+		case time.Now().After(deadline):
+			fmt.Printf("%s: Timed out\n", sub.Status)
+			os.Exit(1)
+		}
+	}
+}
+
 func payment(c *cli.Context) {
 	// Validate and parse required fields
 	if c.String("dest") == "" || c.String("amount") == "" || key == nil {
@@ -110,7 +183,10 @@ func payment(c *cli.Context) {
 	checkErr(err)
 	fmt.Println(string(out))
 
-	if c.GlobalBool("submit") {
+	switch {
+	case c.GlobalBool("via-peers"):
+		submitViaPeers(c, payment)
+	case c.GlobalBool("submit"):
 		submitTx(payment)
 	}
 }
@@ -141,6 +217,12 @@ func main() {
 		cli.IntFlag{"sequence,q", 0, "the sequence for the transaction"},
 		cli.IntFlag{"lastledger,l", 0, "highest ledger number that the transaction can appear in"},
 		cli.BoolFlag{"submit,t", "submits the transaction via websocket"},
+		cli.BoolFlag{"via-peers", "submits the transaction directly to the peer network"},
+		cli.StringFlag{"trusted", "r.ripple.com:51235", "peers to connect to separated by commas when submitting via peers"},
+		cli.StringFlag{"validators", "", "trusted validator public keys in hex separated by commas when submitting via peers"},
+		cli.IntFlag{"quorum", 0, "trusted validations needed to validate a ledger, eighty percent of validators if zero"},
+		cli.IntFlag{"maxpeers", 5, "maximum number of peers to submit via"},
+		cli.IntFlag{"wait", 600, "seconds to wait for validation when submitting via peers"},
 	}
 	app.Before = common
 	app.Commands = []cli.Command{{